@@ -4,13 +4,13 @@ go 1.17
 
 require (
 	github.com/AllenDang/giu v0.5.7-0.20211013022220-3e7b1996bbbd
+	github.com/AllenDang/imgui-go v1.12.1-0.20210929095526-68b309906bdc
 	github.com/intel-go/cpuid v0.0.0-20210602155658-5747e5cec0d9
 	github.com/lucas-clemente/quic-go v0.23.0
 )
 
 require (
 	github.com/AllenDang/go-findfont v0.0.0-20200702051237-9f180485aeb8 // indirect
-	github.com/AllenDang/imgui-go v1.12.1-0.20210929095526-68b309906bdc // indirect
 	github.com/cheekybits/genny v1.0.0 // indirect
 	github.com/faiface/mainthread v0.0.0-20171120011319-8b78f0a41ae3 // indirect
 	github.com/fsnotify/fsnotify v1.4.9 // indirect
@@ -6,6 +6,7 @@ import (
 	"example.com/itsuMain/lib/util"
 	"example.com/itsuMain/lib/vm"
 	"net"
+	"time"
 )
 
 type PingRequestMessage struct{ Token int32 }
@@ -70,9 +71,13 @@ func (m ClientQueryRequest) GetSignatureToken() uint64 { return m.Token }
 
 func (m *ClientQueryRequest) SetSignatureToken(v uint64) { m.Token = v }
 
+//ClientInformation describes a connected agent. ConnectedAt is when its current connection was made,
+//FirstSeen is when the server first saw an agent with the same host, user and executable since it started.
 type ClientInformation struct {
-	SysInfo util.SystemInformation
-	Address string
+	SysInfo     util.SystemInformation
+	Address     string
+	ConnectedAt time.Time
+	FirstSeen   time.Time
 }
 
 type ClientQueryReply struct {
@@ -114,8 +119,11 @@ const (
 	CompFieldGOOS     = 2
 	CompFieldHostname = 3
 	CompFieldUsername = 4
+	CompFieldAddress  = 5
 )
 
+//CompareWith is the original evaluation of the condition, the server evaluates the condition program that Compile translates it into instead.
+//It is kept as the reference that the translation is tested against.
 func (c ProxyCondition) CompareWith(information util.SystemInformation, address net.Addr) bool {
 	compareInt := func(sv, cv int32, typ int8) bool {
 		comps := map[int8]func(sv, cv int32) bool{
@@ -149,12 +157,12 @@ func (c ProxyCondition) CompareWith(information util.SystemInformation, address
 		return pass
 	}
 
-	return compareInt(c.RTCPU, int32(information.GONumCPU), c.Comparisons[0]) &&
-		compareInt(c.CPUIDCPU, int32(information.ProcMaxID), c.Comparisons[1]) &&
-		compareString(c.GOOS, information.GOOS, c.Comparisons[2]) &&
-		compareString(c.Hostname, information.Hostname, c.Comparisons[3]) &&
-		compareString(c.Username, information.Username, c.Comparisons[4]) &&
-		compareString(c.Address, address.String(), c.Comparisons[5]) &&
+	return compareInt(c.RTCPU, int32(information.GONumCPU), c.Comparisons[CompFieldRTCPU]) &&
+		compareInt(c.CPUIDCPU, int32(information.ProcMaxID), c.Comparisons[CompFieldCPUIDCPU]) &&
+		compareString(c.GOOS, information.GOOS, c.Comparisons[CompFieldGOOS]) &&
+		compareString(c.Hostname, information.Hostname, c.Comparisons[CompFieldHostname]) &&
+		compareString(c.Username, information.Username, c.Comparisons[CompFieldUsername]) &&
+		compareString(c.Address, address.String(), c.Comparisons[CompFieldAddress]) &&
 		compareMask(c.CPUIDFeatures, information.ProcFeatures) &&
 		compareMask(c.CPUIDExtendedFeatures, information.ProcExtendedFeatures) &&
 		compareMask(c.CPUIDExtraFeatures, information.ProcExtraFeatures)
@@ -178,6 +186,10 @@ func (m ProxyRequest) GetSignatureToken() uint64 { return m.Token }
 
 func (m *ProxyRequest) SetSignatureToken(v uint64) { m.Token = v }
 
+type ErrorBadRequestMessage struct{ Reason string }
+
+func (m ErrorBadRequestMessage) GetID() MessageID { return MIDErrorBadRequest }
+
 type ProxyReply struct {
 	RelayedTo []uint64
 }
@@ -211,6 +223,7 @@ func init() {
 	gob.Register(ClientQueryRequest{})
 	gob.Register(ClientQueryReply{})
 	gob.Register(ProxyRequest{})
+	gob.Register(ErrorBadRequestMessage{})
 	gob.Register(ProxyReply{})
 	gob.Register(FetchProxyRequest{})
 	gob.Register(FetchProxyReply{})
@@ -0,0 +1,291 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"example.com/itsuMain/lib/util"
+	"example.com/itsuMain/lib/vm"
+	"net"
+	"strings"
+)
+
+var (
+	ErrorConditionResult = errors.New("condition program did not leave a boolean on the stack")
+)
+
+//ConditionBindings returns the values that the CNAMED_* constants of a condition program are linked against for a given agent.
+//Every field of the SystemInformation is bound under its own name, RTCPU and CPUIDCPU are bound as well to match the fields of ProxyCondition.
+//The CPUID feature masks are bound as exact ints, Env is bound as a list of "key=value" strings.
+//Address, ConnectedAt and FirstSeen are bound from the ClientInformation, the timestamps as times.
+//IP is the remote address without its port, for use with IN_CIDR.
+func ConditionBindings(client ClientInformation) map[string]interface{} {
+	info := client.SysInfo
+
+	return map[string]interface{}{
+		"GONumCPU": info.GONumCPU,
+		"GOOS":     info.GOOS,
+		"GOARCH":   info.GOARCH,
+
+		"ProcVendor":           strings.TrimRight(info.ProcVendor, "\000"),
+		"ProcBranding":         strings.TrimRight(info.ProcBranding, "\000"),
+		"ProcMaxID":            info.ProcMaxID,
+		"ProcFeatures":         vm.MakeInt(info.ProcFeatures),
+		"ProcExtendedFeatures": vm.MakeInt(info.ProcExtendedFeatures),
+		"ProcExtraFeatures":    vm.MakeInt(info.ProcExtraFeatures),
+
+		"Hostname":   info.Hostname,
+		"Username":   info.Username,
+		"CacheDir":   info.CacheDir,
+		"ConfigDir":  info.ConfigDir,
+		"HomeDir":    info.HomeDir,
+		"WorkingDir": info.WorkingDir,
+		"ExecPath":   info.ExecPath,
+
+		"UID":    info.UID,
+		"UIDStr": info.UIDStr,
+		"EUID":   info.EUID,
+		"GID":    info.GID,
+		"GidStr": info.GidStr,
+		"EGID":   info.EGID,
+
+		"Env": info.Env,
+
+		"RTCPU":    info.GONumCPU,
+		"CPUIDCPU": info.ProcMaxID,
+		"Address":  client.Address,
+		"IP":       addressIP(client.Address),
+
+		"ConnectedAt": client.ConnectedAt,
+		"FirstSeen":   client.FirstSeen,
+	}
+}
+
+//ConditionHostFunctions returns the host functions that condition programs may call for a given agent.
+//The signatures do not depend on the agent, the functions of an empty SystemInformation can be used for verification.
+func ConditionHostFunctions(info util.SystemInformation) []vm.HostFunction {
+	lookupEnv := func(name string) (string, bool) {
+		for _, v := range info.Env {
+			if k, val, ok := cutString(v, "="); ok && k == name {
+				return val, true
+			}
+		}
+
+		return "", false
+	}
+
+	return []vm.HostFunction{
+		{
+			Name:    "getenv",
+			Args:    []vm.Kind{vm.KindString},
+			Returns: []vm.Kind{vm.KindString},
+			Fn: func(args []vm.Value) ([]vm.Value, error) {
+				v, _ := lookupEnv(args[0].Data.(string))
+				return []vm.Value{vm.MakeValue(v)}, nil
+			},
+		},
+		{
+			Name:    "hasenv",
+			Args:    []vm.Kind{vm.KindString},
+			Returns: []vm.Kind{vm.KindBool},
+			Fn: func(args []vm.Value) ([]vm.Value, error) {
+				_, ok := lookupEnv(args[0].Data.(string))
+				return []vm.Value{vm.MakeValue(ok)}, nil
+			},
+		},
+	}
+}
+
+//addressIP strips the port from the address, addresses without a port are returned as they are
+func addressIP(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+
+	return address
+}
+
+func cutString(s, sep string) (before, after string, found bool) {
+	if idx := strings.Index(s, sep); idx != -1 {
+		return s[:idx], s[idx+len(sep):], true
+	}
+
+	return s, "", false
+}
+
+//CheckCondition statically verifies the program and links it against the bindings of an empty ClientInformation.
+//Every binding exists for every agent with the same kind, so a program that passes cannot fail to link later on.
+//The kinds of the program are checked against these bindings as well: programs with an instruction that fails whenever it is reached
+//or that cannot leave a bool on the stack are rejected, instructions that only fail for some kinds are returned as warnings.
+func CheckCondition(program vm.BuiltProgram) (warnings []vm.KindError, err error) {
+	empty := util.SystemInformation{}
+	bindings := ConditionBindings(ClientInformation{})
+
+	if err = program.Verify(ConditionHostFunctions(empty)...); err != nil {
+		return
+	}
+
+	if _, err = program.Link(bindings, ConditionHostFunctions(empty)...); err != nil {
+		return
+	}
+
+	kinds := make(map[string]vm.Kind, len(bindings))
+	for name, v := range bindings {
+		if value, err := vm.ToValue(v); err == nil {
+			kinds[name] = value.Kind
+		}
+	}
+
+	report, err := program.CheckKinds(kinds, ConditionHostFunctions(empty)...)
+	if err != nil {
+		return
+	} else if len(report.Errors) != 0 {
+		return report.Warnings, report.Errors[0]
+	}
+
+	for _, v := range report.Results {
+		if v == vm.KindBool {
+			return report.Warnings, nil
+		}
+	}
+
+	return report.Warnings, ErrorConditionResult
+}
+
+//LinkCondition links the program against the bindings and host functions of the given agent
+func LinkCondition(program vm.BuiltProgram, client ClientInformation) (vm.Program, error) {
+	return program.Link(ConditionBindings(client), ConditionHostFunctions(client.SysInfo)...)
+}
+
+//EvaluateCondition links the program against the bindings of the given agent and runs it within vm.DefaultLimits until it halts.
+//The agent is targeted if the program leaves true on the top of the stack.
+func EvaluateCondition(ctx context.Context, program vm.BuiltProgram, client ClientInformation) (bool, error) {
+	linked, err := LinkCondition(program, client)
+	if err != nil {
+		return false, err
+	}
+
+	if res, err := vm.NewVM(linked).Run(ctx, vm.DefaultLimits); err != nil {
+		return false, err
+	} else if res.Top.Kind != vm.KindBool {
+		return false, ErrorConditionResult
+	} else {
+		return res.Top.Data.(bool), nil
+	}
+}
+
+//numberComparisons are the opcodes that test the result of CMP for the comparison codes of ProxyCondition, 0 is handled separately
+var numberComparisons = map[int8]byte{
+	-3: vm.OpLT,
+	-2: vm.OpLE,
+	-1: vm.OpNE,
+	1:  vm.OpEQ,
+	2:  vm.OpGE,
+	3:  vm.OpGT,
+}
+
+//Compile translates the condition into a condition program that makes the same decisions as CompareWith,
+//except for processor counts beyond the range of int32, which CompareWith truncates.
+//Comparisons that are always true are left out, a condition with an unknown comparison code compiles to false like it evaluates to.
+func (c ProxyCondition) Compile() (vm.BuiltProgram, error) {
+	b := vm.NewProgramBuilder()
+	terms := 0
+
+	//term loads the named constant of the agent, the rest of the comparison is emitted by the caller
+	term := func(name string, kind vm.Kind) {
+		idx, _ := b.ReserveTypedConstant(name, kind)
+		b.EmitCLoad(idx)
+	}
+	//and combines the term that was just emitted with the ones before it
+	and := func() {
+		if terms++; terms > 1 {
+			b.EmitByte(vm.OpLAND)
+		}
+	}
+	constant := func(v bool) (vm.BuiltProgram, error) {
+		b = vm.NewProgramBuilder()
+		b.EmitConst(vm.MakeValue(v))
+		return b.Build()
+	}
+
+	numbers := []struct {
+		name string
+		sv   int32
+		typ  int8
+	}{
+		{"RTCPU", c.RTCPU, c.Comparisons[CompFieldRTCPU]},
+		{"CPUIDCPU", c.CPUIDCPU, c.Comparisons[CompFieldCPUIDCPU]},
+	}
+	for _, v := range numbers {
+		op, ok := numberComparisons[v.typ]
+		if !ok && v.typ != 0 {
+			return constant(false)
+		} else if v.typ == 0 || v.sv == 0 {
+			continue
+		}
+
+		term(v.name, vm.KindNumber)
+		b.EmitConst(vm.MakeValue(v.sv))
+		b.EmitByte(vm.OpCMP)
+		b.EmitByte(op)
+		and()
+	}
+
+	texts := []struct {
+		name string
+		sv   string
+		typ  int8
+	}{
+		{"GOOS", c.GOOS, c.Comparisons[CompFieldGOOS]},
+		{"Hostname", c.Hostname, c.Comparisons[CompFieldHostname]},
+		{"Username", c.Username, c.Comparisons[CompFieldUsername]},
+		{"Address", c.Address, c.Comparisons[CompFieldAddress]},
+	}
+	for _, v := range texts {
+		var op byte
+		switch v.typ {
+		case 0:
+			continue
+		case 1:
+			op = vm.OpEQ
+		case -1:
+			op = vm.OpNE
+		default:
+			return constant(false)
+		}
+
+		term(v.name, vm.KindString)
+		b.EmitConst(vm.MakeValue(v.sv))
+		b.EmitByte(vm.OpCMP)
+		b.EmitByte(op)
+		and()
+	}
+
+	//every bit of the mask must be set in the features of the agent
+	masks := []struct {
+		name string
+		sv   uint64
+	}{
+		{"ProcFeatures", c.CPUIDFeatures},
+		{"ProcExtendedFeatures", c.CPUIDExtendedFeatures},
+		{"ProcExtraFeatures", c.CPUIDExtraFeatures},
+	}
+	for _, v := range masks {
+		if v.sv == 0 {
+			continue
+		}
+
+		term(v.name, vm.KindInt)
+		b.EmitConst(vm.MakeInt(v.sv))
+		b.EmitByte(vm.OpIAND)
+		b.EmitConst(vm.MakeInt(v.sv))
+		b.EmitByte(vm.OpCMP)
+		b.EmitByte(vm.OpEQ)
+		and()
+	}
+
+	if terms == 0 {
+		return constant(true)
+	}
+
+	return b.Build()
+}
@@ -0,0 +1,147 @@
+package message
+
+import (
+	"context"
+	"example.com/itsuMain/lib/util"
+	"example.com/itsuMain/lib/vm"
+	"example.com/itsuMain/lib/vm/itsu_forth"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestEvaluateCondition(t *testing.T) {
+	agents := []util.SystemInformation{
+		{GONumCPU: 8, GOOS: "linux", Hostname: "build-01"},
+		{GONumCPU: 2, GOOS: "windows", Username: "root"},
+		{GONumCPU: 1, GOOS: "darwin"},
+	}
+
+	tests := []struct {
+		source   string
+		expected []bool
+	}{
+		{`CNAMED_GOOS "linux" CMP EQ CNAMED_GOOS "windows" CMP EQ OR`, []bool{true, true, false}},
+		{`CNAMED_GOOS "linux" CMP EQ NOT`, []bool{false, true, true}},
+		{`CNAMED_RTCPU 1 SUB 4 CMP GE`, []bool{true, false, false}},
+		{`8 CNAMED_RTCPU DIV 4 CMP EQ`, []bool{false, true, false}},
+		{`CNAMED_Username "root" CMP EQ NOT NOT CNAMED_RTCPU 1 SUB 0 CMP EQ OR`, []bool{false, true, true}},
+	}
+
+	for k, v := range tests {
+		builder := vm.NewProgramBuilder()
+		if err := itsu_forth.CompileFORTH(builder, v.source); err != nil {
+			t.Fatal("test ", k, " failed: ", err)
+		}
+		program, err := builder.Build()
+		if err != nil {
+			t.Fatal("test ", k, " failed: ", err)
+		}
+
+		for n, a := range agents {
+			if res, err := EvaluateCondition(context.Background(), program, ClientInformation{SysInfo: a, Address: "10.0.0.1:4000"}); err != nil || res != v.expected[n] {
+				t.Error("test ", k, " failed for agent ", n, ": ", res, ", ", err)
+			}
+		}
+	}
+
+	builder := vm.NewProgramBuilder()
+	builder.EmitConst(vm.MakeValue(1))
+	program, _ := builder.Build()
+	if _, err := EvaluateCondition(context.Background(), program, ClientInformation{SysInfo: agents[0]}); err != ErrorConditionResult {
+		t.Error("non-boolean result was accepted: ", err)
+	}
+}
+
+//conditionCorpus returns agents and conditions whose values are drawn from small pools, so that equal values are common
+func conditionCorpus(r *rand.Rand) ([]ClientInformation, []ProxyCondition) {
+	counts := []int32{0, 1, 2, 4, 8, 64}
+	texts := []string{"", "linux", "windows", "build-01", "root", "10.0.0.1:4000"}
+	masks := []uint64{0, 1, 0x8000000000000001, 0xFFFFFFFFFFFFFFFF, 0x00F0}
+	codes := []int8{-4, -3, -2, -1, 0, 1, 2, 3, 4}
+
+	agents := make([]ClientInformation, 0)
+	for i := 0; i < 40; i++ {
+		agents = append(agents, ClientInformation{
+			SysInfo: util.SystemInformation{
+				GONumCPU:             int(counts[r.Intn(len(counts))]),
+				ProcMaxID:            uint32(counts[r.Intn(len(counts))]),
+				GOOS:                 texts[r.Intn(len(texts))],
+				Hostname:             texts[r.Intn(len(texts))],
+				Username:             texts[r.Intn(len(texts))],
+				ProcFeatures:         masks[r.Intn(len(masks))],
+				ProcExtendedFeatures: masks[r.Intn(len(masks))],
+				ProcExtraFeatures:    masks[r.Intn(len(masks))],
+			},
+			Address: []string{"10.0.0.1:4000", "[2001:db8::1]:4000"}[r.Intn(2)],
+		})
+	}
+
+	conditions := make([]ProxyCondition, 0)
+	for i := 0; i < 400; i++ {
+		c := ProxyCondition{
+			RTCPU:                 counts[r.Intn(len(counts))],
+			CPUIDCPU:              counts[r.Intn(len(counts))],
+			GOOS:                  texts[r.Intn(len(texts))],
+			Hostname:              texts[r.Intn(len(texts))],
+			Username:              texts[r.Intn(len(texts))],
+			Address:               texts[r.Intn(len(texts))],
+			CPUIDFeatures:         masks[r.Intn(len(masks))],
+			CPUIDExtendedFeatures: masks[r.Intn(len(masks))],
+			CPUIDExtraFeatures:    masks[r.Intn(len(masks))],
+		}
+
+		//most codes are valid, otherwise almost every condition would be false
+		for k := range c.Comparisons {
+			if r.Intn(8) == 0 {
+				c.Comparisons[k] = codes[r.Intn(len(codes))]
+			} else if k < CompFieldGOOS {
+				c.Comparisons[k] = codes[1+r.Intn(7)]
+			} else {
+				c.Comparisons[k] = codes[3+r.Intn(3)]
+			}
+		}
+
+		conditions = append(conditions, c)
+	}
+
+	return agents, append(conditions, ProxyCondition{})
+}
+
+func TestProxyCondition_Compile(t *testing.T) {
+	agents, conditions := conditionCorpus(rand.New(rand.NewSource(1)))
+	matches := 0
+
+	for k, c := range conditions {
+		program, err := c.Compile()
+		if err != nil {
+			t.Fatal("condition ", k, " failed: ", err)
+		}
+
+		if _, err = CheckCondition(program); err != nil {
+			t.Error("condition ", k, " was rejected: ", err)
+			continue
+		}
+
+		for n, a := range agents {
+			address, err := net.ResolveTCPAddr("tcp", a.Address)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := c.CompareWith(a.SysInfo, address)
+			if res, err := EvaluateCondition(context.Background(), program, a); err != nil {
+				t.Error("condition ", k, " failed for agent ", n, ": ", err)
+			} else if res != expected {
+				t.Error("condition ", k, " decided ", res, " for agent ", n, " instead of ", expected, "\n", program.Disassemble())
+			} else if res {
+				matches++
+			}
+		}
+	}
+
+	//the corpus has to cover both decisions
+	if total := len(conditions) * len(agents); matches == 0 || matches == total {
+		t.Error("corpus is one-sided: ", matches, " of ", total, " match")
+	}
+}
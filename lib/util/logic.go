@@ -17,10 +17,10 @@ var (
 
 	RelBicond    = Relation(0b1001) //p == q
 	RelNotQ      = Relation(0b1010) //!q
-	RelConvImply = Relation(0b1011) //p <= q
+	RelConvImply = Relation(0b1011) //q -> p
 	RelNotP      = Relation(0b1100) //!p
 	RelImply     = Relation(0b1101) //p -> q
-	RelOr        = Relation(0b1110) //p || q
+	RelOr        = Relation(0b0111) //p || q
 	RelTrue      = Relation(0b1111) //true
 
 	RelNEQ = RelXor
@@ -31,10 +31,10 @@ func TTableEval(p, q bool, rel Relation) bool {
 	idx := uint8(0)
 
 	if p {
-		idx |= 0b01
+		idx |= 0b10
 	}
 	if q {
-		idx |= 0b10
+		idx |= 0b01
 	}
 
 	idx = 3 - idx
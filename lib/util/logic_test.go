@@ -0,0 +1,36 @@
+package util
+
+import "testing"
+
+func TestTTableEval(t *testing.T) {
+	type ttableTest struct {
+		rel  Relation
+		fn   func(p, q bool) bool
+		name string
+	}
+
+	tests := []ttableTest{
+		{RelFalse, func(p, q bool) bool { return false }, "false"},
+		{RelAnd, func(p, q bool) bool { return p && q }, "and"},
+		{RelP, func(p, q bool) bool { return p }, "p"},
+		{RelQ, func(p, q bool) bool { return q }, "q"},
+		{RelXor, func(p, q bool) bool { return p != q }, "xor"},
+		{RelBicond, func(p, q bool) bool { return p == q }, "bicond"},
+		{RelNotQ, func(p, q bool) bool { return !q }, "not q"},
+		{RelConvImply, func(p, q bool) bool { return p || !q }, "converse imply"},
+		{RelNotP, func(p, q bool) bool { return !p }, "not p"},
+		{RelImply, func(p, q bool) bool { return !p || q }, "imply"},
+		{RelOr, func(p, q bool) bool { return p || q }, "or"},
+		{RelTrue, func(p, q bool) bool { return true }, "true"},
+	}
+
+	for _, v := range tests {
+		for _, p := range []bool{false, true} {
+			for _, q := range []bool{false, true} {
+				if TTableEval(p, q, v.rel) != v.fn(p, q) {
+					t.Error("test ", v.name, " failed for ", p, ", ", q)
+				}
+			}
+		}
+	}
+}
@@ -43,6 +43,19 @@ func Spaceship(lhs, rhs interface{}) (res int) {
 			res = 1
 		}
 		break
+	case reflect.Float32, reflect.Float64:
+		v0 := vLhs.Float()
+		v1 := vRhs.Float()
+		if v0 < v1 {
+			res = -1
+		} else if v0 == v1 {
+			res = 0
+		} else if v0 > v1 {
+			res = 1
+		} else {
+			res = 2
+		}
+		break
 	case reflect.String:
 		v0 := vLhs.String()
 		v1 := vRhs.String()
@@ -1,11 +1,14 @@
 package util
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func TestSpaceship(t *testing.T) {
-	s0s := []interface{}{0, 1, 0, "A", "B", "A", 0, 0}
-	s1s := []interface{}{0, 0, 1, "A", "A", "B", uint(0), "A"}
-	res := []int{0, 1, -1, 0, 1, -1, 2, 2}
+	s0s := []interface{}{0, 1, 0, "A", "B", "A", 0, 0, 1.5, 8., 64., math.NaN()}
+	s1s := []interface{}{0, 0, 1, "A", "A", "B", uint(0), "A", 1.5, 64., 8., 0.}
+	res := []int{0, 1, -1, 0, 1, -1, 2, 2, 0, -1, 1, 2}
 
 	for k, e := range res {
 		r := Spaceship(s0s[k], s1s[k])
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrorVersion = errors.New("malformed version")
+)
+
+//Version is a semantic version, Pre holds the dot separated identifiers of the pre-release. Build metadata does not affect precedence and is dropped.
+type Version struct {
+	Major, Minor, Patch uint64
+	Pre                 []string
+}
+
+//isIdentifier reports whether s is a non-empty pre-release or build identifier, which consist of ASCII alphanumerics and hyphens
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && c != '-' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isNumericIdentifier(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+//ParseVersion parses MAJOR[.MINOR[.PATCH]][-PRERELEASE][+BUILD] with an optional leading "v", missing components are 0
+func ParseVersion(s string) (v Version, err error) {
+	s = strings.TrimPrefix(s, "v")
+
+	if idx := strings.Index(s, "+"); idx != -1 {
+		for _, id := range strings.Split(s[idx+1:], ".") {
+			if !isIdentifier(id) {
+				return Version{}, ErrorVersion
+			}
+		}
+		s = s[:idx]
+	}
+
+	if idx := strings.Index(s, "-"); idx != -1 {
+		v.Pre = strings.Split(s[idx+1:], ".")
+		for _, id := range v.Pre {
+			if !isIdentifier(id) {
+				return Version{}, ErrorVersion
+			}
+		}
+		s = s[:idx]
+	}
+
+	components := strings.Split(s, ".")
+	if len(components) > 3 {
+		return Version{}, ErrorVersion
+	}
+
+	numbers := []*uint64{&v.Major, &v.Minor, &v.Patch}
+	for k, c := range components {
+		if !isNumericIdentifier(c) || c == "" {
+			return Version{}, ErrorVersion
+		}
+
+		if *numbers[k], err = strconv.ParseUint(c, 10, 64); err != nil {
+			return Version{}, ErrorVersion
+		}
+	}
+
+	return
+}
+
+//Compare orders versions by semantic versioning precedence, (<, ==, >) = (-1, 0, 1).
+//A pre-release is lower than its release, numeric identifiers are compared numerically and are lower than alphanumeric ones.
+func (v Version) Compare(o Version) int {
+	for k, lhs := range []uint64{v.Major, v.Minor, v.Patch} {
+		if rhs := []uint64{o.Major, o.Minor, o.Patch}[k]; lhs < rhs {
+			return -1
+		} else if lhs > rhs {
+			return 1
+		}
+	}
+
+	if len(v.Pre) == 0 || len(o.Pre) == 0 {
+		return compareInts(len(o.Pre), len(v.Pre))
+	}
+
+	for k := 0; k < len(v.Pre) && k < len(o.Pre); k++ {
+		if res := compareIdentifiers(v.Pre[k], o.Pre[k]); res != 0 {
+			return res
+		}
+	}
+
+	return compareInts(len(v.Pre), len(o.Pre))
+}
+
+func compareInts(lhs, rhs int) int {
+	if lhs < rhs {
+		return -1
+	} else if lhs > rhs {
+		return 1
+	}
+
+	return 0
+}
+
+func compareIdentifiers(lhs, rhs string) int {
+	lNumeric, rNumeric := isNumericIdentifier(lhs), isNumericIdentifier(rhs)
+
+	switch {
+	case lNumeric && rNumeric:
+		//numeric identifiers may exceed 64 bits, without leading zeros the longer one is larger
+		lhs, rhs = strings.TrimLeft(lhs, "0"), strings.TrimLeft(rhs, "0")
+		if res := compareInts(len(lhs), len(rhs)); res != 0 {
+			return res
+		}
+	case lNumeric:
+		return -1
+	case rNumeric:
+		return 1
+	}
+
+	return strings.Compare(lhs, rhs)
+}
+
+//CompareVersions parses both versions and compares them like Version.Compare
+func CompareVersions(lhs, rhs string) (int, error) {
+	l, err := ParseVersion(lhs)
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := ParseVersion(rhs)
+	if err != nil {
+		return 0, err
+	}
+
+	return l.Compare(r), nil
+}
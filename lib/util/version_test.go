@@ -0,0 +1,24 @@
+package util
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	s0s := []string{"1.10.0", "1.4.1", "v1.4.2", "1.4", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0+build.5", "2.0.0-18446744073709551616"}
+	s1s := []string{"1.9.0", "1.4.2", "1.4.2", "1.4.0", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.0", "2.0.0-9"}
+	res := []int{1, -1, 0, 0, -1, -1, -1, -1, -1, -1, 0, 1}
+
+	for k, e := range res {
+		if r, err := CompareVersions(s0s[k], s1s[k]); err != nil || r != e {
+			t.Error("test ", k, " failed: ", r, err)
+		}
+	}
+
+	for k, v := range []string{"", "1.", "1.2.3.4", "1.x", "1.0.0-", "1.0.0-a..b", "1.0.0+", "1.0.0-a_b", "-1.0.0", "1.0.0-+"} {
+		if _, err := ParseVersion(v); !errors.Is(err, ErrorVersion) {
+			t.Error("bad version ", k, " failed: ", err)
+		}
+	}
+}
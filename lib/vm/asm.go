@@ -0,0 +1,556 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+listing format, one statement per line, ';' starts a comment:
+.const <index> <kind> [value]  constant pool entry, indices must be sequential, list values are written as [<kind> [value], ...]
+.name <name> <index>           reserved (named) constant
+.symbol <name> <offset|label>  callable symbol
+.source <offset> <line> <col> "token"  source map entry, offsets must be increasing
+.byte <value>                  raw byte, used for code that does not decode
+<label>:                       marks the current offset
+<hex offset>: <MNEMONIC> [arg] instruction, the offset is optional and checked if present
+
+arguments are numbers or labels for jumps, 0b prefixed bits for truth tables, floats for NCONST, integers for ICONST and element counts for LSTNEW.
+NCONST values that do not survive a round trip through text (i.e. NaN payloads) are written as #<hex bits>.
+*/
+
+var (
+	ErrorAsmSyntax      = errors.New("syntax error")
+	ErrorAsmMnemonic    = errors.New("unknown mnemonic")
+	ErrorAsmLabel       = errors.New("unknown label")
+	ErrorAsmDuplicate   = errors.New("duplicate label")
+	ErrorAsmOffset      = errors.New("offset annotation does not match")
+	ErrorAsmConstIndex  = errors.New("constant indices must be sequential")
+	ErrorAsmConstKind   = errors.New("unsupported constant kind")
+	ErrorAsmConstValue  = errors.New("bad constant value")
+	ErrorAsmArgument    = errors.New("bad argument")
+	ErrorAsmNameOutside = errors.New("named constant index is out of bounds")
+)
+
+//AsmError carries the line at which assembly failed
+type AsmError struct {
+	Line int
+	Err  error
+}
+
+func (e AsmError) Error() string { return fmt.Sprintf("line %d: %s", e.Line, e.Err) }
+
+func (e AsmError) Unwrap() error { return e.Err }
+
+func labelName(pc int) string { return fmt.Sprintf("L%04x", pc) }
+
+func formatConstant(v Value) string {
+	switch v.Kind {
+	case KindNumber:
+		return "num " + strconv.FormatFloat(v.Data.(float64), 'g', -1, 64)
+	case KindBool:
+		return "bool " + strconv.FormatBool(v.Data.(bool))
+	case KindString:
+		return "str " + strconv.Quote(v.Data.(string))
+	case KindInt:
+		return fmt.Sprintf("int 0x%x", v.Data.(uint64))
+	case KindTime:
+		return "time " + v.Data.(time.Time).Format(time.RFC3339Nano)
+	case KindDuration:
+		return "dur " + v.Data.(time.Duration).String()
+	case KindList:
+		elements := make([]string, 0, len(v.Data.([]Value)))
+		for _, e := range v.Data.([]Value) {
+			elements = append(elements, formatConstant(e))
+		}
+		return "list [" + strings.Join(elements, ", ") + "]"
+	default:
+		return v.Kind.String()
+	}
+}
+
+func formatNumber(n float64) string {
+	str := strconv.FormatFloat(n, 'g', -1, 64)
+	if back, err := strconv.ParseFloat(str, 64); err != nil || math.Float64bits(back) != math.Float64bits(n) {
+		return fmt.Sprintf("#%016x", math.Float64bits(n))
+	}
+
+	return str
+}
+
+//Disassemble produces a listing of the program that Assemble turns back into an identical BuiltProgram
+func (b BuiltProgram) Disassemble() string {
+	sb := strings.Builder{}
+
+	for k, v := range b.constantPool {
+		fmt.Fprintf(&sb, ".const %d %s\n", k, formatConstant(v))
+	}
+
+	names := make([]string, 0, len(b.reservedConstantIndices))
+	constantNames := make(map[uint32]string)
+	for k, v := range b.reservedConstantIndices {
+		names = append(names, k)
+		constantNames[v] = k
+	}
+	sort.Strings(names)
+	for _, v := range names {
+		fmt.Fprintf(&sb, ".name %s %d\n", v, b.reservedConstantIndices[v])
+	}
+
+	symbols := make([]string, 0, len(b.symbols))
+	for k := range b.symbols {
+		symbols = append(symbols, k)
+	}
+	sort.Strings(symbols)
+	for _, v := range symbols {
+		fmt.Fprintf(&sb, ".symbol %s %d\n", v, b.symbols[v])
+	}
+
+	for _, v := range b.sourceMap {
+		fmt.Fprintf(&sb, ".source %d %d %d %s\n", v.PC, v.Pos.Line, v.Pos.Column, strconv.Quote(v.Pos.Token))
+	}
+
+	type listedInstruction struct {
+		ins  decodedInstruction
+		good bool
+	}
+
+	listing := make([]listedInstruction, 0)
+	boundaries := make(map[int]bool)
+	for pc := 0; pc < len(b.program); {
+		ins := decodedInstruction{pc: pc, opcode: b.program[pc], props: GetOpcodeProperties(b.program[pc])}
+		if ins.props.Bad() || ins.next() > len(b.program) {
+			listing = append(listing, listedInstruction{ins, false})
+			pc++
+			continue
+		}
+
+		ins.arg = b.program[pc+1 : ins.next()]
+		listing = append(listing, listedInstruction{ins, true})
+		boundaries[pc] = true
+		pc = ins.next()
+	}
+	boundaries[len(b.program)] = true
+
+	targets := make(map[int]bool)
+	for _, v := range listing {
+		if v.good && isStaticJump(v.ins.opcode) && boundaries[int(v.ins.index())] {
+			targets[int(v.ins.index())] = true
+		}
+	}
+
+	for _, v := range listing {
+		ins := v.ins
+
+		if targets[ins.pc] {
+			fmt.Fprintf(&sb, "%s:\n", labelName(ins.pc))
+		}
+
+		if !v.good {
+			fmt.Fprintf(&sb, ".byte 0x%02x\n", ins.opcode)
+			continue
+		}
+
+		fmt.Fprintf(&sb, "%04x: %s", ins.pc, ins.props.Name)
+
+		switch {
+		case ins.opcode == OpICONST:
+			var n uint64
+			_ = binary.Read(bytes.NewReader(ins.arg), binary.LittleEndian, &n)
+			fmt.Fprintf(&sb, " 0x%x", n)
+		case ins.props.ArgSize == 8:
+			var n float64
+			_ = binary.Read(bytes.NewReader(ins.arg), binary.LittleEndian, &n)
+			fmt.Fprintf(&sb, " %s", formatNumber(n))
+		case ins.opcode == OpLSTNEW:
+			fmt.Fprintf(&sb, " %d", ins.arg[0])
+		case ins.props.ArgSize == 1:
+			fmt.Fprintf(&sb, " 0b%04b", ins.arg[0])
+		case isStaticJump(ins.opcode) && targets[int(ins.index())]:
+			fmt.Fprintf(&sb, " %s", labelName(int(ins.index())))
+		case ins.props.ArgSize == 4:
+			fmt.Fprintf(&sb, " %d", ins.index())
+		}
+
+		if ins.opcode == OpCLOAD || ins.opcode == OpHCALL {
+			if name, ok := constantNames[ins.index()]; ok {
+				fmt.Fprintf(&sb, " ; %s", name)
+			} else if ins.index() < uint32(len(b.constantPool)) {
+				fmt.Fprintf(&sb, " ; %s", formatConstant(b.constantPool[ins.index()]))
+			}
+		}
+
+		sb.WriteByte('\n')
+	}
+
+	if targets[len(b.program)] {
+		fmt.Fprintf(&sb, "%s:\n", labelName(len(b.program)))
+	}
+
+	return sb.String()
+}
+
+func isStaticJump(opcode byte) bool {
+	return opcode == OpJMP || opcode == OpJMPT || opcode == OpJMPF || opcode == OpCALL
+}
+
+//stripComment removes everything after the first ';' that is not inside a string literal
+func stripComment(line string) string {
+	inString, inEscape := false, false
+	for k, r := range line {
+		switch {
+		case inEscape:
+			inEscape = false
+		case r == '\\' && inString:
+			inEscape = true
+		case r == '"':
+			inString = !inString
+		case r == ';' && !inString:
+			return line[:k]
+		}
+	}
+
+	return line
+}
+
+func mnemonicTable() map[string]byte {
+	m := make(map[string]byte)
+	for i := 0; i < 256; i++ {
+		if props := GetOpcodeProperties(byte(i)); !props.Bad() {
+			m[props.Name] = byte(i)
+		}
+	}
+
+	return m
+}
+
+//parseConstant parses a constant value as written by formatConstant
+func parseConstant(text string) (v Value, err error) {
+	var rest string
+	if v, rest, err = parseConstantPrefix(text); err != nil {
+		return
+	}
+
+	if strings.TrimSpace(rest) != "" {
+		return ValueNil, ErrorAsmConstValue
+	}
+
+	return
+}
+
+//parseConstantPrefix parses the constant at the beginning of s and returns the text following it
+func parseConstantPrefix(s string) (v Value, rest string, err error) {
+	s = strings.TrimSpace(s)
+
+	word := s
+	if idx := strings.IndexAny(s, " \t,]"); idx != -1 {
+		word = s[:idx]
+	}
+
+	kind, ok := ParseKind(word)
+	if !ok {
+		return ValueNil, s, ErrorAsmConstKind
+	}
+	s = strings.TrimSpace(s[len(word):])
+
+	token := s
+	if idx := strings.IndexAny(s, " \t,]"); idx != -1 {
+		token = s[:idx]
+	}
+
+	switch kind {
+	case KindNil:
+		return ValueNil, s, nil
+	case KindNumber:
+		if n, err := strconv.ParseFloat(token, 64); err != nil {
+			return ValueNil, s, ErrorAsmConstValue
+		} else {
+			return MakeValue(n), s[len(token):], nil
+		}
+	case KindBool:
+		if b, err := strconv.ParseBool(token); err != nil {
+			return ValueNil, s, ErrorAsmConstValue
+		} else {
+			return MakeValue(b), s[len(token):], nil
+		}
+	case KindInt:
+		if n, err := strconv.ParseUint(token, 0, 64); err != nil {
+			return ValueNil, s, ErrorAsmConstValue
+		} else {
+			return MakeInt(n), s[len(token):], nil
+		}
+	case KindTime:
+		if t, err := time.Parse(time.RFC3339Nano, token); err != nil {
+			return ValueNil, s, ErrorAsmConstValue
+		} else {
+			return MakeTime(t), s[len(token):], nil
+		}
+	case KindDuration:
+		if d, err := time.ParseDuration(token); err != nil {
+			return ValueNil, s, ErrorAsmConstValue
+		} else {
+			return MakeDuration(d), s[len(token):], nil
+		}
+	case KindString:
+		if str, err := strconv.QuotedPrefix(s); err != nil {
+			return ValueNil, s, ErrorAsmConstValue
+		} else if unquoted, err := strconv.Unquote(str); err != nil {
+			return ValueNil, s, ErrorAsmConstValue
+		} else {
+			return MakeValue(unquoted), s[len(str):], nil
+		}
+	case KindList:
+		if !strings.HasPrefix(s, "[") {
+			return ValueNil, s, ErrorAsmConstValue
+		}
+		s = strings.TrimSpace(s[1:])
+
+		list := make([]Value, 0)
+		for !strings.HasPrefix(s, "]") {
+			var e Value
+			if e, s, err = parseConstantPrefix(s); err != nil {
+				return
+			}
+			list = append(list, e)
+
+			if s = strings.TrimSpace(s); strings.HasPrefix(s, ",") {
+				s = strings.TrimSpace(s[1:])
+			} else if !strings.HasPrefix(s, "]") {
+				return ValueNil, s, ErrorAsmConstValue
+			}
+		}
+
+		return Value{Data: list, Kind: KindList}, s[1:], nil
+	default:
+		return ValueNil, s, ErrorAsmConstKind
+	}
+}
+
+type asmStatement struct {
+	line     int
+	opcode   byte
+	props    OpcodeProperties
+	arg      string
+	raw      bool
+	rawByte  byte
+	expected int //offset annotation, -1 if absent
+}
+
+//Assemble builds a program from a listing in the format produced by Disassemble
+func Assemble(listing string) (b BuiltProgram, err error) {
+	b = BuiltProgram{
+		program:                 nil,
+		constantPool:            make([]Value, 0),
+		reservedConstantIndices: make(map[string]uint32),
+		symbols:                 make(map[string]uint32),
+	}
+
+	symbolTargets := make(map[string]string)
+	symbolLines := make(map[string]int)
+	mnemonics := mnemonicTable()
+	labels := make(map[string]int)
+	statements := make([]asmStatement, 0)
+	offset := 0
+
+	scanner := bufio.NewScanner(strings.NewReader(listing))
+	scanner.Buffer(make([]byte, 0, 4096), len(listing)+1)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fail := func(e error) error { return AsmError{Line: lineNo, Err: e} }
+
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case ".const":
+			if len(fields) < 3 {
+				return b, fail(ErrorAsmSyntax)
+			}
+
+			if idx, err := strconv.ParseUint(fields[1], 10, 32); err != nil || int(idx) != len(b.constantPool) {
+				return b, fail(ErrorAsmConstIndex)
+			}
+
+			rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(line, ".const")), fields[1]))
+			if v, err := parseConstant(rest); err != nil {
+				return b, fail(err)
+			} else {
+				b.constantPool = append(b.constantPool, v)
+			}
+			continue
+		case ".name":
+			if len(fields) != 3 {
+				return b, fail(ErrorAsmSyntax)
+			}
+
+			if idx, err := strconv.ParseUint(fields[2], 10, 32); err != nil {
+				return b, fail(ErrorAsmArgument)
+			} else {
+				b.reservedConstantIndices[fields[1]] = uint32(idx)
+			}
+			continue
+		case ".symbol":
+			if len(fields) != 3 {
+				return b, fail(ErrorAsmSyntax)
+			}
+
+			symbolTargets[fields[1]] = fields[2]
+			symbolLines[fields[1]] = lineNo
+			continue
+		case ".source":
+			if len(fields) < 5 || !strings.HasPrefix(fields[4], "\"") {
+				return b, fail(ErrorAsmSyntax)
+			}
+
+			var numbers [3]uint64
+			for k := range numbers {
+				if numbers[k], err = strconv.ParseUint(fields[k+1], 10, 32); err != nil {
+					return b, fail(ErrorAsmArgument)
+				}
+			}
+
+			token, err := strconv.Unquote(line[strings.Index(line, "\""):])
+			if err != nil {
+				return b, fail(ErrorAsmArgument)
+			}
+
+			if n := len(b.sourceMap); n != 0 && uint32(numbers[0]) <= b.sourceMap[n-1].PC {
+				return b, fail(ErrorAsmOffset)
+			}
+
+			b.sourceMap = append(b.sourceMap, SourceMapEntry{uint32(numbers[0]), SourcePos{int(numbers[1]), int(numbers[2]), token}})
+			continue
+		case ".byte":
+			if len(fields) != 2 {
+				return b, fail(ErrorAsmSyntax)
+			}
+
+			if v, err := strconv.ParseUint(fields[1], 0, 8); err != nil {
+				return b, fail(ErrorAsmArgument)
+			} else {
+				statements = append(statements, asmStatement{line: lineNo, raw: true, rawByte: byte(v), expected: -1})
+				offset++
+			}
+			continue
+		}
+
+		expected := -1
+		if strings.HasSuffix(fields[0], ":") {
+			name := strings.TrimSuffix(fields[0], ":")
+
+			if len(fields) == 1 {
+				if _, ok := labels[name]; ok {
+					return b, fail(ErrorAsmDuplicate)
+				}
+				labels[name] = offset
+				continue
+			}
+
+			if v, err := strconv.ParseUint(name, 16, 32); err != nil {
+				return b, fail(ErrorAsmSyntax)
+			} else {
+				expected = int(v)
+			}
+			fields = fields[1:]
+		}
+
+		opcode, ok := mnemonics[fields[0]]
+		if !ok {
+			return b, fail(ErrorAsmMnemonic)
+		}
+
+		st := asmStatement{line: lineNo, opcode: opcode, props: GetOpcodeProperties(opcode), expected: expected}
+		if (st.props.ArgSize == 0) != (len(fields) == 1) || len(fields) > 2 {
+			return b, fail(ErrorAsmArgument)
+		}
+		if len(fields) == 2 {
+			st.arg = fields[1]
+		}
+
+		if st.expected != -1 && st.expected != offset {
+			return b, fail(ErrorAsmOffset)
+		}
+
+		statements = append(statements, st)
+		offset += 1 + st.props.ArgSize
+	}
+
+	for k, v := range b.reservedConstantIndices {
+		if v >= uint32(len(b.constantPool)) {
+			return b, AsmError{Line: 0, Err: fmt.Errorf("%w: %s", ErrorAsmNameOutside, k)}
+		}
+	}
+
+	for k, v := range symbolTargets {
+		if pc, err := strconv.ParseUint(v, 0, 32); err == nil {
+			b.symbols[k] = uint32(pc)
+		} else if pc, ok := labels[v]; ok {
+			b.symbols[k] = uint32(pc)
+		} else {
+			return b, AsmError{Line: symbolLines[k], Err: ErrorAsmLabel}
+		}
+	}
+
+	buffer := bytes.Buffer{}
+	for _, st := range statements {
+		fail := func(e error) error { return AsmError{Line: st.line, Err: e} }
+
+		if st.raw {
+			buffer.WriteByte(st.rawByte)
+			continue
+		}
+
+		buffer.WriteByte(st.opcode)
+
+		switch st.props.ArgSize {
+		case 1:
+			if v, err := strconv.ParseUint(st.arg, 0, 8); err != nil {
+				return b, fail(ErrorAsmArgument)
+			} else {
+				buffer.WriteByte(byte(v))
+			}
+		case 4:
+			var index uint32
+			if v, err := strconv.ParseUint(st.arg, 0, 32); err == nil {
+				index = uint32(v)
+			} else if target, ok := labels[st.arg]; ok && isStaticJump(st.opcode) {
+				index = uint32(target)
+			} else if isStaticJump(st.opcode) {
+				return b, fail(ErrorAsmLabel)
+			} else {
+				return b, fail(ErrorAsmArgument)
+			}
+			_ = binary.Write(&buffer, binary.LittleEndian, index)
+		case 8:
+			var bits uint64
+			if st.opcode == OpICONST {
+				if bits, err = strconv.ParseUint(st.arg, 0, 64); err != nil {
+					return b, fail(ErrorAsmArgument)
+				}
+			} else if strings.HasPrefix(st.arg, "#") {
+				if bits, err = strconv.ParseUint(strings.TrimPrefix(st.arg, "#"), 16, 64); err != nil {
+					return b, fail(ErrorAsmArgument)
+				}
+			} else if n, err := strconv.ParseFloat(st.arg, 64); err != nil {
+				return b, fail(ErrorAsmArgument)
+			} else {
+				bits = math.Float64bits(n)
+			}
+			_ = binary.Write(&buffer, binary.LittleEndian, bits)
+		}
+	}
+
+	b.program = buffer.Bytes()
+	err = nil
+	return
+}
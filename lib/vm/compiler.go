@@ -5,14 +5,34 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
-	"io"
+	"math"
 )
 
+var (
+	ErrorDuplicateSymbol = errors.New("symbol is already defined")
+	ErrorConstantKind    = errors.New("named constant is already declared with a different kind")
+	ErrorLabelMarked     = errors.New("label is already marked")
+	ErrorLabelUnmarked   = errors.New("label is used but never marked")
+)
+
+//Label is a code offset that can be jumped to before it is known, labels belong to the builder that created them
+type Label int
+
+//labelFixup is the argument of a jump that is set to the offset of its label by Build
+type labelFixup struct {
+	at    uint32
+	label Label
+}
+
 type ProgramBuilder struct {
 	constantPool []Value
 
 	reservedConstantIndices map[string]uint32
+	symbols                 map[string]uint32
+	sourceMap               []SourceMapEntry
+
+	labels []int //offsets of the labels, -1 until marked
+	fixups []labelFixup
 
 	buffer bytes.Buffer
 }
@@ -21,6 +41,7 @@ func NewProgramBuilder() *ProgramBuilder {
 	b := &ProgramBuilder{
 		constantPool:            make([]Value, 0),
 		reservedConstantIndices: make(map[string]uint32),
+		symbols:                 make(map[string]uint32),
 		buffer:                  bytes.Buffer{},
 	}
 
@@ -32,16 +53,69 @@ func (b *ProgramBuilder) AddConstant(v Value) uint32 {
 	return uint32(len(b.constantPool) - 1)
 }
 
+//ReserveConstant reserves a named constant without a declared kind, it can be bound to a value of any kind
 func (b *ProgramBuilder) ReserveConstant(name string) uint32 {
-	if existingIdx, ok := b.reservedConstantIndices[name]; ok {
-		return existingIdx
-	} else {
-		idx := b.AddConstant(MakeValue(nil))
+	idx, _ := b.ReserveTypedConstant(name, KindNil)
+	return idx
+}
 
+//ReserveTypedConstant reserves a named constant that must be bound to a value of the given kind, KindNil leaves the kind undeclared.
+//The placeholder in the constant pool is the zero value of the kind, a declaration refines an earlier undeclared reservation of the same name.
+func (b *ProgramBuilder) ReserveTypedConstant(name string, kind Kind) (uint32, error) {
+	existingIdx, ok := b.reservedConstantIndices[name]
+	if !ok {
+		idx := b.AddConstant(ZeroValue(kind))
 		b.reservedConstantIndices[name] = idx
+		return idx, nil
+	}
+
+	if existing := b.constantPool[existingIdx].Kind; kind != KindNil && existing != kind {
+		if existing != KindNil {
+			return existingIdx, ErrorConstantKind
+		}
+
+		b.constantPool[existingIdx] = ZeroValue(kind)
+	}
+
+	return existingIdx, nil
+}
+
+//DefineSymbol names the current offset so that it can be called through DCALL
+func (b *ProgramBuilder) DefineSymbol(name string) error {
+	if _, ok := b.symbols[name]; ok {
+		return ErrorDuplicateSymbol
+	}
+
+	b.symbols[name] = uint32(b.buffer.Len())
+	return nil
+}
 
-		return idx
+//Offset returns the offset at which the next instruction is emitted
+func (b *ProgramBuilder) Offset() uint32 { return uint32(b.buffer.Len()) }
+
+//NewLabel creates a label that is not marked yet
+func (b *ProgramBuilder) NewLabel() Label {
+	b.labels = append(b.labels, -1)
+	return Label(len(b.labels) - 1)
+}
+
+//MarkLabel sets the label to the current offset
+func (b *ProgramBuilder) MarkLabel(l Label) error {
+	if int(l) < 0 || int(l) >= len(b.labels) {
+		return ErrorLabelUnmarked
+	} else if b.labels[l] != -1 {
+		return ErrorLabelMarked
 	}
+
+	b.labels[l] = b.buffer.Len()
+	return nil
+}
+
+//EmitJump emits a static jump or call (JMP, JMPT, JMPF or CALL) to the label, which may be marked later on
+func (b *ProgramBuilder) EmitJump(opcode byte, l Label) {
+	b.EmitByte(opcode)
+	b.fixups = append(b.fixups, labelFixup{b.Offset(), l})
+	b.emitGeneric(uint32(0))
 }
 
 func (b *ProgramBuilder) emitGeneric(v interface{}) { binary.Write(&b.buffer, binary.LittleEndian, v) }
@@ -53,10 +127,26 @@ func (b *ProgramBuilder) EmitCLoad(index uint32) {
 	b.emitGeneric(index)
 }
 
+func (b *ProgramBuilder) EmitLoad(index uint32) {
+	b.EmitByte(OpLOAD)
+	b.emitGeneric(index)
+}
+
+func (b *ProgramBuilder) EmitStore(index uint32) {
+	b.EmitByte(OpSTORE)
+	b.emitGeneric(index)
+}
+
+//EmitHostCall emits a call to the host function with the given name
+func (b *ProgramBuilder) EmitHostCall(name string) {
+	b.EmitByte(OpHCALL)
+	b.emitGeneric(b.AddConstant(MakeValue(name)))
+}
+
 func (b *ProgramBuilder) EmitConst(v Value) {
 	switch v.Kind {
 	case KindNumber:
-		if n := v.Data.(float64); n == 0. {
+		if n := v.Data.(float64); n == 0. && !math.Signbit(n) {
 			b.EmitByte(OpNCONST_0)
 		} else if n == 1. {
 			b.EmitByte(OpNCONST_1)
@@ -74,9 +164,16 @@ func (b *ProgramBuilder) EmitConst(v Value) {
 			b.EmitByte(OpBCONST_0)
 		}
 		break
-	case KindString:
+	case KindString, KindList, KindTime, KindDuration:
 		b.EmitCLoad(b.AddConstant(v))
 		break
+	case KindInt:
+		b.EmitByte(OpICONST)
+		b.emitGeneric(v.Data.(uint64))
+		break
+	case KindNil:
+		b.EmitByte(OpNILCONST)
+		break
 	}
 }
 
@@ -86,6 +183,8 @@ type BuiltProgram struct {
 	constantPool []Value
 
 	reservedConstantIndices map[string]uint32
+	symbols                 map[string]uint32
+	sourceMap               []SourceMapEntry
 }
 
 func (b BuiltProgram) GobEncode() ([]byte, error) {
@@ -96,138 +195,46 @@ func (b *BuiltProgram) GobDecode(data []byte) error {
 	if b2, err := DeserializeBuiltProgram(bufio.NewReader(bytes.NewReader(data))); err != nil {
 		return err
 	} else {
-		b.program = b2.program
-		b.constantPool = b2.constantPool
-		b.reservedConstantIndices = b2.reservedConstantIndices
+		*b = b2
 		return nil
 	}
 }
 
-func (b BuiltProgram) Serialize() (buf []byte, err error) {
-	buffer := bytes.Buffer{}
-
-	if err = binary.Write(&buffer, binary.LittleEndian, uint32(len(b.program))); err != nil {
-		return
-	}
-	buffer.Write(b.program)
-
-	if err = binary.Write(&buffer, binary.LittleEndian, uint32(len(b.constantPool))); err != nil {
-		return
-	}
-	for _, v := range b.constantPool {
-		buffer.Write(v.Serialize())
-	}
-
-	if err = binary.Write(&buffer, binary.LittleEndian, uint32(len(b.reservedConstantIndices))); err != nil {
-		return
-	}
-	for k, v := range b.reservedConstantIndices {
-		if err = binary.Write(&buffer, binary.LittleEndian, uint32(len(k))); err != nil {
-			return
-		}
-		buffer.Write([]byte(k))
-		if err = binary.Write(&buffer, binary.LittleEndian, v); err != nil {
-			return
-		}
-	}
-
-	buf = buffer.Bytes()
-
-	return
-}
-
-func DeserializeBuiltProgram(reader *bufio.Reader) (b BuiltProgram, err error) {
-	b = BuiltProgram{
-		program:                 nil,
-		constantPool:            nil,
-		reservedConstantIndices: make(map[string]uint32),
-	}
-
-	var progLen uint32
-	if err = binary.Read(reader, binary.LittleEndian, &progLen); err != nil {
-		return
-	}
-	b.program = make([]byte, progLen)
-	if _, err = io.ReadFull(reader, b.program); err != nil {
-		return
-	}
-
-	var constsLen uint32
-	if err = binary.Read(reader, binary.LittleEndian, &constsLen); err != nil {
-		return
-	}
-	b.constantPool = make([]Value, constsLen)
-	for i := uint32(0); i < constsLen; i++ {
-		var val Value
-		if val, err = DeserializeValue(reader); err != nil {
-			return
-		}
-
-		b.constantPool[i] = val
-	}
-
-	var reservedLen uint32
-	if err = binary.Read(reader, binary.LittleEndian, &reservedLen); err != nil {
-		return
-	}
-	for i := uint32(0); i < reservedLen; i++ {
-		var keyLength uint32
-		var keyBuffer []byte
-		var index uint32
-
-		if err = binary.Read(reader, binary.LittleEndian, &keyLength); err != nil {
-			return
+//Build resolves the jumps to labels and hands the program over, the builder is reset afterwards.
+//If a label was used but never marked the builder is left as it is.
+func (b *ProgramBuilder) Build() (BuiltProgram, error) {
+	code := b.buffer.Bytes()
+	for _, v := range b.fixups {
+		if int(v.label) < 0 || int(v.label) >= len(b.labels) || b.labels[v.label] == -1 {
+			return BuiltProgram{}, ErrorLabelUnmarked
 		}
 
-		keyBuffer = make([]byte, keyLength)
-		if _, err = io.ReadFull(reader, keyBuffer); err != nil {
-			return
-		}
-
-		if err = binary.Read(reader, binary.LittleEndian, &index); err != nil {
-			return
-		}
-
-		b.reservedConstantIndices[string(keyBuffer)] = index
+		binary.LittleEndian.PutUint32(code[v.at:], uint32(b.labels[v.label]))
 	}
 
-	return
-}
-
-func (b *ProgramBuilder) Build() BuiltProgram {
 	b2 := BuiltProgram{
 		program:                 b.buffer.Bytes(),
 		constantPool:            b.constantPool,
 		reservedConstantIndices: b.reservedConstantIndices,
+		symbols:                 b.symbols,
+		sourceMap:               b.sourceMap,
 	}
 
 	b.buffer = bytes.Buffer{}
 	b.constantPool = make([]Value, 0)
 	b.reservedConstantIndices = make(map[string]uint32)
+	b.symbols = make(map[string]uint32)
+	b.sourceMap = nil
+	b.labels = nil
+	b.fixups = nil
 
-	return b2
+	return b2, nil
 }
 
 type Program struct {
 	Program   []byte
 	Constants []Value
-}
-
-func (b BuiltProgram) Link(m map[string]interface{}) (p Program, err error) {
-	p = Program{
-		Program:   b.program,
-		Constants: b.constantPool,
-	}
-
-	for key, index := range b.reservedConstantIndices {
-		if v, ok := m[key]; !ok {
-			if err = errors.New(fmt.Sprint("missing constant in constant mapping with key: ", key)); err != nil {
-				return
-			}
-		} else {
-			b.constantPool[index] = MakeValue(v)
-		}
-	}
-
-	return
+	Symbols   map[string]uint32
+	Hosts     map[string]HostFunction
+	SourceMap []SourceMapEntry
 }
@@ -0,0 +1,305 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+/*
+container format, all integers are little endian:
+magic         4 bytes, "ITSU"
+version       uint16
+section count uint16
+section table section count * (id uint16, length uint32), ids are strictly increasing
+sections      the bodies of the sections in the order of the table
+checksum      uint32, CRC-32 (IEEE) of everything above
+
+sections:
+code      the bytecode
+constants uint32 count, followed by serialized values
+names     uint32 count, followed by (uint32 length, name, uint32 constant index), sorted by name
+symbols   same as names, with code offsets instead of constant indices
+debug     uint32 count, followed by source map entries (uint32 pc, uint32 line, uint32 column, uint32 length, token), sorted by pc
+
+empty sections are omitted, unknown sections are skipped when reading
+*/
+
+const (
+	containerVersion = 1
+
+	//maxSectionLength and maxContainerLength bound the allocations made while reading untrusted containers
+	maxSectionLength   = 1 << 24
+	maxContainerLength = 1 << 24
+
+	//maxValueDepth is the deepest nesting of lists that is deserialized
+	maxValueDepth = 32
+)
+
+var containerMagic = [4]byte{'I', 'T', 'S', 'U'}
+
+const (
+	SectionCode      = uint16(1)
+	SectionConstants = uint16(2)
+	SectionNames     = uint16(3)
+	SectionSymbols   = uint16(4)
+	SectionDebug     = uint16(5)
+)
+
+var (
+	ErrorContainerMagic    = errors.New("not a program container")
+	ErrorContainerVersion  = errors.New("unsupported container version")
+	ErrorContainerSection  = errors.New("malformed section table")
+	ErrorContainerChecksum = errors.New("container checksum mismatch")
+	ErrorContainerTrailing = errors.New("section has trailing bytes")
+	ErrorContainerLength   = errors.New("container is too large")
+	ErrorValueDepth        = errors.New("value is nested too deeply")
+	ErrorValueKind         = errors.New("value has an unknown kind")
+)
+
+type containerSection struct {
+	id   uint16
+	body []byte
+}
+
+//Serialize encodes the program as a container, the encoding of a program is always the same
+func (b BuiltProgram) Serialize() (buf []byte, err error) {
+	sections := make([]containerSection, 0, 4)
+	add := func(id uint16, body []byte) {
+		if len(body) != 0 {
+			sections = append(sections, containerSection{id, body})
+		}
+	}
+
+	add(SectionCode, b.program)
+
+	if len(b.constantPool) != 0 {
+		constants := bytes.Buffer{}
+		_ = binary.Write(&constants, binary.LittleEndian, uint32(len(b.constantPool)))
+		for _, v := range b.constantPool {
+			constants.Write(v.Serialize())
+		}
+		add(SectionConstants, constants.Bytes())
+	}
+
+	add(SectionNames, serializeIndexMap(b.reservedConstantIndices))
+	add(SectionSymbols, serializeIndexMap(b.symbols))
+	add(SectionDebug, serializeSourceMap(b.sourceMap))
+
+	buffer := bytes.Buffer{}
+	buffer.Write(containerMagic[:])
+	_ = binary.Write(&buffer, binary.LittleEndian, uint16(containerVersion))
+	_ = binary.Write(&buffer, binary.LittleEndian, uint16(len(sections)))
+	for _, v := range sections {
+		if len(v.body) > maxSectionLength {
+			return nil, ErrorContainerSection
+		}
+
+		_ = binary.Write(&buffer, binary.LittleEndian, v.id)
+		_ = binary.Write(&buffer, binary.LittleEndian, uint32(len(v.body)))
+	}
+	for _, v := range sections {
+		buffer.Write(v.body)
+	}
+	_ = binary.Write(&buffer, binary.LittleEndian, crc32.ChecksumIEEE(buffer.Bytes()))
+
+	buf = buffer.Bytes()
+	return
+}
+
+//Digest is the SHA-256 of the serialized program, programs that serialize identically have the same digest
+func (b BuiltProgram) Digest() (digest [sha256.Size]byte, err error) {
+	var serialized []byte
+	if serialized, err = b.Serialize(); err != nil {
+		return
+	}
+
+	return sha256.Sum256(serialized), nil
+}
+
+//DeserializeBuiltProgram reads a container written by Serialize, the checksum is verified before the sections are decoded
+func DeserializeBuiltProgram(reader *bufio.Reader) (b BuiltProgram, err error) {
+	b = BuiltProgram{
+		program:                 make([]byte, 0),
+		constantPool:            make([]Value, 0),
+		reservedConstantIndices: make(map[string]uint32),
+		symbols:                 make(map[string]uint32),
+	}
+
+	crc := crc32.NewIEEE()
+	tee := io.TeeReader(reader, crc)
+
+	var magic [4]byte
+	if _, err = io.ReadFull(tee, magic[:]); err != nil {
+		return
+	} else if magic != containerMagic {
+		return b, ErrorContainerMagic
+	}
+
+	var version, count uint16
+	if err = binary.Read(tee, binary.LittleEndian, &version); err != nil {
+		return
+	} else if version != containerVersion {
+		return b, ErrorContainerVersion
+	}
+
+	if err = binary.Read(tee, binary.LittleEndian, &count); err != nil {
+		return
+	}
+
+	//the table is not trusted for preallocation, the bodies are allocated as they are read
+	sections := make([]containerSection, 0)
+	lengths := make([]uint32, 0)
+	total := uint32(0)
+	for k := 0; k < int(count); k++ {
+		var id uint16
+		var length uint32
+		if err = binary.Read(tee, binary.LittleEndian, &id); err != nil {
+			return
+		}
+		if err = binary.Read(tee, binary.LittleEndian, &length); err != nil {
+			return
+		}
+
+		if length > maxSectionLength || (k != 0 && id <= sections[k-1].id) {
+			return b, ErrorContainerSection
+		}
+		if total += length; total > maxContainerLength {
+			return b, ErrorContainerLength
+		}
+
+		sections = append(sections, containerSection{id, nil})
+		lengths = append(lengths, length)
+	}
+
+	for k := range sections {
+		if sections[k].body, err = readBounded(tee, lengths[k]); err != nil {
+			return
+		}
+	}
+
+	var checksum uint32
+	expected := crc.Sum32()
+	if err = binary.Read(reader, binary.LittleEndian, &checksum); err != nil {
+		return
+	} else if checksum != expected {
+		return b, ErrorContainerChecksum
+	}
+
+	for _, v := range sections {
+		section := bufio.NewReader(bytes.NewReader(v.body))
+
+		switch v.id {
+		case SectionCode:
+			b.program = v.body
+			continue
+		case SectionConstants:
+			var length uint32
+			if err = binary.Read(section, binary.LittleEndian, &length); err != nil {
+				return
+			}
+
+			for i := uint32(0); i < length; i++ {
+				var val Value
+				if val, err = DeserializeValue(section); err != nil {
+					return
+				}
+
+				b.constantPool = append(b.constantPool, val)
+			}
+		case SectionNames:
+			if b.reservedConstantIndices, err = deserializeIndexMap(section); err != nil {
+				return
+			}
+		case SectionSymbols:
+			if b.symbols, err = deserializeIndexMap(section); err != nil {
+				return
+			}
+		case SectionDebug:
+			if b.sourceMap, err = deserializeSourceMap(section); err != nil {
+				return
+			}
+		default:
+			continue
+		}
+
+		if _, peekErr := section.Peek(1); peekErr != io.EOF {
+			return b, ErrorContainerTrailing
+		}
+	}
+
+	return
+}
+
+func serializeIndexMap(m map[string]uint32) []byte {
+	if len(m) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buffer := bytes.Buffer{}
+	_ = binary.Write(&buffer, binary.LittleEndian, uint32(len(m)))
+	for _, k := range keys {
+		_ = binary.Write(&buffer, binary.LittleEndian, uint32(len(k)))
+		buffer.WriteString(k)
+		_ = binary.Write(&buffer, binary.LittleEndian, m[k])
+	}
+
+	return buffer.Bytes()
+}
+
+func deserializeIndexMap(reader *bufio.Reader) (m map[string]uint32, err error) {
+	m = make(map[string]uint32)
+
+	var length uint32
+	if err = binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return
+	}
+	for i := uint32(0); i < length; i++ {
+		var keyLength uint32
+		var keyBuffer []byte
+		var index uint32
+
+		if err = binary.Read(reader, binary.LittleEndian, &keyLength); err != nil {
+			return
+		}
+
+		if keyLength > maxSectionLength {
+			return m, ErrorContainerSection
+		}
+
+		if keyBuffer, err = readBounded(reader, keyLength); err != nil {
+			return
+		}
+
+		if err = binary.Read(reader, binary.LittleEndian, &index); err != nil {
+			return
+		}
+
+		m[string(keyBuffer)] = index
+	}
+
+	return
+}
+
+//readBounded reads length bytes, memory is allocated as the bytes arrive so that a length that is larger than the input does not allocate it
+func readBounded(reader io.Reader, length uint32) ([]byte, error) {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if _, err := io.CopyN(buffer, reader, int64(length)); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
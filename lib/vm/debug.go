@@ -0,0 +1,122 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+//SourcePos is the position of the token that an instruction was compiled from, lines and columns start at 1
+type SourcePos struct {
+	Line   int
+	Column int
+	Token  string
+}
+
+func (p SourcePos) String() string { return fmt.Sprintf("%d:%d %q", p.Line, p.Column, p.Token) }
+
+//SourceMapEntry marks the code starting at PC, up to the next entry, as compiled from Pos
+type SourceMapEntry struct {
+	PC  uint32
+	Pos SourcePos
+}
+
+//MarkSource records that the code emitted from now on is compiled from the given position
+func (b *ProgramBuilder) MarkSource(pos SourcePos) {
+	pc := uint32(b.buffer.Len())
+	if n := len(b.sourceMap); n != 0 && b.sourceMap[n-1].PC == pc {
+		b.sourceMap[n-1].Pos = pos
+		return
+	}
+
+	b.sourceMap = append(b.sourceMap, SourceMapEntry{pc, pos})
+}
+
+//lookupSource finds the position that the instruction at pc was compiled from, the source map must be sorted by PC
+func lookupSource(sourceMap []SourceMapEntry, pc int) (SourcePos, bool) {
+	idx := sort.Search(len(sourceMap), func(i int) bool { return int(sourceMap[i].PC) > pc })
+	if idx == 0 {
+		return SourcePos{}, false
+	}
+
+	return sourceMap[idx-1].Pos, true
+}
+
+//SourcePosition returns the position that the instruction at pc was compiled from
+func (b BuiltProgram) SourcePosition(pc int) (SourcePos, bool) { return lookupSource(b.sourceMap, pc) }
+
+//SourcePosition returns the position that the instruction at pc was compiled from
+func (p Program) SourcePosition(pc int) (SourcePos, bool) { return lookupSource(p.SourceMap, pc) }
+
+//RuntimeError is returned by SingleStep when an instruction fails, HasPos is false if the program has no source map entry for PC
+type RuntimeError struct {
+	PC     int
+	Opcode byte
+	Pos    SourcePos
+	HasPos bool
+	Err    error
+}
+
+func (e RuntimeError) Error() string {
+	if e.HasPos {
+		return fmt.Sprintf("pc %d (%s) at %s: %s", e.PC, GetOpcodeProperties(e.Opcode).Name, e.Pos, e.Err)
+	}
+
+	return fmt.Sprintf("pc %d (%s): %s", e.PC, GetOpcodeProperties(e.Opcode).Name, e.Err)
+}
+
+func (e RuntimeError) Unwrap() error { return e.Err }
+
+func (vm *VM) runtimeError(pc int, opcode byte, err error) error {
+	pos, ok := vm.program.SourcePosition(pc)
+	return RuntimeError{PC: pc, Opcode: opcode, Pos: pos, HasPos: ok, Err: err}
+}
+
+func serializeSourceMap(sourceMap []SourceMapEntry) []byte {
+	if len(sourceMap) == 0 {
+		return nil
+	}
+
+	buffer := bytes.Buffer{}
+	_ = binary.Write(&buffer, binary.LittleEndian, uint32(len(sourceMap)))
+	for _, v := range sourceMap {
+		_ = binary.Write(&buffer, binary.LittleEndian, v.PC)
+		_ = binary.Write(&buffer, binary.LittleEndian, uint32(v.Pos.Line))
+		_ = binary.Write(&buffer, binary.LittleEndian, uint32(v.Pos.Column))
+		_ = binary.Write(&buffer, binary.LittleEndian, uint32(len(v.Pos.Token)))
+		buffer.WriteString(v.Pos.Token)
+	}
+
+	return buffer.Bytes()
+}
+
+func deserializeSourceMap(reader *bufio.Reader) (sourceMap []SourceMapEntry, err error) {
+	var length uint32
+	if err = binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return
+	}
+
+	for i := uint32(0); i < length; i++ {
+		var pc, line, column, tokenLength uint32
+		for _, v := range []*uint32{&pc, &line, &column, &tokenLength} {
+			if err = binary.Read(reader, binary.LittleEndian, v); err != nil {
+				return
+			}
+		}
+
+		if tokenLength > maxSectionLength || (i != 0 && pc <= sourceMap[i-1].PC) {
+			return sourceMap, ErrorContainerSection
+		}
+
+		var token []byte
+		if token, err = readBounded(reader, tokenLength); err != nil {
+			return
+		}
+
+		sourceMap = append(sourceMap, SourceMapEntry{pc, SourcePos{int(line), int(column), string(token)}})
+	}
+
+	return
+}
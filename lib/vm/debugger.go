@@ -0,0 +1,153 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+var (
+	ErrorNoCodeAtLine = errors.New("no code was compiled from the line")
+)
+
+//Frame is a copy of a call frame, ReturnPC is -1 for the top level of the program
+type Frame struct {
+	ReturnPC int
+	Locals   map[uint32]Value
+}
+
+//Snapshot is a copy of the state of a VM. Stack is ordered from the bottom to the top, Frames from the top level to the innermost call.
+//Opcode is the instruction at PC, it is OpNOP if PC is outside of the program.
+type Snapshot struct {
+	PC     int
+	SP     int
+	Halted bool
+	Stack  []Value
+	Frames []Frame
+
+	Opcode byte
+	Pos    SourcePos
+	HasPos bool
+}
+
+//Snapshot copies the state of the VM, values are immutable so the elements of lists are shared with the VM
+func (vm *VM) Snapshot() Snapshot {
+	s := Snapshot{
+		PC:     vm.pc,
+		SP:     vm.sp,
+		Halted: vm.halt,
+		Stack:  make([]Value, vm.sp),
+		Frames: make([]Frame, vm.csp),
+		Opcode: OpNOP,
+	}
+
+	copy(s.Stack, vm.stack[:vm.sp])
+
+	for k := range s.Frames {
+		frame := vm.callStack[k]
+		s.Frames[k].ReturnPC = frame.rp
+
+		if frame.vars != nil {
+			s.Frames[k].Locals = make(map[uint32]Value, len(frame.vars))
+			for idx, v := range frame.vars {
+				s.Frames[k].Locals[idx] = v
+			}
+		}
+	}
+
+	if vm.pc >= 0 && vm.pc < len(vm.code) {
+		s.Opcode = vm.code[vm.pc].opcode
+	}
+
+	s.Pos, s.HasPos = vm.program.SourcePosition(vm.pc)
+	return s
+}
+
+//Restore returns the VM to the state of a snapshot that was taken from it, the program is not part of the snapshot and is kept
+func (vm *VM) Restore(s Snapshot) {
+	vm.pc, vm.sp, vm.halt = s.PC, s.SP, s.Halted
+
+	vm.stack = [stackSize]Value{}
+	copy(vm.stack[:], s.Stack)
+
+	vm.callStack = [callStackSize]callFrame{}
+	vm.csp = len(s.Frames)
+	for k, f := range s.Frames {
+		vm.callStack[k].rp = f.ReturnPC
+
+		if f.Locals != nil {
+			vm.callStack[k].vars = make(map[uint32]Value, len(f.Locals))
+			for idx, v := range f.Locals {
+				vm.callStack[k].vars[idx] = v
+			}
+		}
+	}
+}
+
+//Debugger executes a VM under the control of the caller. Every method that executes instructions is bounded by the limits given to NewDebugger
+//and returns like Run, a run that stops at a breakpoint or after a step returns StopPaused.
+type Debugger struct {
+	vm          *VM
+	limits      Limits
+	breakpoints map[int]bool
+}
+
+func NewDebugger(vm *VM, limits Limits) *Debugger {
+	return &Debugger{
+		vm:          vm,
+		limits:      limits,
+		breakpoints: make(map[int]bool),
+	}
+}
+
+func (d *Debugger) VM() *VM { return d.vm }
+
+func (d *Debugger) Snapshot() Snapshot { return d.vm.Snapshot() }
+
+//SetBreakpoint pauses Continue and StepOver before the instruction at pc is executed
+func (d *Debugger) SetBreakpoint(pc int) { d.breakpoints[pc] = true }
+
+func (d *Debugger) ClearBreakpoint(pc int) { delete(d.breakpoints, pc) }
+
+//Breakpoints returns the offsets of all breakpoints in ascending order
+func (d *Debugger) Breakpoints() []int {
+	pcs := make([]int, 0, len(d.breakpoints))
+	for k := range d.breakpoints {
+		pcs = append(pcs, k)
+	}
+	sort.Ints(pcs)
+
+	return pcs
+}
+
+//SetLineBreakpoint sets a breakpoint on the first instruction that was compiled from the given source line and returns its offset
+func (d *Debugger) SetLineBreakpoint(line int) (int, error) {
+	for _, v := range d.vm.program.SourceMap {
+		if v.Pos.Line == line {
+			d.SetBreakpoint(int(v.PC))
+			return int(v.PC), nil
+		}
+	}
+
+	return 0, ErrorNoCodeAtLine
+}
+
+//Step executes a single instruction
+func (d *Debugger) Step(ctx context.Context) (RunResult, error) {
+	return d.vm.run(ctx, d.limits, func() bool { return true })
+}
+
+//StepOver executes a single instruction, CALL and DCALL are executed until the callee returns unless a breakpoint is reached first
+func (d *Debugger) StepOver(ctx context.Context) (RunResult, error) {
+	if d.vm.pc < 0 || d.vm.pc >= len(d.vm.code) || (d.vm.code[d.vm.pc].opcode != OpCALL && d.vm.code[d.vm.pc].opcode != OpDCALL) {
+		return d.Step(ctx)
+	}
+
+	depth := d.vm.csp
+	return d.vm.run(ctx, d.limits, func() bool { return d.vm.csp <= depth || d.breakpoints[d.vm.pc] })
+}
+
+//Continue executes instructions until a breakpoint is reached or the program stops
+func (d *Debugger) Continue(ctx context.Context) (RunResult, error) {
+	return d.vm.run(ctx, d.limits, func() bool { return d.breakpoints[d.vm.pc] })
+}
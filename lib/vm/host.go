@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrorUnknownHost = errors.New("host function is not registered")
+	ErrorHostArity   = errors.New("not enough arguments for host function")
+	ErrorHostReturn  = errors.New("host function returned values that do not match its signature")
+	ErrorHostPanic   = errors.New("host function panicked")
+)
+
+//HostFunction is a Go function that programs can call through HCALL.
+//Args are popped from the stack with the last argument on the top, Returns are pushed in order. KindAny matches every kind.
+type HostFunction struct {
+	Name    string
+	Args    []Kind
+	Returns []Kind
+	Fn      func(args []Value) ([]Value, error)
+}
+
+func kindMatches(expected Kind, v Value) bool {
+	return expected == KindAny || expected == v.Kind
+}
+
+func (f HostFunction) call(args []Value) (ret []Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %s: %v", ErrorHostPanic, f.Name, r)
+		}
+	}()
+
+	for k, v := range args {
+		if !kindMatches(f.Args[k], v) {
+			return nil, ErrorType
+		}
+	}
+
+	if ret, err = f.Fn(args); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name, err)
+	}
+
+	if len(ret) != len(f.Returns) {
+		return nil, ErrorHostReturn
+	}
+	for k, v := range ret {
+		if !kindMatches(f.Returns[k], v) {
+			return nil, ErrorHostReturn
+		}
+	}
+
+	return
+}
+
+//RegisterHostFunction makes the function callable by the program, functions registered on the VM take precedence over the ones given at link time
+func (vm *VM) RegisterHostFunction(f HostFunction) {
+	if vm.hosts == nil {
+		vm.hosts = make(map[string]HostFunction)
+	}
+
+	vm.hosts[f.Name] = f
+}
+
+func (vm *VM) lookupHost(name string) (HostFunction, bool) {
+	if f, ok := vm.hosts[name]; ok {
+		return f, true
+	}
+
+	f, ok := vm.program.Hosts[name]
+	return f, ok
+}
+
+func (vm *VM) CallHost(name string) error {
+	f, ok := vm.lookupHost(name)
+	if !ok {
+		return ErrorUnknownHost
+	}
+
+	if vm.sp < len(f.Args) {
+		return ErrorHostArity
+	}
+
+	args := make([]Value, len(f.Args))
+	copy(args, vm.stack[vm.sp-len(f.Args):vm.sp])
+
+	ret, err := f.call(args)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(f.Args); i++ {
+		vm.sp--
+		vm.stack[vm.sp] = ValueNil
+	}
+
+	for _, v := range ret {
+		if err = vm.Push(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
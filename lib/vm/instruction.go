@@ -4,24 +4,63 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
-	"io"
+	"fmt"
 	"reflect"
+	"time"
 )
 
 /*
 data types:
-bool, number, string
+bool, number, string, int (exact 64 bit unsigned integers), time (UTC instants with nanosecond precision), dur (durations in nanoseconds), list (of any of the above)
 */
 
 type Kind uint16
 
 const (
-	KindNil    = Kind(0)
-	KindNumber = Kind(1)
-	KindBool   = Kind(2)
-	KindString = Kind(3)
+	KindNil      = Kind(0)
+	KindNumber   = Kind(1)
+	KindBool     = Kind(2)
+	KindString   = Kind(3)
+	KindInt      = Kind(4)
+	KindList     = Kind(5)
+	KindTime     = Kind(6)
+	KindDuration = Kind(7)
+
+	//KindAny is never held by a Value, it is used in signatures to accept every kind
+	KindAny = Kind(0xFFFF)
 )
 
+var kindNames = map[Kind]string{
+	KindNil:      "nil",
+	KindNumber:   "num",
+	KindBool:     "bool",
+	KindString:   "str",
+	KindInt:      "int",
+	KindList:     "list",
+	KindTime:     "time",
+	KindDuration: "dur",
+	KindAny:      "any",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+
+	return fmt.Sprint("kind(", uint16(k), ")")
+}
+
+//ParseKind is the inverse of Kind.String
+func ParseKind(s string) (Kind, bool) {
+	for k, name := range kindNames {
+		if name == s {
+			return k, true
+		}
+	}
+
+	return KindNil, false
+}
+
 type Value struct {
 	Data interface{}
 	Kind Kind
@@ -50,6 +89,27 @@ func (v Value) Serialize() []byte {
 		buffer.Write([]byte(v.Data.(string)))
 		break
 
+	case KindInt:
+		binary.Write(&buffer, binary.LittleEndian, v.Data.(uint64))
+		break
+
+	case KindTime:
+		t := v.Data.(time.Time)
+		binary.Write(&buffer, binary.LittleEndian, t.Unix())
+		binary.Write(&buffer, binary.LittleEndian, int32(t.Nanosecond()))
+		break
+
+	case KindDuration:
+		binary.Write(&buffer, binary.LittleEndian, int64(v.Data.(time.Duration)))
+		break
+
+	case KindList:
+		binary.Write(&buffer, binary.LittleEndian, uint32(len(v.Data.([]Value))))
+		for _, e := range v.Data.([]Value) {
+			buffer.Write(e.Serialize())
+		}
+		break
+
 	default:
 		break
 	}
@@ -58,6 +118,11 @@ func (v Value) Serialize() []byte {
 }
 
 func DeserializeValue(reader *bufio.Reader) (v Value, err error) {
+	return deserializeValue(reader, 0)
+}
+
+//deserializeValue reads a value nested in depth lists
+func deserializeValue(reader *bufio.Reader, depth int) (v Value, err error) {
 	var kind uint16
 	if err = binary.Read(reader, binary.LittleEndian, &kind); err != nil {
 		return
@@ -93,16 +158,70 @@ func DeserializeValue(reader *bufio.Reader) (v Value, err error) {
 			return
 		}
 
-		buffer := make([]byte, length)
-		if _, err = io.ReadFull(reader, buffer); err != nil {
+		var buffer []byte
+		if buffer, err = readBounded(reader, length); err != nil {
 			return
 		}
 
 		v.Data = string(buffer)
 		break
 
-	default:
+	case KindInt:
+		var n uint64
+		if err = binary.Read(reader, binary.LittleEndian, &n); err != nil {
+			return
+		}
+		v.Data = n
 		break
+
+	case KindTime:
+		var sec int64
+		var nsec int32
+		if err = binary.Read(reader, binary.LittleEndian, &sec); err != nil {
+			return
+		}
+		if err = binary.Read(reader, binary.LittleEndian, &nsec); err != nil {
+			return
+		}
+		v = MakeTime(time.Unix(sec, int64(nsec)))
+		break
+
+	case KindDuration:
+		var d int64
+		if err = binary.Read(reader, binary.LittleEndian, &d); err != nil {
+			return
+		}
+		v = MakeDuration(time.Duration(d))
+		break
+
+	case KindList:
+		if depth == maxValueDepth {
+			return v, ErrorValueDepth
+		}
+
+		var length uint32
+		if err = binary.Read(reader, binary.LittleEndian, &length); err != nil {
+			return
+		}
+
+		//the length is not trusted for preallocation, elements are appended as they are read
+		list := make([]Value, 0)
+		for i := uint32(0); i < length; i++ {
+			var e Value
+			if e, err = deserializeValue(reader, depth+1); err != nil {
+				return
+			}
+			list = append(list, e)
+		}
+
+		v.Data = list
+		break
+
+	case KindNil:
+		break
+
+	default:
+		return v, ErrorValueKind
 	}
 
 	return
@@ -121,16 +240,90 @@ var (
 		Data: "",
 		Kind: KindString,
 	}
+	ValueZeroInt = Value{
+		Data: uint64(0),
+		Kind: KindInt,
+	}
+	ValueZeroList = Value{
+		Data: []Value{},
+		Kind: KindList,
+	}
+	ValueZeroTime = Value{
+		Data: time.Unix(0, 0).UTC(),
+		Kind: KindTime,
+	}
+	ValueZeroDuration = Value{
+		Data: time.Duration(0),
+		Kind: KindDuration,
+	}
 	ValueNil = Value{
 		Data: nil,
 		Kind: KindNil,
 	}
 )
 
+//MakeInt constructs a KindInt Value, MakeValue turns every Go integer into a number instead
+func MakeInt(v uint64) Value {
+	return Value{
+		Data: v,
+		Kind: KindInt,
+	}
+}
+
+//MakeTime constructs a KindTime Value, the time is converted to UTC and its monotonic clock reading is stripped so that equal instants hold equal data
+func MakeTime(t time.Time) Value {
+	return Value{
+		Data: t.UTC().Round(0),
+		Kind: KindTime,
+	}
+}
+
+//MakeDuration constructs a KindDuration Value, MakeValue turns time.Duration into a duration as well
+func MakeDuration(d time.Duration) Value {
+	return Value{
+		Data: d,
+		Kind: KindDuration,
+	}
+}
+
+//MakeList constructs a KindList Value from the given elements
+func MakeList(elements ...Value) Value {
+	list := make([]Value, len(elements))
+	copy(list, elements)
+
+	return Value{
+		Data: list,
+		Kind: KindList,
+	}
+}
+
 //MakeValue constructs a Value from various data types. If nil or an unsupported type is passed, a NilValue will be generated
+//Values are passed through as they are, time.Time and time.Duration become times and durations, slices and arrays become lists of their elements.
 func MakeValue(v interface{}) Value {
+	val, _ := ToValue(v)
+	return val
+}
+
+//ToValue is like MakeValue but fails with ErrorUnsupportedType instead of producing nil for unsupported types
+func ToValue(v interface{}) (Value, error) {
 	if v == nil {
-		return ValueNil
+		return ValueNil, nil
+	}
+
+	//the common cases are handled without reflection
+	switch val := v.(type) {
+	case Value:
+		return val, nil
+	case float64:
+		return Value{Data: val, Kind: KindNumber}, nil
+	case bool:
+		return Value{Data: val, Kind: KindBool}, nil
+	case string:
+		return Value{Data: val, Kind: KindString}, nil
+	case time.Time:
+		return MakeTime(val), nil
+	case time.Duration:
+		return MakeDuration(val), nil
 	}
 
 	switch val := reflect.ValueOf(v); val.Type().Kind() {
@@ -138,32 +331,69 @@ func MakeValue(v interface{}) Value {
 		return Value{
 			Data: float64(val.Int()),
 			Kind: KindNumber,
-		}
+		}, nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return Value{
 			Data: float64(val.Uint()),
 			Kind: KindNumber,
-		}
+		}, nil
 	case reflect.Float32, reflect.Float64:
 		return Value{
 			Data: val.Float(),
 			Kind: KindNumber,
-		}
+		}, nil
 	case reflect.Bool:
 		return Value{
 			Data: val.Bool(),
 			Kind: KindBool,
-		}
+		}, nil
 	case reflect.String:
 		return Value{
 			Data: val.String(),
 			Kind: KindString,
+		}, nil
+	case reflect.Slice, reflect.Array:
+		list := make([]Value, val.Len())
+		for i := range list {
+			var err error
+			if list[i], err = ToValue(val.Index(i).Interface()); err != nil {
+				return ValueNil, err
+			}
 		}
+
+		return Value{
+			Data: list,
+			Kind: KindList,
+		}, nil
 	default:
-		return ValueNil
+		return ValueNil, fmt.Errorf("%w: %s", ErrorUnsupportedType, val.Type())
 	}
 }
 
+//Equal reports whether both values are of the same kind and hold the same data, lists are compared element-wise
+func (v Value) Equal(o Value) bool {
+	if v.Kind != o.Kind {
+		return false
+	}
+
+	if v.Kind != KindList {
+		return v.Data == o.Data
+	}
+
+	lhs, rhs := v.Data.([]Value), o.Data.([]Value)
+	if len(lhs) != len(rhs) {
+		return false
+	}
+
+	for k := range lhs {
+		if !lhs[k].Equal(rhs[k]) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func ZeroValue(kind Kind) Value {
 	switch kind {
 	case KindNumber:
@@ -172,6 +402,14 @@ func ZeroValue(kind Kind) Value {
 		return ValueZeroBool
 	case KindString:
 		return ValueZeroString
+	case KindInt:
+		return ValueZeroInt
+	case KindList:
+		return ValueZeroList
+	case KindTime:
+		return ValueZeroTime
+	case KindDuration:
+		return ValueZeroDuration
 	default:
 		return ValueNil
 	}
@@ -229,8 +467,8 @@ const (
 )
 
 const (
-	OpNADD   = 0x30
-	OpNSUB   = 0x31
+	OpNADD   = 0x30 //also adds durations to times (t d -- t, d t -- t) and durations to each other
+	OpNSUB   = 0x31 //also subtracts times from each other (t1 t2 -- d) and durations from times and durations
 	OpNMUL   = 0x32
 	OpNDIV   = 0x33
 	OpNFMOD  = 0x34
@@ -243,6 +481,50 @@ const (
 	OpNSHR   = 0x3B
 )
 
+const (
+	OpICONST   = 0x40 //8 byte argument
+	OpIAND     = 0x41 //i1 i2 -- (i1&i2)
+	OpIOR      = 0x42
+	OpIXOR     = 0x43
+	OpINOT     = 0x44 //i -- ^i
+	OpISHL     = 0x45 //i n -- (i<<n), n may be a number or an int
+	OpISHR     = 0x46
+	OpITESTBIT = 0x47 //i n -- b (bit n of i is set)
+	OpITON     = 0x48 //i -- n
+	OpNTOI     = 0x49 //n -- i, truncates
+)
+
+const (
+	OpSTRLEN      = 0x50 //s -- n (length in bytes)
+	OpSTRCAT      = 0x51 //s1 s2 -- s1s2
+	OpSTRSUB      = 0x52 //s start n -- s[start:start+n], clamped to the bounds of s
+	OpSTRPREFIX   = 0x53 //s1 s2 -- b (s1 starts with s2)
+	OpSTRSUFFIX   = 0x54 //s1 s2 -- b (s1 ends with s2)
+	OpSTRCONTAINS = 0x55 //s1 s2 -- b (s1 contains s2)
+	OpSTRLOWER    = 0x56 //s -- s
+	OpSTRUPPER    = 0x57 //s -- s
+	OpSTRFOLDEQ   = 0x58 //s1 s2 -- b (s1 and s2 are equal under case folding)
+	OpSTRGLOB     = 0x59 //s pattern -- b (see matchGlob)
+	OpVERCMP      = 0x5A //s1 s2 -- n (like CMP, for semantic versions, see util.ParseVersion)
+	OpINCIDR      = 0x5B //s prefix -- b (the IP address s is within the CIDR prefix, which may be a list of prefixes, s may carry a port)
+)
+
+const (
+	OpLSTNEW    = 0x60 //v1 ... vn -- l, 1 byte argument n
+	OpLSTLEN    = 0x61 //l -- n
+	OpLSTGET    = 0x62 //l n -- v (element n of l)
+	OpLSTIN     = 0x63 //v l -- b (l contains v)
+	OpLSTAPPEND = 0x64 //l v -- l
+)
+
+const (
+	OpNOW  = 0x70 // -- t (the clock of the VM, see SetClock)
+	OpTTON = 0x71 //t -- n (seconds since the Unix epoch)
+	OpNTOT = 0x72 //n -- t
+	OpDTON = 0x73 //d -- n (seconds)
+	OpNTOD = 0x74 //n -- d, truncated to nanoseconds
+)
+
 const (
 	OpHLT   = 0xE0
 	OpNOP   = 0xE1
@@ -253,14 +535,20 @@ const (
 	OpDJMP  = 0xE6 //n --
 	OpDJMPT = 0xE7 //n --
 	OpDJMPF = 0xE8 //n --
-	OpDCALL = 0xE9 //n --
+	OpDCALL = 0xE9 //n|s -- the pc or the name of a symbol
 	OpRET   = 0xEA
+	OpHCALL = 0xEB //4 byte constant index of the name of the host function
 )
 
+//OpcodeProperties describes the encoding of an opcode and its effect on the stack.
+//Pops is the amount of values the instruction requires on the stack, Pushes is the amount of values in their place afterwards.
+//The effects of CALL, RET and HCALL depend on the called function and are left as zero, LSTNEW additionally pops as many values as its argument says.
 type OpcodeProperties struct {
 	ArgSize  int
 	Name     string
 	IndexArg bool
+	Pops     int
+	Pushes   int
 }
 
 var (
@@ -268,60 +556,120 @@ var (
 		ArgSize:  0,
 		Name:     "[invalid opcode]",
 		IndexArg: false,
+		Pops:     0,
+		Pushes:   0,
 	}
 )
 
-func GetOpcodeProperties(opcode byte) OpcodeProperties {
-	m := map[byte]OpcodeProperties{
-		OpNCONST:   {8, "NCONST", false},
-		OpNCONST_0: {0, "NCONST_0", false},
-		OpNCONST_1: {0, "NCONST_1", false},
-		OpNCONST_2: {0, "NCONST_2", false},
-		OpBCONST_0: {0, "BCONST_0", false},
-		OpBCONST_1: {0, "BCONST_1", false},
-		OpCLOAD:    {4, "CLOAD", true},
-		OpLOAD:     {4, "LOAD", true},
-		OpSTORE:    {4, "STORE", true},
-		OpNILCONST: {0, "NILCONST", false},
-		OpISNIL:    {0, "ISNIL", false},
-		OpKIND:     {0, "KIND", false},
-		OpSDUP:     {0, "SDUP", false},
-		OpSDROP:    {0, "SDROP", false},
-		OpSSWAP:    {0, "SSWAP", false},
-		OpSOVER:    {0, "SOVER", false},
-		OpSROT:     {0, "SROT", false},
-		OpCMP:      {0, "CMP", false},
-		OpLT:       {0, "LT", false},
-		OpLE:       {0, "LE", false},
-		OpEQ:       {0, "EQ", false},
-		OpGE:       {0, "GE", false},
-		OpGT:       {0, "GT", false},
-		OpNE:       {0, "NE", false},
-		OpLAND:     {0, "LAND", false},
-		OpLOR:      {0, "LOR", false},
-		OpLXOR:     {0, "LXOR", false},
-		OpLTTBLB:   {0, "LTTBLB", false},
-		OpLNOT:     {0, "LNOT", false},
-		OpLTTBLU:   {0, "LTTBLU", false},
-		OpHLT:      {0, "HLT", false},
-		OpNOP:      {0, "NOP", false},
-		OpJMP:      {4, "JMP", true},
-		OpJMPT:     {4, "JMPT", true},
-		OpJMPF:     {4, "JMPF", true},
-		OpDJMP:     {0, "DJMP", false},
-		OpDJMPT:    {0, "DJMPT", false},
-		OpDJMPF:    {0, "DJMPF", false},
-		OpCALL:     {4, "CALL", true},
-		OpRET:      {0, "RET", false},
-		OpDCALL:    {0, "DCALL", false},
-		//Op: {0, "", false},
+//opcodePropertyTable is indexed by opcode, it is filled from opcodeProperties
+var opcodePropertyTable [256]OpcodeProperties
+
+func init() {
+	for k := range opcodePropertyTable {
+		opcodePropertyTable[k] = BadOpcodeProps
 	}
 
-	if v, ok := m[opcode]; ok {
-		return v
-	} else {
-		return BadOpcodeProps
+	for k, v := range opcodeProperties {
+		opcodePropertyTable[k] = v
 	}
 }
 
+func GetOpcodeProperties(opcode byte) OpcodeProperties { return opcodePropertyTable[opcode] }
+
+var (
+	opcodeProperties = map[byte]OpcodeProperties{
+		OpNCONST:   {8, "NCONST", false, 0, 1},
+		OpNCONST_0: {0, "NCONST_0", false, 0, 1},
+		OpNCONST_1: {0, "NCONST_1", false, 0, 1},
+		OpNCONST_2: {0, "NCONST_2", false, 0, 1},
+		OpBCONST_0: {0, "BCONST_0", false, 0, 1},
+		OpBCONST_1: {0, "BCONST_1", false, 0, 1},
+		OpCLOAD:    {4, "CLOAD", true, 0, 1},
+		OpLOAD:     {4, "LOAD", true, 0, 1},
+		OpSTORE:    {4, "STORE", true, 1, 0},
+		OpNILCONST: {0, "NILCONST", false, 0, 1},
+		OpISNIL:    {0, "ISNIL", false, 1, 2},
+		OpKIND:     {0, "KIND", false, 1, 2},
+		OpSDUP:     {0, "SDUP", false, 1, 2},
+		OpSDROP:    {0, "SDROP", false, 1, 0},
+		OpSSWAP:    {0, "SSWAP", false, 2, 2},
+		OpSOVER:    {0, "SOVER", false, 2, 3},
+		OpSROT:     {0, "SROT", false, 3, 3},
+		OpCMP:      {0, "CMP", false, 2, 1},
+		OpLT:       {0, "LT", false, 1, 1},
+		OpLE:       {0, "LE", false, 1, 1},
+		OpEQ:       {0, "EQ", false, 1, 1},
+		OpGE:       {0, "GE", false, 1, 1},
+		OpGT:       {0, "GT", false, 1, 1},
+		OpNE:       {0, "NE", false, 1, 1},
+		OpLAND:     {0, "LAND", false, 2, 1},
+		OpLOR:      {0, "LOR", false, 2, 1},
+		OpLXOR:     {0, "LXOR", false, 2, 1},
+		OpLTTBLB:   {1, "LTTBLB", false, 2, 1},
+		OpLNOT:     {0, "LNOT", false, 1, 1},
+		OpLTTBLU:   {1, "LTTBLU", false, 1, 1},
+		OpNADD:     {0, "NADD", false, 2, 1},
+		OpNSUB:     {0, "NSUB", false, 2, 1},
+		OpNMUL:     {0, "NMUL", false, 2, 1},
+		OpNDIV:     {0, "NDIV", false, 2, 1},
+		OpNFMOD:    {0, "NFMOD", false, 2, 1},
+		OpNPOW:     {0, "NPOW", false, 2, 1},
+		OpNSQRT:    {0, "NSQRT", false, 1, 1},
+		OpNTRUNC:   {0, "NTRUNC", false, 1, 1},
+		OpNFLOOR:   {0, "NFLOOR", false, 1, 1},
+		OpNCEIL:    {0, "NCEIL", false, 1, 1},
+		OpNSHL:     {0, "NSHL", false, 2, 1},
+		OpNSHR:     {0, "NSHR", false, 2, 1},
+		OpICONST:   {8, "ICONST", false, 0, 1},
+		OpIAND:     {0, "IAND", false, 2, 1},
+		OpIOR:      {0, "IOR", false, 2, 1},
+		OpIXOR:     {0, "IXOR", false, 2, 1},
+		OpINOT:     {0, "INOT", false, 1, 1},
+		OpISHL:     {0, "ISHL", false, 2, 1},
+		OpISHR:     {0, "ISHR", false, 2, 1},
+		OpITESTBIT: {0, "ITESTBIT", false, 2, 1},
+		OpITON:     {0, "ITON", false, 1, 1},
+		OpNTOI:     {0, "NTOI", false, 1, 1},
+
+		OpSTRLEN:      {0, "STRLEN", false, 1, 1},
+		OpSTRCAT:      {0, "STRCAT", false, 2, 1},
+		OpSTRSUB:      {0, "STRSUB", false, 3, 1},
+		OpSTRPREFIX:   {0, "STRPREFIX", false, 2, 1},
+		OpSTRSUFFIX:   {0, "STRSUFFIX", false, 2, 1},
+		OpSTRCONTAINS: {0, "STRCONTAINS", false, 2, 1},
+		OpSTRLOWER:    {0, "STRLOWER", false, 1, 1},
+		OpSTRUPPER:    {0, "STRUPPER", false, 1, 1},
+		OpSTRFOLDEQ:   {0, "STRFOLDEQ", false, 2, 1},
+		OpSTRGLOB:     {0, "STRGLOB", false, 2, 1},
+		OpVERCMP:      {0, "VERCMP", false, 2, 1},
+		OpINCIDR:      {0, "INCIDR", false, 2, 1},
+
+		OpLSTNEW:    {1, "LSTNEW", false, 0, 1},
+		OpLSTLEN:    {0, "LSTLEN", false, 1, 1},
+		OpLSTGET:    {0, "LSTGET", false, 2, 1},
+		OpLSTIN:     {0, "LSTIN", false, 2, 1},
+		OpLSTAPPEND: {0, "LSTAPPEND", false, 2, 1},
+
+		OpNOW:  {0, "NOW", false, 0, 1},
+		OpTTON: {0, "TTON", false, 1, 1},
+		OpNTOT: {0, "NTOT", false, 1, 1},
+		OpDTON: {0, "DTON", false, 1, 1},
+		OpNTOD: {0, "NTOD", false, 1, 1},
+
+		OpHLT:   {0, "HLT", false, 0, 0},
+		OpNOP:   {0, "NOP", false, 0, 0},
+		OpJMP:   {4, "JMP", true, 0, 0},
+		OpJMPT:  {4, "JMPT", true, 1, 1},
+		OpJMPF:  {4, "JMPF", true, 1, 1},
+		OpDJMP:  {0, "DJMP", false, 1, 0},
+		OpDJMPT: {0, "DJMPT", false, 2, 1},
+		OpDJMPF: {0, "DJMPF", false, 2, 1},
+		OpCALL:  {4, "CALL", true, 0, 0},
+		OpRET:   {0, "RET", false, 0, 0},
+		OpDCALL: {0, "DCALL", false, 1, 0},
+		OpHCALL: {4, "HCALL", true, 0, 0},
+		//Op: {0, "", false, 0, 0},
+	}
+)
+
 func (p OpcodeProperties) Bad() bool { return p == BadOpcodeProps }
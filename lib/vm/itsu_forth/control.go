@@ -0,0 +1,235 @@
+package itsu_forth
+
+import (
+	"errors"
+	"example.com/itsuMain/lib/vm"
+)
+
+var (
+	ErrorUnbalanced       = errors.New("unbalanced control structure")
+	ErrorWordName         = errors.New("missing or invalid word name")
+	ErrorNestedDefinition = errors.New("definitions must be at the top level")
+	ErrorNoLoop           = errors.New("no enclosing DO loop")
+)
+
+//loopVariableBase is the first variable index used for the counters of DO loops, well above the indices that programs use through STORE_n and LOAD_n
+const loopVariableBase = 1 << 31
+
+//controlFrame is a control structure or definition that has not been closed yet
+type controlFrame struct {
+	word   string //the word that opened the frame: ":", "IF", "ELSE", "BEGIN" or "DO"
+	pos    vm.SourcePos
+	exit   vm.Label //marked when the frame is closed, or where an IF jumps to if its flag is false
+	target vm.Label //start of the body of a loop or of a word
+	index  uint32   //variable holding the index of a DO loop, the limit is held in the next one
+	name   string   //name of the word being defined
+}
+
+//controlCompiler compiles the words that jump: IF ELSE THEN, BEGIN UNTIL, DO LOOP with I and J, and colon definitions.
+//Flags are popped by the words that consume them although JMPT and JMPF only peek, so both paths of every branch start with SDROP.
+type controlCompiler struct {
+	builder *vm.ProgramBuilder
+	frames  []controlFrame
+	words   map[string]vm.Label
+	vars    uint32
+	naming  bool //set after ":" until the name of the word has been read
+}
+
+func newControlCompiler(builder *vm.ProgramBuilder) *controlCompiler {
+	return &controlCompiler{
+		builder: builder,
+		frames:  make([]controlFrame, 0),
+		words:   make(map[string]vm.Label),
+	}
+}
+
+func isControlWord(s string) bool {
+	switch s {
+	case ":", ";", "IF", "ELSE", "THEN", "BEGIN", "UNTIL", "DO", "LOOP", "I", "J":
+		return true
+	}
+
+	return false
+}
+
+//pop closes the innermost frame, which must have been opened by one of the given words
+func (c *controlCompiler) pop(words ...string) (controlFrame, error) {
+	if len(c.frames) != 0 {
+		f := c.frames[len(c.frames)-1]
+		for _, v := range words {
+			if f.word == v {
+				c.frames = c.frames[:len(c.frames)-1]
+				return f, nil
+			}
+		}
+	}
+
+	return controlFrame{}, ErrorUnbalanced
+}
+
+//mark marks a label that was created by the control compiler, which marks every label exactly once
+func (c *controlCompiler) mark(l vm.Label) { _ = c.builder.MarkLabel(l) }
+
+//loopEntry emits the head of a loop, the returned label drops the flag of the previous iteration and is skipped on entry
+func (c *controlCompiler) loopEntry() vm.Label {
+	skip, target := c.builder.NewLabel(), c.builder.NewLabel()
+	c.builder.EmitJump(vm.OpJMP, skip)
+	c.mark(target)
+	c.builder.EmitByte(vm.OpSDROP)
+	c.mark(skip)
+
+	return target
+}
+
+//loopIndex finds the variable of the DO loop at the given depth, 0 being the innermost loop of the current definition
+func (c *controlCompiler) loopIndex(depth int) (uint32, error) {
+	for k := len(c.frames) - 1; k >= 0 && c.frames[k].word != ":"; k-- {
+		if c.frames[k].word != "DO" {
+			continue
+		}
+
+		if depth == 0 {
+			return c.frames[k].index, nil
+		}
+		depth--
+	}
+
+	return 0, ErrorNoLoop
+}
+
+//compile handles the token if it is a control word or a defined word
+func (c *controlCompiler) compile(token string, pos vm.SourcePos) (bool, error) {
+	b := c.builder
+
+	if c.naming {
+		c.naming = false
+		if isControlWord(token) {
+			return true, ErrorWordName
+		}
+
+		//the symbol is defined at the start of the body so that DCALL by name enters the word
+		c.frames[len(c.frames)-1].name = token
+		c.mark(c.frames[len(c.frames)-1].target)
+		return true, b.DefineSymbol(token)
+	}
+
+	switch token {
+	case ":":
+		if len(c.frames) != 0 {
+			return true, ErrorNestedDefinition
+		}
+
+		f := controlFrame{word: ":", pos: pos, exit: b.NewLabel(), target: b.NewLabel()}
+		b.EmitJump(vm.OpJMP, f.exit)
+		c.frames = append(c.frames, f)
+		c.naming = true
+	case ";":
+		f, err := c.pop(":")
+		if err != nil {
+			return true, err
+		}
+
+		b.EmitByte(vm.OpRET)
+		c.mark(f.exit)
+		c.words[f.name] = f.target
+	case "IF":
+		f := controlFrame{word: "IF", pos: pos, exit: b.NewLabel()}
+		b.EmitJump(vm.OpJMPF, f.exit)
+		b.EmitByte(vm.OpSDROP)
+		c.frames = append(c.frames, f)
+	case "ELSE":
+		f, err := c.pop("IF")
+		if err != nil {
+			return true, err
+		}
+
+		end := b.NewLabel()
+		b.EmitJump(vm.OpJMP, end)
+		c.mark(f.exit)
+		b.EmitByte(vm.OpSDROP)
+		c.frames = append(c.frames, controlFrame{word: "ELSE", pos: pos, exit: end})
+	case "THEN":
+		f, err := c.pop("IF", "ELSE")
+		if err != nil {
+			return true, err
+		}
+
+		if f.word == "IF" {
+			//the false path still has to drop the flag
+			end := b.NewLabel()
+			b.EmitJump(vm.OpJMP, end)
+			c.mark(f.exit)
+			b.EmitByte(vm.OpSDROP)
+			c.mark(end)
+		} else {
+			c.mark(f.exit)
+		}
+	case "BEGIN":
+		c.frames = append(c.frames, controlFrame{word: "BEGIN", pos: pos, target: c.loopEntry()})
+	case "UNTIL":
+		f, err := c.pop("BEGIN")
+		if err != nil {
+			return true, err
+		}
+
+		b.EmitJump(vm.OpJMPF, f.target)
+		b.EmitByte(vm.OpSDROP)
+	case "DO":
+		index := loopVariableBase + c.vars
+		c.vars += 2
+
+		b.EmitStore(index)
+		b.EmitStore(index + 1)
+		c.frames = append(c.frames, controlFrame{word: "DO", pos: pos, target: c.loopEntry(), index: index})
+	case "LOOP":
+		f, err := c.pop("DO")
+		if err != nil {
+			return true, err
+		}
+
+		b.EmitLoad(f.index)
+		b.EmitByte(vm.OpNCONST_1)
+		b.EmitByte(vm.OpNADD)
+		b.EmitByte(vm.OpSDUP)
+		b.EmitStore(f.index)
+		b.EmitLoad(f.index + 1)
+		b.EmitByte(vm.OpCMP)
+		b.EmitByte(vm.OpLT)
+		b.EmitJump(vm.OpJMPT, f.target)
+		b.EmitByte(vm.OpSDROP)
+	case "I", "J":
+		depth := 0
+		if token == "J" {
+			depth = 1
+		}
+
+		index, err := c.loopIndex(depth)
+		if err != nil {
+			return true, err
+		}
+		b.EmitLoad(index)
+	default:
+		entry, ok := c.words[token]
+		if !ok {
+			return false, nil
+		}
+
+		b.EmitJump(vm.OpCALL, entry)
+	}
+
+	return true, nil
+}
+
+//finish reports the innermost structure that was left open
+func (c *controlCompiler) finish() error {
+	if len(c.frames) == 0 {
+		return nil
+	}
+
+	f := c.frames[len(c.frames)-1]
+	if c.naming {
+		return CompileError{f.pos, ErrorWordName}
+	}
+
+	return CompileError{f.pos, ErrorUnbalanced}
+}
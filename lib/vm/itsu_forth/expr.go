@@ -0,0 +1,437 @@
+package itsu_forth
+
+import (
+	"errors"
+	"example.com/itsuMain/lib/vm"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	ErrorExprSyntax   = errors.New("syntax error")
+	ErrorExprChained  = errors.New("comparisons cannot be chained")
+	ErrorExprFunction = errors.New("unknown function")
+	ErrorExprArity    = errors.New("wrong number of arguments")
+	ErrorExprDepth    = errors.New("expression is nested too deeply")
+)
+
+//maxExprDepth bounds the nesting of brackets and unary operators, the parser recurses once for each of them
+const maxExprDepth = 256
+
+//exprFunctions maps the functions of infix expressions to the words that implement them, the arguments are pushed from left to right
+var exprFunctions = map[string]struct {
+	arity int
+	word  string
+}{
+	"strlen":    {1, "STRLEN"},
+	"concat":    {2, "STRCAT"},
+	"substr":    {3, "SUBSTR"},
+	"hasprefix": {2, "HASPREFIX"},
+	"hassuffix": {2, "HASSUFFIX"},
+	"contains":  {2, "CONTAINS"},
+	"lower":     {1, "LOWER"},
+	"upper":     {1, "UPPER"},
+	"foldeq":    {2, "FOLDEQ"},
+	"glob":      {2, "GLOB"},
+	"vercmp":    {2, "VERCMP"},
+	"in_cidr":   {2, "IN_CIDR"},
+
+	"llen": {1, "LLEN"},
+	"nth":  {2, "NTH"},
+	"in":   {2, "IN"},
+
+	"sqrt":  {1, "SQRT"},
+	"trunc": {1, "TRUNC"},
+	"floor": {1, "FLOOR"},
+	"ceil":  {1, "CEIL"},
+	"pow":   {2, "POW"},
+
+	"now":      {0, "NOW"},
+	"unix":     {1, "TTON"},
+	"fromunix": {1, "NTOT"},
+	"seconds":  {1, "DTON"},
+	"duration": {1, "NTOD"},
+}
+
+//exprLevels are the binary operators from the lowest to the highest precedence, comparisons are not associative
+var exprLevels = []struct {
+	operators   map[string][]string
+	associative bool
+}{
+	{map[string][]string{"||": {"OR"}}, true},
+	{map[string][]string{"^^": {"XOR"}}, true},
+	{map[string][]string{"&&": {"AND"}}, true},
+	{map[string][]string{"==": {"CMP", "=="}, "!=": {"CMP", "!="}}, false},
+	{map[string][]string{"<": {"CMP", "<"}, "<=": {"CMP", "<="}, ">": {"CMP", ">"}, ">=": {"CMP", ">="}}, false},
+	{map[string][]string{"+": {"ADD"}, "-": {"SUB"}}, true},
+	{map[string][]string{"*": {"MUL"}, "/": {"DIV"}, "%": {"FMOD"}}, true},
+}
+
+const (
+	exprNumber = iota
+	exprString
+	exprName
+	exprPunct
+	exprEnd
+)
+
+type exprToken struct {
+	kind int
+	text string //the value of string literals, the text of every other token
+	pos  vm.SourcePos
+}
+
+//timeLiteralLength returns the length of the RFC 3339 time at the start of runes or 0 if there is none.
+//The literal ends after its zone, so that it may be followed by an operator without a space in between.
+func timeLiteralLength(runes []rune) int {
+	const layout = "0000-00-00T"
+	if len(runes) < len(layout) {
+		return 0
+	}
+
+	for k, c := range layout {
+		if (c == '0' && !unicode.IsDigit(runes[k])) || (c != '0' && runes[k] != c) {
+			return 0
+		}
+	}
+
+	i := len(layout)
+	for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == ':' || runes[i] == '.') {
+		i++
+	}
+
+	if i < len(runes) && runes[i] == 'Z' {
+		return i + 1
+	} else if i < len(runes) && (runes[i] == '+' || runes[i] == '-') {
+		for i++; i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == ':'); i++ {
+		}
+	}
+
+	return i
+}
+
+//isNumericLiteral reports whether the text of a number token is a number or an int as vm.ParseNumber accepts them, a time or a duration
+func isNumericLiteral(s string) bool {
+	if _, ok := vm.ParseNumber(s); ok {
+		return true
+	} else if _, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return true
+	}
+
+	_, err := time.ParseDuration(s)
+	return err == nil
+}
+
+//lexExpr splits an infix expression into tokens, the last token is always exprEnd
+func lexExpr(str string) ([]exprToken, error) {
+	runes := []rune(str)
+	tokens := make([]exprToken, 0)
+	line, column := 1, 1
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := vm.SourcePos{Line: line, Column: column}
+		start := i
+
+		switch {
+		case r == '\n':
+			line, column = line+1, 1
+			i++
+			continue
+		case unicode.IsSpace(r):
+			column++
+			i++
+			continue
+		case r == '"':
+			sb := strings.Builder{}
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					decoded, n := vm.DecodeEscape(runes[i+1], runes[i+2:])
+					sb.WriteString(decoded)
+					i += n + 1
+					continue
+				}
+				sb.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				pos.Token = string(runes[start:])
+				return nil, CompileError{pos, ErrorExprSyntax}
+			}
+			i++
+
+			pos.Token = string(runes[start:i])
+			tokens = append(tokens, exprToken{exprString, sb.String(), pos})
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			if n := timeLiteralLength(runes[i:]); n != 0 {
+				i += n
+				pos.Token = string(runes[start:i])
+				tokens = append(tokens, exprToken{exprNumber, pos.Token, pos})
+				break
+			}
+
+			for i++; i < len(runes); i++ {
+				c := runes[i]
+				exponentSign := (c == '+' || c == '-') && (runes[i-1] == 'e' || runes[i-1] == 'E')
+				if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '.' && c != '_' && !exponentSign {
+					break
+				}
+			}
+
+			pos.Token = string(runes[start:i])
+			tokens = append(tokens, exprToken{exprNumber, pos.Token, pos})
+		case unicode.IsLetter(r) || r == '_':
+			for i++; i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == ':'); i++ {
+			}
+
+			pos.Token = string(runes[start:i])
+			tokens = append(tokens, exprToken{exprName, pos.Token, pos})
+		default:
+			i++
+			if i < len(runes) {
+				switch string(runes[start : i+1]) {
+				case "||", "&&", "^^", "==", "!=", "<=", ">=":
+					i++
+				}
+			}
+
+			pos.Token = string(runes[start:i])
+			if !strings.Contains("()[],+-*/%<>!", pos.Token) && len(pos.Token) == 1 {
+				return nil, CompileError{pos, ErrorExprSyntax}
+			}
+			tokens = append(tokens, exprToken{exprPunct, pos.Token, pos})
+		}
+
+		column += i - start
+	}
+
+	tokens = append(tokens, exprToken{kind: exprEnd, pos: vm.SourcePos{Line: line, Column: column}})
+	return tokens, nil
+}
+
+//exprParser translates an infix expression into words by recursive descent, every word carries the position of the token it was generated from
+type exprParser struct {
+	tokens []exprToken
+	next   int
+	words  []word
+	depth  int //nesting of unary operands
+}
+
+func (p *exprParser) peek() exprToken { return p.tokens[p.next] }
+
+func (p *exprParser) advance() exprToken {
+	t := p.tokens[p.next]
+	if t.kind != exprEnd {
+		p.next++
+	}
+
+	return t
+}
+
+func (p *exprParser) emit(at exprToken, texts ...string) {
+	for _, v := range texts {
+		p.words = append(p.words, word{v, at.pos})
+	}
+}
+
+func (p *exprParser) fail(t exprToken, err error) error { return CompileError{t.pos, err} }
+
+func (p *exprParser) expect(text string) error {
+	if t := p.advance(); t.kind != exprPunct || t.text != text {
+		return p.fail(t, ErrorExprSyntax)
+	}
+
+	return nil
+}
+
+func (p *exprParser) binary(level int) error {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+
+	if err := p.binary(level + 1); err != nil {
+		return err
+	}
+
+	for operands := 1; ; operands++ {
+		t := p.peek()
+		words, ok := exprLevels[level].operators[t.text]
+		if t.kind != exprPunct || !ok {
+			return nil
+		}
+
+		if operands > 1 && !exprLevels[level].associative {
+			return p.fail(t, ErrorExprChained)
+		}
+
+		p.advance()
+		if err := p.binary(level + 1); err != nil {
+			return err
+		}
+		p.emit(t, words...)
+	}
+}
+
+func (p *exprParser) unary() error {
+	t := p.peek()
+	if p.depth == maxExprDepth {
+		return p.fail(t, ErrorExprDepth)
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+
+	if t.kind != exprPunct || (t.text != "!" && t.text != "-") {
+		return p.primary()
+	}
+	p.advance()
+
+	if t.text == "-" {
+		p.emit(t, "0")
+	}
+
+	if err := p.unary(); err != nil {
+		return err
+	}
+
+	if t.text == "-" {
+		p.emit(t, "SUB")
+	} else {
+		p.emit(t, "NOT")
+	}
+
+	return nil
+}
+
+//arguments parses a comma separated list of expressions up to the closing bracket and returns its length
+func (p *exprParser) arguments(closing string) (n int, err error) {
+	if t := p.peek(); t.kind == exprPunct && t.text == closing {
+		p.advance()
+		return 0, nil
+	}
+
+	for {
+		if err = p.binary(0); err != nil {
+			return
+		}
+		n++
+
+		t := p.advance()
+		if t.kind == exprPunct && t.text == closing {
+			return
+		} else if t.kind != exprPunct || t.text != "," {
+			return n, p.fail(t, ErrorExprSyntax)
+		}
+	}
+}
+
+func (p *exprParser) primary() error {
+	t := p.advance()
+
+	switch t.kind {
+	case exprNumber:
+		if !isNumericLiteral(t.text) {
+			return p.fail(t, ErrorExprSyntax)
+		}
+		p.emit(t, t.text)
+	case exprString:
+		p.emit(t, "\""+t.text+"\"")
+	case exprName:
+		if next := p.peek(); next.kind == exprPunct && next.text == "(" {
+			p.advance()
+			f, ok := exprFunctions[t.text]
+			if !ok {
+				return p.fail(t, ErrorExprFunction)
+			}
+
+			if n, err := p.arguments(")"); err != nil {
+				return err
+			} else if n != f.arity {
+				return p.fail(t, ErrorExprArity)
+			}
+			p.emit(t, f.word)
+			return nil
+		}
+
+		switch t.text {
+		case "true", "false":
+			p.emit(t, t.text)
+		case "nil":
+			p.emit(t, "NIL")
+		default:
+			p.emit(t, "CNAMED_"+t.text)
+		}
+	case exprPunct:
+		switch t.text {
+		case "(":
+			if err := p.binary(0); err != nil {
+				return err
+			}
+			return p.expect(")")
+		case "[":
+			n, err := p.arguments("]")
+			if err != nil {
+				return err
+			}
+			p.emit(t, "LIST_"+strconv.Itoa(n))
+		default:
+			return p.fail(t, ErrorExprSyntax)
+		}
+	default:
+		return p.fail(t, ErrorExprSyntax)
+	}
+
+	return nil
+}
+
+func exprToWords(str string) ([]word, error) {
+	tokens, err := lexExpr(str)
+	if err != nil {
+		return nil, err
+	}
+
+	p := exprParser{tokens: tokens}
+	if err = p.binary(0); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != exprEnd {
+		return nil, p.fail(t, ErrorExprSyntax)
+	}
+
+	return p.words, nil
+}
+
+//StrictExprToFORTH translates an infix expression into Forth words, in the form TokenizeString returns them.
+//Operators from the lowest to the highest precedence: || ^^ && (== !=) (< <= > >=) (+ -) (* / %) and the unary ! and -.
+//Both operands are always evaluated. Names refer to named constants and may declare their kind like in CNAMED_kind:name,
+//literals are numbers and ints as vm.ParseNumber accepts them, times and durations as in CompileFORTH, strings with the escapes of vm.DecodeEscape,
+//true, false, nil and lists in brackets, functions are called as name(args). Times and durations are added and subtracted with + and -.
+//
+//	((const0>=1)&&(const0<=3))||(const1=="asdasdasd")
+//
+//compiles to:
+//
+//	CNAMED_const0 1 CMP >= CNAMED_const0 3 CMP <= AND CNAMED_const1 "asdasdasd" CMP == OR
+func StrictExprToFORTH(str string) ([]string, error) {
+	words, err := exprToWords(str)
+	if err != nil {
+		return nil, err
+	}
+
+	texts := make([]string, len(words))
+	for k, v := range words {
+		texts[k] = v.text
+	}
+
+	return texts, nil
+}
+
+//CompileExpr compiles an infix expression into the builder, the source map refers to the positions within the expression
+func CompileExpr(builder *vm.ProgramBuilder, str string) error {
+	words, err := exprToWords(str)
+	if err != nil {
+		return err
+	}
+
+	return compileWords(builder, words)
+}
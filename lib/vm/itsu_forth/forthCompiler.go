@@ -3,13 +3,52 @@ package itsu_forth
 import (
 	"errors"
 	"example.com/itsuMain/lib/vm"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
+var (
+	ErrorUnknownKind = errors.New("unknown kind")
+	ErrorUnknownWord = errors.New("unknown word")
+)
+
+//CompileError is returned by CompileFORTH, Pos is the token that could not be compiled
+type CompileError struct {
+	Pos vm.SourcePos
+	Err error
+}
+
+func (e CompileError) Error() string {
+	return fmt.Sprintf("line %d, column %d: bad token: %s: %s", e.Pos.Line, e.Pos.Column, e.Pos.Token, e.Err)
+}
+
+func (e CompileError) Unwrap() error { return e.Err }
+
+//CompileFORTH compiles the source into the builder, the position of every token is recorded in the source map of the builder.
+//Besides the words that map to instructions, IF ELSE THEN, BEGIN UNTIL, DO LOOP with I and J, and ": name ... ;" definitions are supported.
+//Comments, escapes and the formats of numeric literals are described at vm.TokenizeStringPositions and vm.ParseNumber.
+//Times are written in RFC 3339 like 2024-05-01T12:00:00Z and durations in the format of time.ParseDuration like 90m or -1h30m.
 func CompileFORTH(builder *vm.ProgramBuilder, str string) error {
 	//builder := NewProgramBuilder()
-	tokens := vm.TokenizeString(str)
+	tokens := vm.TokenizeStringPositions(str)
+
+	words := make([]word, len(tokens))
+	for k, v := range tokens {
+		words[k] = word{v.Text, vm.SourcePos{Line: v.Line, Column: v.Column, Token: v.Text}}
+	}
+
+	return compileWords(builder, words)
+}
+
+//word is a token of Forth source along with the position that it is compiled from, which is not necessarily Forth source
+type word struct {
+	text string
+	pos  vm.SourcePos
+}
+
+func compileWords(builder *vm.ProgramBuilder, words []word) error {
 
 	singleByteTokens := map[string]byte{
 		"0":     vm.OpNCONST_0,
@@ -75,7 +114,47 @@ func CompileFORTH(builder *vm.ProgramBuilder, str string) error {
 		"<<":    vm.OpNSHL,
 		">>":    vm.OpNSHR,
 
-		"HLT": vm.OpHLT,
+		"IAND":    vm.OpIAND,
+		"IOR":     vm.OpIOR,
+		"IXOR":    vm.OpIXOR,
+		"INOT":    vm.OpINOT,
+		"ISHL":    vm.OpISHL,
+		"ISHR":    vm.OpISHR,
+		"TESTBIT": vm.OpITESTBIT,
+		"ITON":    vm.OpITON,
+		"NTOI":    vm.OpNTOI,
+		"&":       vm.OpIAND,
+		"|":       vm.OpIOR,
+		"~":       vm.OpINOT,
+
+		"STRLEN":    vm.OpSTRLEN,
+		"STRCAT":    vm.OpSTRCAT,
+		"SUBSTR":    vm.OpSTRSUB,
+		"HASPREFIX": vm.OpSTRPREFIX,
+		"HASSUFFIX": vm.OpSTRSUFFIX,
+		"CONTAINS":  vm.OpSTRCONTAINS,
+		"LOWER":     vm.OpSTRLOWER,
+		"UPPER":     vm.OpSTRUPPER,
+		"FOLDEQ":    vm.OpSTRFOLDEQ,
+		"GLOB":      vm.OpSTRGLOB,
+		"VERCMP":    vm.OpVERCMP,
+		"IN_CIDR":   vm.OpINCIDR,
+
+		"LLEN":   vm.OpLSTLEN,
+		"NTH":    vm.OpLSTGET,
+		"IN":     vm.OpLSTIN,
+		"APPEND": vm.OpLSTAPPEND,
+
+		"NOW":  vm.OpNOW,
+		"TTON": vm.OpTTON,
+		"NTOT": vm.OpNTOT,
+		"DTON": vm.OpDTON,
+		"NTOD": vm.OpNTOD,
+
+		"HLT":   vm.OpHLT,
+		"NOP":   vm.OpNOP,
+		"DCALL": vm.OpDCALL,
+		"RET":   vm.OpRET,
 	}
 
 	parseTTBL := func(s string) (v uint8, valid bool) {
@@ -136,6 +215,9 @@ func CompileFORTH(builder *vm.ProgramBuilder, str string) error {
 		return
 	}
 
+	//tokenErr is set by generators that recognize a token but cannot compile it
+	var tokenErr error
+
 	generators := []func(string) bool{
 		func(s string) bool {
 			if !strings.HasPrefix(s, "\"") || !strings.HasSuffix(s, "\"") {
@@ -147,12 +229,22 @@ func CompileFORTH(builder *vm.ProgramBuilder, str string) error {
 
 			return true
 		}, func(s string) bool {
-			if v, err := strconv.ParseFloat(s, 64); err != nil {
+			if v, ok := vm.ParseNumber(s); !ok {
 				return false
 			} else {
-				builder.EmitConst(vm.MakeValue(v))
+				builder.EmitConst(v)
+				return true
+			}
+		}, func(s string) bool {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				builder.EmitConst(vm.MakeTime(t))
+				return true
+			} else if d, err := time.ParseDuration(s); err == nil {
+				builder.EmitConst(vm.MakeDuration(d))
 				return true
 			}
+
+			return false
 		}, func(s string) bool {
 			if ttbl, ok := parsePrefixedTTBL(s, "LTTBLB_"); !ok {
 				return false
@@ -173,28 +265,60 @@ func CompileFORTH(builder *vm.ProgramBuilder, str string) error {
 			if base, index, valid := parseIndexed(s); !valid {
 				return false
 			} else {
-				if base != "CLOAD" {
+				switch base {
+				case "CLOAD":
+					builder.EmitCLoad(index)
+				case "LOAD":
+					builder.EmitLoad(index)
+				case "STORE":
+					builder.EmitStore(index)
+				case "LIST":
+					if index > 0xFF {
+						return false
+					}
+					builder.EmitByte(vm.OpLSTNEW)
+					builder.EmitByte(byte(index))
+				default:
 					return false
 				}
 
-				builder.EmitCLoad(index)
 				return true
 			}
 		}, func(s string) bool {
 			if base, rhs, valid := parseSplit(s); !valid {
 				return false
 			} else {
-				if base != "CNAMED" {
+				switch base {
+				case "CNAMED":
+					if idx, err := reserveNamed(builder, rhs); err != nil {
+						tokenErr = err
+						return false
+					} else {
+						builder.EmitCLoad(idx)
+					}
+				case "HCALL":
+					builder.EmitHostCall(rhs)
+				default:
 					return false
 				}
 
-				builder.EmitCLoad(builder.ReserveConstant(rhs))
 				return true
 			}
 		},
 	}
 
-	for _, token := range tokens {
+	control := newControlCompiler(builder)
+
+	for _, w := range words {
+		token, pos := w.text, w.pos
+		builder.MarkSource(pos)
+
+		if handled, err := control.compile(token, pos); err != nil {
+			return CompileError{pos, err}
+		} else if handled {
+			continue
+		}
+
 		if b, ok := singleByteTokens[token]; ok {
 			builder.EmitByte(b)
 			continue
@@ -211,16 +335,26 @@ func CompileFORTH(builder *vm.ProgramBuilder, str string) error {
 			continue
 		}
 
-		return errors.New("bad token: " + token)
+		if tokenErr != nil {
+			return CompileError{pos, tokenErr}
+		}
+		return CompileError{pos, ErrorUnknownWord}
 	}
 
-	return nil
+	return control.finish()
 }
 
-func StrictExprToFORTH(str string) []string {
-	//((const0>=1)&&(const0<=3))||(const1=="asdasdasd")
-	//compiles to:
-	//CNUM_const0 1 CMP GE CNUM_const0 3 CMP LE AND CSTR_const1 "asdasdasd" CMP EQ OR
+//reserveNamed reserves the constant named by the part of a CNAMED_ token after the underscore, either "name" or "kind:name"
+func reserveNamed(builder *vm.ProgramBuilder, s string) (uint32, error) {
+	idx := strings.Index(s, ":")
+	if idx == -1 {
+		return builder.ReserveConstant(s), nil
+	}
+
+	kind, ok := vm.ParseKind(s[:idx])
+	if !ok || kind == vm.KindNil || kind == vm.KindAny {
+		return 0, fmt.Errorf("%w: %s", ErrorUnknownKind, s[:idx])
+	}
 
-	return nil
+	return builder.ReserveTypedConstant(s[idx+1:], kind)
 }
@@ -0,0 +1,553 @@
+package itsu_forth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"example.com/itsuMain/lib/vm"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runVM(machine *vm.VM) {
+	for {
+		machine.DumpNow()
+		if err := machine.SingleStep(); err != nil {
+			log.Println(err)
+			break
+		}
+	}
+}
+
+func getDefaultProgram() (b vm.BuiltProgram, err error) {
+	builder := vm.NewProgramBuilder()
+
+	if err = CompileFORTH(builder, `
+CNAMED_const0 1 CMP >=
+CNAMED_const0 3 CMP <=
+AND
+"asdasdasd" CNAMED_const1 CMP ==
+OR
+HLT
+`); err != nil {
+		return
+	}
+
+	b, err = builder.Build()
+	return
+}
+
+func TestCompile(t *testing.T) {
+	var err error
+	var built vm.BuiltProgram
+
+	if built, err = getDefaultProgram(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if linked, err := built.Link(map[string]interface{}{
+		"const0": 1.5,
+		"const1": "asdasd asd",
+	}); err != nil {
+		t.Error(err)
+		return
+	} else {
+		runVM(vm.NewVM(linked))
+	}
+}
+
+func TestBuiltProgram_Serialize(t *testing.T) {
+	var err error
+	var built vm.BuiltProgram
+
+	if built, err = getDefaultProgram(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var built2 vm.BuiltProgram
+	var serialized []byte
+
+	if serialized, err = built.Serialize(); err != nil {
+		return
+	}
+
+	if built2, err = vm.DeserializeBuiltProgram(bufio.NewReader(bytes.NewReader(serialized))); err != nil {
+		return
+	}
+
+	if !reflect.DeepEqual(built, built2) {
+		t.Error("")
+	}
+}
+
+func runFORTH(source string, bindings map[string]interface{}) (vm.Value, error) {
+	builder := vm.NewProgramBuilder()
+	if err := CompileFORTH(builder, source); err != nil {
+		return vm.ValueNil, err
+	}
+
+	built, err := builder.Build()
+	if err != nil {
+		return vm.ValueNil, err
+	}
+	optimized, err := built.Optimize()
+	if err != nil {
+		return vm.ValueNil, err
+	}
+
+	run := func(program vm.BuiltProgram) (vm.Value, error) {
+		linked, err := program.Link(bindings)
+		if err != nil {
+			return vm.ValueNil, err
+		}
+
+		res, err := vm.NewVM(linked).Run(context.Background(), vm.DefaultLimits)
+		return res.Top, err
+	}
+
+	//every program is run with and without optimizations, both must behave the same
+	top, err := run(built)
+	if optimizedTop, optimizedErr := run(optimized); !reflect.DeepEqual(top, optimizedTop) || (err == nil) != (optimizedErr == nil) {
+		return vm.ValueNil, fmt.Errorf("optimized program returned %v, %v instead of %v, %v", optimizedTop, optimizedErr, top, err)
+	}
+
+	return top, err
+}
+
+func TestCompileFORTH_Strings(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected vm.Value
+	}{
+		{`CNAMED_Hostname "build-*" GLOB`, vm.MakeValue(true)},
+		{`CNAMED_Hostname "build-?" GLOB`, vm.MakeValue(false)},
+		{`"CORP/alice" "*/a*" GLOB`, vm.MakeValue(true)},
+		{`CNAMED_GOOS "LINUX" FOLDEQ`, vm.MakeValue(true)},
+		{`CNAMED_GOOS UPPER "LINUX" CMP ==`, vm.MakeValue(true)},
+		{`CNAMED_Hostname "build-" HASPREFIX CNAMED_Hostname "42" HASSUFFIX &&`, vm.MakeValue(true)},
+		{`CNAMED_Hostname "ld-4" CONTAINS`, vm.MakeValue(true)},
+		{`CNAMED_Hostname STRLEN`, vm.MakeValue(8)},
+		{`CNAMED_Hostname 0 5 SUBSTR "." STRCAT CNAMED_GOOS LOWER STRCAT`, vm.MakeValue("build.linux")},
+		{"\\ the hostname\nCNAMED_Hostname ( without its number ) 0 6 SUBSTR", vm.MakeValue("build-")},
+		{`"a\tb\x21\"" STRLEN`, vm.MakeValue(5)},
+		{`CNAMED_Version "1.4.2" VERCMP <`, vm.MakeValue(true)},
+		{`"1.4.2-rc.1" "1.4.2" VERCMP`, vm.MakeValue(-1)},
+	}
+
+	for k, v := range tests {
+		if res, err := runFORTH(v.source, map[string]interface{}{
+			"Hostname": "build-42",
+			"GOOS":     "Linux",
+			"Version":  "1.4.1",
+		}); err != nil {
+			t.Error("test ", k, " failed: ", err)
+		} else if !reflect.DeepEqual(res, v.expected) {
+			t.Error("test ", k, " failed: ", res, " != ", v.expected)
+		}
+	}
+}
+
+func TestCompileFORTH_Lists(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected vm.Value
+	}{
+		{`CNAMED_GOARCH "amd64" "arm64" LIST_2 IN`, vm.MakeValue(true)},
+		{`"riscv64" CNAMED_Arches IN`, vm.MakeValue(false)},
+		{`CNAMED_Arches "riscv64" APPEND LLEN`, vm.MakeValue(3)},
+		{`CNAMED_Arches 1 NTH`, vm.MakeValue("arm64")},
+		{`LIST_0 LLEN`, vm.MakeValue(0)},
+	}
+
+	for k, v := range tests {
+		if res, err := runFORTH(v.source, map[string]interface{}{
+			"GOARCH": "arm64",
+			"Arches": []string{"amd64", "arm64"},
+		}); err != nil {
+			t.Error("test ", k, " failed: ", err)
+		} else if !reflect.DeepEqual(res, v.expected) {
+			t.Error("test ", k, " failed: ", res, " != ", v.expected)
+		}
+	}
+}
+
+func TestCompileFORTH_Times(t *testing.T) {
+	firstSeen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	bindings := map[string]interface{}{
+		"FirstSeen":   firstSeen,
+		"ConnectedAt": firstSeen.Add(36 * time.Hour),
+	}
+
+	tests := []struct {
+		source   string
+		expected vm.Value
+	}{
+		{`2024-05-01T12:00:00Z 90m + 2024-05-01T13:30:00Z CMP ==`, vm.MakeValue(true)},
+		{`2024-05-01T12:00:00+02:00 2024-05-01T10:00:00Z CMP ==`, vm.MakeValue(true)},
+		{`CNAMED_ConnectedAt CNAMED_FirstSeen -`, vm.MakeDuration(36 * time.Hour)},
+		{`CNAMED_time:ConnectedAt CNAMED_FirstSeen - 24h CMP >`, vm.MakeValue(true)},
+		{`NOW CNAMED_ConnectedAt CMP >`, vm.MakeValue(true)},
+		{`1h30m DTON`, vm.MakeValue(5400)},
+		{`90 NTOD 1.5m CMP ==`, vm.MakeValue(true)},
+		{`2024-05-01T00:00:00Z TTON`, vm.MakeValue(1714521600)},
+		{`1714521600.5 NTOT`, vm.MakeTime(time.Date(2024, 5, 1, 0, 0, 0, 5e8, time.UTC))},
+		{`-1h 1h + 2h -`, vm.MakeDuration(-2 * time.Hour)},
+	}
+
+	for k, v := range tests {
+		if res, err := runFORTH(v.source, bindings); err != nil {
+			t.Error("test ", k, " failed: ", err)
+		} else if !reflect.DeepEqual(res, v.expected) {
+			t.Error("test ", k, " failed: ", res, " != ", v.expected)
+		}
+	}
+
+	for k, v := range []string{`1 1h +`, `NOW NOW +`, `1h NOW -`, `1h 1 CMP`} {
+		if _, err := runFORTH(v, bindings); !errors.Is(err, vm.ErrorType) {
+			t.Error("bad program ", k, " failed: ", err)
+		}
+	}
+}
+
+func TestCompileFORTH_Addresses(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected vm.Value
+	}{
+		{`CNAMED_IP "10.0.0.0/8" IN_CIDR`, vm.MakeValue(true)},
+		{`CNAMED_Address "10.1.0.0/16" IN_CIDR`, vm.MakeValue(true)},
+		{`CNAMED_IP "192.168.0.0/16" "172.16.0.0/12" LIST_2 IN_CIDR`, vm.MakeValue(false)},
+		{`"::ffff:10.1.2.3" "10.0.0.0/8" IN_CIDR`, vm.MakeValue(true)},
+		{`"fe80::1%eth0" "fe80::/10" IN_CIDR "fe80::1" "10.0.0.0/8" IN_CIDR NOT AND`, vm.MakeValue(true)},
+		{`"unknown" "0.0.0.0/0" IN_CIDR`, vm.MakeValue(false)},
+	}
+
+	for k, v := range tests {
+		if res, err := runFORTH(v.source, map[string]interface{}{
+			"Address": "10.1.2.3:51234",
+			"IP":      "10.1.2.3",
+		}); err != nil {
+			t.Error("test ", k, " failed: ", err)
+		} else if !reflect.DeepEqual(res, v.expected) {
+			t.Error("test ", k, " failed: ", res, " != ", v.expected)
+		}
+	}
+
+	for k, v := range []string{`"10.1.2.3" "10.0.0.0" IN_CIDR`, `"10.1.2.3" "10.0.0.0/8" 1 LIST_2 IN_CIDR`} {
+		if _, err := runFORTH(v, nil); err == nil {
+			t.Error("bad program ", k, " succeeded")
+		}
+	}
+}
+
+func TestCompileFORTH_TypedNames(t *testing.T) {
+	builder := vm.NewProgramBuilder()
+	if err := CompileFORTH(builder, `CNAMED_num:RTCPU CNAMED_RTCPU CNAMED_str:Hostname CNAMED_list:Env`); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]vm.Kind{
+		"RTCPU":    vm.KindNumber,
+		"Hostname": vm.KindString,
+		"Env":      vm.KindList,
+	}
+	built, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if declared := built.DeclaredConstants(); !reflect.DeepEqual(declared, expected) {
+		t.Error("unexpected declarations: ", declared)
+	}
+
+	for _, v := range []string{`CNAMED_float:x`, `CNAMED_num:x CNAMED_str:x`, `CNAMED_any:x`} {
+		if err := CompileFORTH(vm.NewProgramBuilder(), v); err == nil {
+			t.Error("compiled ", v)
+		}
+	}
+
+	if _, err := runFORTH(`CNAMED_num:RTCPU`, map[string]interface{}{"RTCPU": "4"}); !errors.Is(err, vm.ErrorBindingKind) {
+		t.Error("mistyped binding was linked: ", err)
+	}
+}
+
+func TestCompileFORTH_SourceMap(t *testing.T) {
+	_, err := runFORTH("1 2 +\n  \"a\" +", nil)
+
+	var runtimeError vm.RuntimeError
+	if !errors.As(err, &runtimeError) || !errors.Is(err, vm.ErrorType) {
+		t.Fatal("unexpected error: ", err)
+	}
+
+	if expected := (vm.SourcePos{Line: 2, Column: 7, Token: "+"}); !runtimeError.HasPos || runtimeError.Pos != expected {
+		t.Error("unexpected position: ", runtimeError.Pos)
+	}
+
+	err = CompileFORTH(vm.NewProgramBuilder(), "1\n2 FOO")
+
+	var compileError CompileError
+	if !errors.As(err, &compileError) || !errors.Is(err, ErrorUnknownWord) {
+		t.Fatal("unexpected error: ", err)
+	}
+
+	if expected := (vm.SourcePos{Line: 2, Column: 3, Token: "FOO"}); compileError.Pos != expected {
+		t.Error("unexpected position: ", compileError.Pos)
+	}
+}
+
+func TestCompileFORTH_Control(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected vm.Value
+	}{
+		{`1 2 CMP < IF "yes" ELSE "no" THEN`, vm.MakeValue("yes")},
+		{`2 1 CMP < IF "yes" ELSE "no" THEN`, vm.MakeValue("no")},
+		{`5 T IF 1 + THEN`, vm.MakeValue(6)},
+		{`5 F IF 1 + THEN`, vm.MakeValue(5)},
+		{`0 BEGIN 1 + DUP 5 CMP >= UNTIL`, vm.MakeValue(5)},
+		{`0 10 0 DO I + LOOP`, vm.MakeValue(45)},
+		{`0 3 0 DO 2 0 DO J 10 * I + + LOOP LOOP`, vm.MakeValue(63)},
+		{`: SQ DUP * ; 3 SQ SQ`, vm.MakeValue(81)},
+		{`: ABS DUP 0 CMP < IF 0 SWAP - THEN ; -4 ABS 3 ABS +`, vm.MakeValue(7)},
+		{`: SUM 0 SWAP 0 DO I + LOOP ; 4 SUM`, vm.MakeValue(6)},
+		{`: sq DUP * ; 3 "sq" DCALL`, vm.MakeValue(9)},
+		{`: A 1 + ; : B 2 * ; 5 "A" DCALL "B" DCALL`, vm.MakeValue(12)},
+	}
+
+	for k, v := range tests {
+		builder := vm.NewProgramBuilder()
+		if err := CompileFORTH(builder, v.source); err != nil {
+			t.Error("test ", k, " failed: ", err)
+			continue
+		}
+		if built, err := builder.Build(); err != nil {
+			t.Error("test ", k, " failed: ", err)
+		} else if err = built.Verify(); err != nil {
+			t.Error("test ", k, " failed verification: ", err)
+		}
+
+		if res, err := runFORTH(v.source, nil); err != nil {
+			t.Error("test ", k, " failed: ", err)
+		} else if !reflect.DeepEqual(res, v.expected) {
+			t.Error("test ", k, " failed: ", res, " != ", v.expected)
+		}
+	}
+
+	bad := []struct {
+		source string
+		err    error
+		pos    vm.SourcePos
+	}{
+		{"1 2\nIF 3", ErrorUnbalanced, vm.SourcePos{Line: 2, Column: 1, Token: "IF"}},
+		{"THEN", ErrorUnbalanced, vm.SourcePos{Line: 1, Column: 1, Token: "THEN"}},
+		{"T IF BEGIN THEN", ErrorUnbalanced, vm.SourcePos{Line: 1, Column: 12, Token: "THEN"}},
+		{"1 ELSE", ErrorUnbalanced, vm.SourcePos{Line: 1, Column: 3, Token: "ELSE"}},
+		{": X", ErrorUnbalanced, vm.SourcePos{Line: 1, Column: 1, Token: ":"}},
+		{":", ErrorWordName, vm.SourcePos{Line: 1, Column: 1, Token: ":"}},
+		{": IF ;", ErrorWordName, vm.SourcePos{Line: 1, Column: 3, Token: "IF"}},
+		{": A : B ; ;", ErrorNestedDefinition, vm.SourcePos{Line: 1, Column: 5, Token: ":"}},
+		{": A ; : A ;", vm.ErrorDuplicateSymbol, vm.SourcePos{Line: 1, Column: 9, Token: "A"}},
+		{"I", ErrorNoLoop, vm.SourcePos{Line: 1, Column: 1, Token: "I"}},
+		{"2 0 DO : A J ; LOOP", ErrorNestedDefinition, vm.SourcePos{Line: 1, Column: 8, Token: ":"}},
+		{"2 0 DO J LOOP", ErrorNoLoop, vm.SourcePos{Line: 1, Column: 8, Token: "J"}},
+	}
+
+	for k, v := range bad {
+		var compileError CompileError
+		if err := CompileFORTH(vm.NewProgramBuilder(), v.source); !errors.As(err, &compileError) || !errors.Is(err, v.err) {
+			t.Error("bad source ", k, " failed: ", err)
+		} else if compileError.Pos != v.pos {
+			t.Error("bad source ", k, " failed: ", compileError.Pos)
+		}
+	}
+}
+
+func TestStrictExprToFORTH(t *testing.T) {
+	words, err := StrictExprToFORTH(`((const0>=1)&&(const0<=3))||(const1=="asdasdasd")`)
+	expected := []string{
+		"CNAMED_const0", "1", "CMP", ">=", "CNAMED_const0", "3", "CMP", "<=", "AND",
+		"CNAMED_const1", `"asdasdasd"`, "CMP", "==", "OR",
+	}
+	if err != nil || !reflect.DeepEqual(words, expected) {
+		t.Error("unexpected translation: ", words, err)
+	}
+
+	bindings := map[string]interface{}{
+		"RTCPU":     4,
+		"Hostname":  "Build-01",
+		"Env":       []string{"A=1"},
+		"FirstSeen": time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		source   string
+		expected vm.Value
+	}{
+		{`1 + 2 * 3`, vm.MakeValue(7)},
+		{`(1 + 2) * 3`, vm.MakeValue(9)},
+		{`10 - 4 - 3`, vm.MakeValue(3)},
+		{`-2 * -(1 + 1)`, vm.MakeValue(4)},
+		{`7 % 4 == 3`, vm.MakeValue(true)},
+		{`num:RTCPU >= 2 && num:RTCPU <= 8`, vm.MakeValue(true)},
+		{`!(RTCPU > 2) || false`, vm.MakeValue(false)},
+		{`true ^^ true || 1 < 2 && !false`, vm.MakeValue(true)},
+		{`hasprefix(lower(str:Hostname), "build-") && !contains(Hostname, "\"")`, vm.MakeValue(true)},
+		{`in("A=1", list:Env) && llen([1, "a", 2]) == 3`, vm.MakeValue(true)},
+		{`concat("a", "b") != "ab"`, vm.MakeValue(false)},
+		{`5u == 5u`, vm.MakeValue(true)},
+		{`0x10 + 0b11 + 0o7 == 26 && 0xFFu == 255u`, vm.MakeValue(true)},
+		{`strlen("\x41\n") == 2`, vm.MakeValue(true)},
+		{`now() - FirstSeen > 24h && FirstSeen + 90m == 2024-05-01T13:30:00Z`, vm.MakeValue(true)},
+		{`2024-05-01T12:00:00+02:00-2h == 2024-05-01T08:00:00Z`, vm.MakeValue(true)},
+		{`in_cidr("2001:db8::7", ["10.0.0.0/8", "2001:db8::/48"]) && !in_cidr("10.0.0.1", "10.0.0.0/32")`, vm.MakeValue(true)},
+		{`in_cidr("10.0.0.1", "10.0.0.0/31") && !in_cidr("10.0.0.2", "10.0.0.0/31")`, vm.MakeValue(true)},
+		{`vercmp("1.10.0", "1.9") > 0 && vercmp("v2.0.0+build.7", "2.0.0") == 0`, vm.MakeValue(true)},
+		{`seconds(1h30m) == 5400 && unix(fromunix(60)) == 60 && duration(1.5) == 1500ms`, vm.MakeValue(true)},
+		{strings.Repeat("!(", 100) + "true" + strings.Repeat(")", 100), vm.MakeValue(true)},
+	}
+
+	for k, v := range tests {
+		builder := vm.NewProgramBuilder()
+		if err := CompileExpr(builder, v.source); err != nil {
+			t.Error("test ", k, " failed: ", err)
+			continue
+		}
+
+		built, err := builder.Build()
+		if err != nil {
+			t.Error("test ", k, " failed: ", err)
+			continue
+		}
+
+		linked, err := built.Link(bindings)
+		if err != nil {
+			t.Error("test ", k, " failed: ", err)
+			continue
+		}
+
+		if res, err := vm.NewVM(linked).Run(context.Background(), vm.DefaultLimits); err != nil {
+			t.Error("test ", k, " failed: ", err)
+		} else if !reflect.DeepEqual(res.Top, v.expected) {
+			t.Error("test ", k, " failed: ", res.Top, " != ", v.expected)
+		}
+	}
+
+	bad := []struct {
+		source string
+		err    error
+		pos    vm.SourcePos
+	}{
+		{`1 +`, ErrorExprSyntax, vm.SourcePos{Line: 1, Column: 4}},
+		{`(1`, ErrorExprSyntax, vm.SourcePos{Line: 1, Column: 3}},
+		{`1 2`, ErrorExprSyntax, vm.SourcePos{Line: 1, Column: 3, Token: "2"}},
+		{`1 < 2 < 3`, ErrorExprChained, vm.SourcePos{Line: 1, Column: 7, Token: "<"}},
+		{"1 ==\n  foo(1)", ErrorExprFunction, vm.SourcePos{Line: 2, Column: 3, Token: "foo"}},
+		{`lower(1, 2)`, ErrorExprArity, vm.SourcePos{Line: 1, Column: 1, Token: "lower"}},
+		{`1 = 2`, ErrorExprSyntax, vm.SourcePos{Line: 1, Column: 3, Token: "="}},
+		{`"abc`, ErrorExprSyntax, vm.SourcePos{Line: 1, Column: 1, Token: `"abc`}},
+		{`1x`, ErrorExprSyntax, vm.SourcePos{Line: 1, Column: 1, Token: "1x"}},
+		{`2024-05-01T25:00:00Z`, ErrorExprSyntax, vm.SourcePos{Line: 1, Column: 1, Token: "2024-05-01T25:00:00Z"}},
+		{strings.Repeat("(", 300) + "1" + strings.Repeat(")", 300), ErrorExprDepth, vm.SourcePos{Line: 1, Column: 257, Token: "("}},
+		{strings.Repeat("-", 300) + "1", ErrorExprDepth, vm.SourcePos{Line: 1, Column: 257, Token: "-"}},
+	}
+
+	for k, v := range bad {
+		var compileError CompileError
+		if err := CompileExpr(vm.NewProgramBuilder(), v.source); !errors.As(err, &compileError) || !errors.Is(err, v.err) {
+			t.Error("bad expression ", k, " failed: ", err)
+		} else if compileError.Pos != v.pos {
+			t.Error("bad expression ", k, " failed: ", compileError.Pos)
+		}
+	}
+}
+
+func TestCheckKinds(t *testing.T) {
+	tests := []struct {
+		source   string
+		bindings map[string]vm.Kind
+		errors   []vm.SourcePos
+		warnings []vm.SourcePos
+		results  []vm.Kind
+	}{
+		{`CNAMED_num:x 1 + 2 CMP >`, nil, nil, nil, []vm.Kind{vm.KindBool}},
+		{`1 "a" CMP ==`, nil, []vm.SourcePos{{Line: 1, Column: 7, Token: "CMP"}}, nil, nil},
+		{"1 2\nAND", nil, []vm.SourcePos{{Line: 2, Column: 1, Token: "AND"}, {Line: 2, Column: 1, Token: "AND"}}, nil, nil},
+		{`1 IF 2 THEN`, nil, []vm.SourcePos{{Line: 1, Column: 3, Token: "IF"}}, nil, nil},
+		{`CNAMED_x 1 +`, nil, nil, []vm.SourcePos{{Line: 1, Column: 12, Token: "+"}}, []vm.Kind{vm.KindNumber}},
+		{`CNAMED_x 1 +`, map[string]vm.Kind{"x": vm.KindNumber}, nil, nil, []vm.Kind{vm.KindNumber}},
+		{`1 2 CMP < IF "a" ELSE 3 THEN STRLEN`, nil, nil, []vm.SourcePos{{Line: 1, Column: 30, Token: "STRLEN"}}, []vm.Kind{vm.KindNumber}},
+		{`: inc 1 + ; 1 inc "a" inc`, nil, []vm.SourcePos{{Line: 1, Column: 9, Token: "+"}}, nil, nil},
+		{`: inc 1 + ; 1 inc CNAMED_x inc`, nil, nil, []vm.SourcePos{{Line: 1, Column: 9, Token: "+"}}, []vm.Kind{vm.KindNumber}},
+		{`0 3 0 DO I + LOOP`, nil, nil, nil, []vm.Kind{vm.KindNumber}},
+		{`"a" 1 CMP == IF 1 THEN`, nil, []vm.SourcePos{{Line: 1, Column: 7, Token: "CMP"}}, nil, nil},
+		{`NOW CNAMED_FirstSeen - 1h CMP >`, map[string]vm.Kind{"FirstSeen": vm.KindTime}, nil, nil, []vm.Kind{vm.KindBool}},
+		{`NOW 1 +`, nil, []vm.SourcePos{{Line: 1, Column: 7, Token: "+"}}, nil, nil},
+		{`CNAMED_x 1h +`, nil, nil, []vm.SourcePos{{Line: 1, Column: 13, Token: "+"}}, []vm.Kind{vm.KindTime, vm.KindDuration}},
+	}
+
+	positions := func(errs []vm.KindError) []vm.SourcePos {
+		var pos []vm.SourcePos
+		for _, v := range errs {
+			pos = append(pos, v.Pos)
+		}
+		return pos
+	}
+
+	for k, v := range tests {
+		builder := vm.NewProgramBuilder()
+		if err := CompileFORTH(builder, v.source); err != nil {
+			t.Error("test ", k, " failed: ", err)
+			continue
+		}
+
+		built, err := builder.Build()
+		if err != nil {
+			t.Error("test ", k, " failed: ", err)
+			continue
+		}
+
+		report, err := built.CheckKinds(v.bindings)
+		if err != nil {
+			t.Error("test ", k, " failed: ", err)
+		} else if !reflect.DeepEqual(positions(report.Errors), v.errors) || !reflect.DeepEqual(positions(report.Warnings), v.warnings) {
+			t.Error("test ", k, " failed: ", report.Errors, report.Warnings)
+		} else if len(v.errors) == 0 && !reflect.DeepEqual(report.Results, v.results) {
+			t.Error("test ", k, " failed: unexpected results ", report.Results)
+		}
+
+		for _, e := range report.Errors {
+			if !errors.Is(e, vm.ErrorType) || !e.Certain {
+				t.Error("test ", k, " failed: ", e)
+			}
+		}
+	}
+
+	//every word calls the next one 4 times, so there are 4^10 call paths to the last word
+	source := ": f10 ;"
+	for i := 9; i >= 0; i-- {
+		next := fmt.Sprint(" f", i+1)
+		source += fmt.Sprint(" : f", i, strings.Repeat(next, 4), " ;")
+	}
+	source += " f0 T"
+
+	builder := vm.NewProgramBuilder()
+	if err := CompileFORTH(builder, source); err != nil {
+		t.Fatal(err)
+	}
+	built, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = built.Verify(); err != nil {
+		t.Error("fan-out failed verification: ", err)
+	}
+	if _, err = built.CheckKinds(nil); !errors.Is(err, vm.ErrorKindStates) {
+		t.Error("fan-out was checked: ", err)
+	}
+}
@@ -0,0 +1,672 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//maxKindStates bounds the number of (pc, call path) pairs that CheckKinds tracks, the number of call paths grows exponentially with nested calls
+const maxKindStates = 1 << 14
+
+var (
+	ErrorKindStates = errors.New("program has too many call paths to check")
+)
+
+//kindSet is the set of kinds that a value may have at some point of a program, bit k stands for Kind(k)
+type kindSet uint8
+
+const (
+	kindsNil      = kindSet(1 << KindNil)
+	kindsNumber   = kindSet(1 << KindNumber)
+	kindsBool     = kindSet(1 << KindBool)
+	kindsString   = kindSet(1 << KindString)
+	kindsInt      = kindSet(1 << KindInt)
+	kindsList     = kindSet(1 << KindList)
+	kindsTime     = kindSet(1 << KindTime)
+	kindsDuration = kindSet(1 << KindDuration)
+	kindsAny      = kindsNil | kindsNumber | kindsBool | kindsString | kindsInt | kindsList | kindsTime | kindsDuration
+	kindsElement  = kindsAny &^ kindsList //lists cannot be nested
+
+	kindsArithmetic = kindsNumber | kindsTime | kindsDuration //accepted by NADD and NSUB, see arithmeticKinds
+)
+
+func kindsOf(k Kind) kindSet {
+	if k == KindAny {
+		return kindsAny
+	} else if k > KindDuration {
+		return 0
+	}
+
+	return kindSet(1 << k)
+}
+
+func (s kindSet) kinds() []Kind {
+	kinds := make([]Kind, 0)
+	for k := KindNil; k <= KindDuration; k++ {
+		if s&kindsOf(k) != 0 {
+			kinds = append(kinds, k)
+		}
+	}
+
+	return kinds
+}
+
+//kindSignature is the effect of an instruction on the kinds of the stack, args are ordered from the bottom to the top
+type kindSignature struct {
+	args    []kindSet
+	results []kindSet
+}
+
+//kindSignatures covers every instruction that only pops and pushes values, the others are handled by the kind checker itself
+var kindSignatures = map[byte]kindSignature{
+	OpNCONST:   {nil, []kindSet{kindsNumber}},
+	OpNCONST_0: {nil, []kindSet{kindsNumber}},
+	OpNCONST_1: {nil, []kindSet{kindsNumber}},
+	OpNCONST_2: {nil, []kindSet{kindsNumber}},
+	OpBCONST_0: {nil, []kindSet{kindsBool}},
+	OpBCONST_1: {nil, []kindSet{kindsBool}},
+	OpNILCONST: {nil, []kindSet{kindsNil}},
+	OpICONST:   {nil, []kindSet{kindsInt}},
+
+	OpLT:     {[]kindSet{kindsNumber}, []kindSet{kindsBool}},
+	OpLE:     {[]kindSet{kindsNumber}, []kindSet{kindsBool}},
+	OpEQ:     {[]kindSet{kindsNumber}, []kindSet{kindsBool}},
+	OpGE:     {[]kindSet{kindsNumber}, []kindSet{kindsBool}},
+	OpGT:     {[]kindSet{kindsNumber}, []kindSet{kindsBool}},
+	OpNE:     {[]kindSet{kindsNumber}, []kindSet{kindsBool}},
+	OpLAND:   {[]kindSet{kindsBool, kindsBool}, []kindSet{kindsBool}},
+	OpLOR:    {[]kindSet{kindsBool, kindsBool}, []kindSet{kindsBool}},
+	OpLXOR:   {[]kindSet{kindsBool, kindsBool}, []kindSet{kindsBool}},
+	OpLTTBLB: {[]kindSet{kindsBool, kindsBool}, []kindSet{kindsBool}},
+	OpLNOT:   {[]kindSet{kindsBool}, []kindSet{kindsBool}},
+	OpLTTBLU: {[]kindSet{kindsBool}, []kindSet{kindsBool}},
+
+	OpNMUL:   {[]kindSet{kindsNumber, kindsNumber}, []kindSet{kindsNumber}},
+	OpNDIV:   {[]kindSet{kindsNumber, kindsNumber}, []kindSet{kindsNumber}},
+	OpNFMOD:  {[]kindSet{kindsNumber, kindsNumber}, []kindSet{kindsNumber}},
+	OpNPOW:   {[]kindSet{kindsNumber, kindsNumber}, []kindSet{kindsNumber}},
+	OpNSHL:   {[]kindSet{kindsNumber, kindsNumber}, []kindSet{kindsNumber}},
+	OpNSHR:   {[]kindSet{kindsNumber, kindsNumber}, []kindSet{kindsNumber}},
+	OpNSQRT:  {[]kindSet{kindsNumber}, []kindSet{kindsNumber}},
+	OpNTRUNC: {[]kindSet{kindsNumber}, []kindSet{kindsNumber}},
+	OpNFLOOR: {[]kindSet{kindsNumber}, []kindSet{kindsNumber}},
+	OpNCEIL:  {[]kindSet{kindsNumber}, []kindSet{kindsNumber}},
+
+	OpIAND:     {[]kindSet{kindsInt, kindsInt}, []kindSet{kindsInt}},
+	OpIOR:      {[]kindSet{kindsInt, kindsInt}, []kindSet{kindsInt}},
+	OpIXOR:     {[]kindSet{kindsInt, kindsInt}, []kindSet{kindsInt}},
+	OpINOT:     {[]kindSet{kindsInt}, []kindSet{kindsInt}},
+	OpISHL:     {[]kindSet{kindsInt, kindsNumber | kindsInt}, []kindSet{kindsInt}},
+	OpISHR:     {[]kindSet{kindsInt, kindsNumber | kindsInt}, []kindSet{kindsInt}},
+	OpITESTBIT: {[]kindSet{kindsInt, kindsNumber | kindsInt}, []kindSet{kindsBool}},
+	OpITON:     {[]kindSet{kindsInt}, []kindSet{kindsNumber}},
+	OpNTOI:     {[]kindSet{kindsNumber}, []kindSet{kindsInt}},
+
+	OpSTRLEN:      {[]kindSet{kindsString}, []kindSet{kindsNumber}},
+	OpSTRCAT:      {[]kindSet{kindsString, kindsString}, []kindSet{kindsString}},
+	OpSTRSUB:      {[]kindSet{kindsString, kindsNumber, kindsNumber}, []kindSet{kindsString}},
+	OpSTRPREFIX:   {[]kindSet{kindsString, kindsString}, []kindSet{kindsBool}},
+	OpSTRSUFFIX:   {[]kindSet{kindsString, kindsString}, []kindSet{kindsBool}},
+	OpSTRCONTAINS: {[]kindSet{kindsString, kindsString}, []kindSet{kindsBool}},
+	OpSTRFOLDEQ:   {[]kindSet{kindsString, kindsString}, []kindSet{kindsBool}},
+	OpSTRGLOB:     {[]kindSet{kindsString, kindsString}, []kindSet{kindsBool}},
+	OpSTRLOWER:    {[]kindSet{kindsString}, []kindSet{kindsString}},
+	OpSTRUPPER:    {[]kindSet{kindsString}, []kindSet{kindsString}},
+	OpVERCMP:      {[]kindSet{kindsString, kindsString}, []kindSet{kindsNumber}},
+	OpINCIDR:      {[]kindSet{kindsString, kindsString | kindsList}, []kindSet{kindsBool}},
+
+	OpLSTLEN:    {[]kindSet{kindsList}, []kindSet{kindsNumber}},
+	OpLSTGET:    {[]kindSet{kindsList, kindsNumber}, []kindSet{kindsElement}},
+	OpLSTIN:     {[]kindSet{kindsAny, kindsList}, []kindSet{kindsBool}},
+	OpLSTAPPEND: {[]kindSet{kindsList, kindsElement}, []kindSet{kindsList}},
+
+	OpNOW:  {nil, []kindSet{kindsTime}},
+	OpTTON: {[]kindSet{kindsTime}, []kindSet{kindsNumber}},
+	OpNTOT: {[]kindSet{kindsNumber}, []kindSet{kindsTime}},
+	OpDTON: {[]kindSet{kindsDuration}, []kindSet{kindsNumber}},
+	OpNTOD: {[]kindSet{kindsNumber}, []kindSet{kindsDuration}},
+}
+
+//arithmeticKinds are the pairs of kinds that NADD and NSUB accept as lhs and rhs, followed by the kind of their result
+var arithmeticKinds = map[byte][][3]Kind{
+	OpNADD: {
+		{KindNumber, KindNumber, KindNumber},
+		{KindTime, KindDuration, KindTime},
+		{KindDuration, KindTime, KindTime},
+		{KindDuration, KindDuration, KindDuration},
+	},
+	OpNSUB: {
+		{KindNumber, KindNumber, KindNumber},
+		{KindTime, KindTime, KindDuration},
+		{KindTime, KindDuration, KindTime},
+		{KindDuration, KindDuration, KindDuration},
+	},
+}
+
+func arithmeticResult(opcode byte, lhs, rhs Kind) (Kind, bool) {
+	for _, v := range arithmeticKinds[opcode] {
+		if v[0] == lhs && v[1] == rhs {
+			return v[2], true
+		}
+	}
+
+	return KindNil, false
+}
+
+//KindError is an instruction that may be reached with operands of kinds that it does not accept, Operand 0 is the top of the stack
+type KindError struct {
+	PC       int
+	Opcode   byte
+	Pos      SourcePos
+	HasPos   bool
+	Operand  int
+	Expected []Kind
+	Got      []Kind
+	Certain  bool //the instruction fails whenever it is reached, or through one of the call sites of its function, otherwise only some of the kinds that may reach it are not accepted
+}
+
+func (e KindError) Error() string {
+	names := func(kinds []Kind) string {
+		s := make([]string, len(kinds))
+		for k, v := range kinds {
+			s[k] = v.String()
+		}
+		return strings.Join(s, "|")
+	}
+
+	verb := "may be"
+	if e.Certain {
+		verb = "is"
+	}
+
+	msg := fmt.Sprintf("operand %d %s %s, expected %s", e.Operand, verb, names(e.Got), names(e.Expected))
+	if e.HasPos {
+		return fmt.Sprintf("pc %d (%s) at %s: %s", e.PC, GetOpcodeProperties(e.Opcode).Name, e.Pos, msg)
+	}
+
+	return fmt.Sprintf("pc %d (%s): %s", e.PC, GetOpcodeProperties(e.Opcode).Name, msg)
+}
+
+func (e KindError) Unwrap() error { return ErrorType }
+
+//KindReport is the outcome of CheckKinds. Errors and Warnings are ordered by PC.
+//Results are the kinds that may be on the top of the stack when the program stops, KindNil included if the stack may be empty.
+type KindReport struct {
+	Errors   []KindError
+	Warnings []KindError
+	Results  []Kind
+}
+
+type kindFrame struct {
+	rp   int
+	vars map[uint32]kindSet //variables that are missing have not been stored yet and hold nil
+}
+
+type kindState struct {
+	stack  []kindSet
+	frames []kindFrame
+}
+
+func (s kindState) clone() kindState {
+	c := kindState{
+		stack:  append([]kindSet(nil), s.stack...),
+		frames: make([]kindFrame, len(s.frames)),
+	}
+
+	for k, f := range s.frames {
+		c.frames[k] = kindFrame{f.rp, make(map[uint32]kindSet, len(f.vars))}
+		for idx, v := range f.vars {
+			c.frames[k].vars[idx] = v
+		}
+	}
+
+	return c
+}
+
+//context identifies the calls that lead to a state, states are only joined within the same context
+func (s kindState) context() string {
+	sb := strings.Builder{}
+	for _, f := range s.frames[1:] {
+		sb.WriteString(strconv.Itoa(f.rp))
+		sb.WriteByte(' ')
+	}
+
+	return sb.String()
+}
+
+//join widens s to cover o as well and reports whether s changed, both states must belong to the same context
+func (s *kindState) join(o kindState) (changed bool, err error) {
+	if len(s.stack) != len(o.stack) {
+		return false, ErrorVerifyStackDepth
+	}
+
+	for k, v := range o.stack {
+		if s.stack[k]|v != s.stack[k] {
+			s.stack[k] |= v
+			changed = true
+		}
+	}
+
+	//a variable that is missing from one of the states may still hold nil
+	for k, f := range o.frames {
+		vars := s.frames[k].vars
+		widen := func(idx uint32, v kindSet) {
+			old, ok := vars[idx]
+			if !ok {
+				old = kindsNil
+			}
+
+			if vars[idx] = old | v; !ok || old|v != old {
+				changed = true
+			}
+		}
+
+		for idx, v := range f.vars {
+			widen(idx, v)
+		}
+		for idx := range vars {
+			if _, ok := f.vars[idx]; !ok {
+				widen(idx, kindsNil)
+			}
+		}
+	}
+
+	return
+}
+
+type kindPoint struct {
+	pc      int
+	context string
+}
+
+type kindChecker struct {
+	program      BuiltProgram
+	instructions map[int]decodedInstruction
+	hosts        map[string]HostFunction
+	named        map[uint32]kindSet //kinds of the named constants by index
+
+	states   map[kindPoint]*kindState
+	queue    []kindPoint
+	findings map[kindPoint][]KindError
+	results  kindSet
+}
+
+//CheckKinds runs the program on the kinds of values instead of the values themselves, to find the instructions that can fail with ErrorType.
+//Named constants have their declared kinds, undeclared ones have the kind of their value in bindings or any kind if they are missing from it.
+//The program should pass Verify with the same host functions, structural problems are returned as a VerifyError.
+func (b BuiltProgram) CheckKinds(bindings map[string]Kind, hosts ...HostFunction) (report KindReport, err error) {
+	c := kindChecker{
+		program:  b,
+		hosts:    make(map[string]HostFunction),
+		named:    make(map[uint32]kindSet),
+		states:   make(map[kindPoint]*kindState),
+		findings: make(map[kindPoint][]KindError),
+	}
+
+	for _, h := range hosts {
+		c.hosts[h.Name] = h
+	}
+
+	for name, index := range b.reservedConstantIndices {
+		if index >= uint32(len(b.constantPool)) {
+			continue
+		}
+
+		if declared := b.constantPool[index].Kind; declared != KindNil {
+			c.named[index] = kindsOf(declared)
+		} else if bound, ok := bindings[name]; ok {
+			c.named[index] = kindsOf(bound)
+		} else {
+			c.named[index] = kindsAny
+		}
+	}
+
+	if c.instructions, err = decodeProgram(b.program); err != nil {
+		return
+	}
+
+	if err = c.flow(0, kindState{frames: []kindFrame{{-1, make(map[uint32]kindSet)}}}); err != nil {
+		return
+	}
+
+	for len(c.queue) > 0 {
+		p := c.queue[0]
+		c.queue = c.queue[1:]
+
+		if err = c.step(p); err != nil {
+			return
+		}
+	}
+
+	report.Errors, report.Warnings = c.collect()
+	report.Results = c.results.kinds()
+	return
+}
+
+func (c *kindChecker) flow(pc int, s kindState) error {
+	p := kindPoint{pc, s.context()}
+
+	existing, ok := c.states[p]
+	if !ok {
+		if len(c.states) == maxKindStates {
+			return ErrorKindStates
+		}
+
+		c.states[p] = &s
+		c.queue = append(c.queue, p)
+		return nil
+	}
+
+	if changed, err := existing.join(s); err != nil {
+		ins := c.instructions[pc]
+		return VerifyError{PC: pc, Opcode: ins.opcode, Err: err}
+	} else if changed {
+		c.queue = append(c.queue, p)
+	}
+
+	return nil
+}
+
+func (c *kindChecker) constantKinds(index uint32) kindSet {
+	if index >= uint32(len(c.program.constantPool)) {
+		return kindsNil
+	} else if named, ok := c.named[index]; ok {
+		return named
+	}
+
+	return kindsOf(c.program.constantPool[index].Kind)
+}
+
+//step applies the instruction at the point to its state and passes the result on to the successors
+func (c *kindChecker) step(p kindPoint) (err error) {
+	s := c.states[p].clone()
+
+	if p.pc == len(c.program.program) {
+		c.stop(s)
+		return nil
+	}
+
+	ins := c.instructions[p.pc]
+	fail := func(e error) error { return VerifyError{PC: ins.pc, Opcode: ins.opcode, Err: e} }
+
+	//findings are recomputed on every visit, the last visit has seen the widest state
+	c.findings[p] = nil
+	operand := 0
+
+	//pop removes the top of the stack, which must have one of the expected kinds; ok is false if it never has one
+	pop := func(expected kindSet) (v kindSet, ok bool, err error) {
+		if len(s.stack) == 0 {
+			return 0, false, fail(ErrorUnderflow)
+		}
+
+		v = s.stack[len(s.stack)-1]
+		s.stack = s.stack[:len(s.stack)-1]
+		c.check(p, ins, operand, v, expected)
+		operand++
+
+		return v & expected, v&expected != 0, nil
+	}
+	push := func(v ...kindSet) { s.stack = append(s.stack, v...) }
+
+	//alive is false once an operand can never be accepted, in which case the path ends here
+	alive := true
+	popAll := func(expected ...kindSet) (v []kindSet) {
+		v = make([]kindSet, len(expected))
+		for k := len(expected) - 1; k >= 0 && err == nil; k-- {
+			var ok bool
+			v[k], ok, err = pop(expected[k])
+			alive = alive && ok
+		}
+		return
+	}
+
+	frame := &s.frames[len(s.frames)-1]
+	next := []int{ins.next()}
+
+	switch ins.opcode {
+	case OpHLT:
+		c.stop(s)
+		return nil
+	case OpNOP:
+	case OpCLOAD:
+		push(c.constantKinds(ins.index()))
+	case OpLOAD:
+		if v, ok := frame.vars[ins.index()]; ok {
+			push(v)
+		} else {
+			push(kindsNil)
+		}
+	case OpSTORE:
+		v := popAll(kindsAny)
+		if err == nil {
+			frame.vars[ins.index()] = v[0]
+		}
+	case OpISNIL, OpKIND:
+		v := popAll(kindsAny)
+		if ins.opcode == OpISNIL {
+			push(v[0], kindsBool)
+		} else {
+			push(v[0], kindsNumber)
+		}
+	case OpSDUP:
+		v := popAll(kindsAny)
+		push(v[0], v[0])
+	case OpSDROP:
+		popAll(kindsAny)
+	case OpSSWAP:
+		v := popAll(kindsAny, kindsAny)
+		push(v[1], v[0])
+	case OpSOVER:
+		v := popAll(kindsAny, kindsAny)
+		push(v[0], v[1], v[0])
+	case OpSROT:
+		v := popAll(kindsAny, kindsAny, kindsAny)
+		push(v[1], v[2], v[0])
+	case OpCMP:
+		v := popAll(kindsAny, kindsAny)
+		if err == nil {
+			//both operands must have the same kind, which is certain if both have a single kind, the left one is reported as the culprit
+			shared := v[0] & v[1]
+			if shared == 0 || len(v[0].kinds()) > 1 || v[0] != v[1] {
+				c.record(p, ins, 1, v[0], v[1], shared == 0)
+			}
+			alive = shared != 0
+		}
+		push(kindsNumber)
+	case OpNADD, OpNSUB:
+		v := popAll(kindsArithmetic, kindsArithmetic)
+		var results kindSet
+		if err == nil {
+			//every pair of kinds that the operands may have must be accepted, the left one is reported as the culprit like for CMP
+			var partners kindSet
+			mismatch := false
+			for _, lhs := range v[0].kinds() {
+				for _, rhs := range v[1].kinds() {
+					if res, ok := arithmeticResult(ins.opcode, lhs, rhs); ok {
+						results |= kindsOf(res)
+					} else {
+						mismatch = true
+					}
+				}
+			}
+			for _, pair := range arithmeticKinds[ins.opcode] {
+				if v[1]&kindsOf(pair[1]) != 0 {
+					partners |= kindsOf(pair[0])
+				}
+			}
+
+			if mismatch {
+				c.record(p, ins, 1, v[0], partners, results == 0)
+			}
+			alive = alive && results != 0
+		}
+		push(results)
+	case OpLSTNEW:
+		elements := make([]kindSet, int(ins.arg[0]))
+		for k := range elements {
+			elements[k] = kindsElement
+		}
+		popAll(elements...)
+		push(kindsList)
+	case OpJMP:
+		next = []int{int(ins.index())}
+	case OpJMPT, OpJMPF:
+		v := popAll(kindsBool)
+		push(v...)
+		next = append(next, int(ins.index()))
+	case OpCALL, OpDCALL:
+		targets := []int{int(ins.index())}
+		if ins.opcode == OpDCALL {
+			if len(c.program.symbols) == 0 {
+				return fail(ErrorVerifyDynamicJump)
+			}
+
+			popAll(kindsNumber | kindsString)
+			targets = make([]int, 0, len(c.program.symbols))
+			for _, pc := range c.program.symbols {
+				targets = append(targets, int(pc))
+			}
+			sort.Ints(targets)
+		}
+
+		if len(s.frames) == callStackSize {
+			return fail(ErrorOverflow)
+		}
+
+		s.frames = append(s.frames, kindFrame{ins.next(), make(map[uint32]kindSet)})
+		next = targets
+	case OpRET:
+		if len(s.frames) == 1 {
+			return fail(ErrorVerifyReturn)
+		}
+
+		next = []int{s.frames[len(s.frames)-1].rp}
+		s.frames = s.frames[:len(s.frames)-1]
+	case OpHCALL:
+		host, ok := c.host(ins)
+		if !ok {
+			return fail(ErrorVerifyHost)
+		}
+
+		args := make([]kindSet, len(host.Args))
+		for k, v := range host.Args {
+			args[k] = kindsOf(v)
+		}
+		popAll(args...)
+
+		for _, v := range host.Returns {
+			push(kindsOf(v))
+		}
+	case OpDJMP, OpDJMPT, OpDJMPF:
+		return fail(ErrorVerifyDynamicJump)
+	default:
+		sig, ok := kindSignatures[ins.opcode]
+		if !ok {
+			return fail(ErrorBadOpcode)
+		}
+
+		popAll(sig.args...)
+		push(sig.results...)
+	}
+
+	if err != nil || !alive {
+		return
+	}
+
+	for _, pc := range next {
+		if err = c.flow(pc, s.clone()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (c *kindChecker) stop(s kindState) {
+	if len(s.stack) == 0 {
+		c.results |= kindsNil
+	} else {
+		c.results |= s.stack[len(s.stack)-1]
+	}
+}
+
+func (c *kindChecker) host(ins decodedInstruction) (HostFunction, bool) {
+	index := ins.index()
+	if index >= uint32(len(c.program.constantPool)) || c.program.constantPool[index].Kind != KindString {
+		return HostFunction{}, false
+	}
+
+	f, ok := c.hosts[c.program.constantPool[index].Data.(string)]
+	return f, ok
+}
+
+//check records a finding if the operand may have a kind that is not expected
+func (c *kindChecker) check(p kindPoint, ins decodedInstruction, operand int, got, expected kindSet) {
+	if got&^expected != 0 {
+		c.record(p, ins, operand, got, expected, got&expected == 0)
+	}
+}
+
+func (c *kindChecker) record(p kindPoint, ins decodedInstruction, operand int, got, expected kindSet, certain bool) {
+	pos, hasPos := c.program.SourcePosition(ins.pc)
+	c.findings[p] = append(c.findings[p], KindError{
+		PC:       ins.pc,
+		Opcode:   ins.opcode,
+		Pos:      pos,
+		HasPos:   hasPos,
+		Operand:  operand,
+		Expected: expected.kinds(),
+		Got:      got.kinds(),
+		Certain:  certain,
+	})
+}
+
+//collect merges the findings of every context in which an instruction was reached, a finding is certain if it is certain in one of them
+func (c *kindChecker) collect() (errs, warnings []KindError) {
+	type key struct{ pc, operand int }
+	merged := make(map[key]KindError)
+	certain := make(map[key]bool)
+
+	for _, findings := range c.findings {
+		for _, f := range findings {
+			k := key{f.PC, f.Operand}
+			if existing, ok := merged[k]; ok {
+				f.Got = (kindSetOf(existing.Got) | kindSetOf(f.Got)).kinds()
+				f.Expected = (kindSetOf(existing.Expected) | kindSetOf(f.Expected)).kinds()
+			}
+			merged[k] = f
+
+			certain[k] = certain[k] || f.Certain
+		}
+	}
+
+	keys := make([]key, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].pc < keys[j].pc || (keys[i].pc == keys[j].pc && keys[i].operand < keys[j].operand)
+	})
+
+	for _, k := range keys {
+		f := merged[k]
+		if f.Certain = certain[k]; f.Certain {
+			errs = append(errs, f)
+		} else {
+			warnings = append(warnings, f)
+		}
+	}
+
+	return
+}
+
+func kindSetOf(kinds []Kind) (s kindSet) {
+	for _, v := range kinds {
+		s |= kindsOf(v)
+	}
+
+	return
+}
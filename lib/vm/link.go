@@ -0,0 +1,133 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrorUnsupportedType = errors.New("type cannot be converted to a value")
+	ErrorMissingBinding  = errors.New("named constant is not bound")
+	ErrorBindingKind     = errors.New("bound value does not match the declared kind")
+)
+
+//BindingError describes a named constant that could not be linked
+type BindingError struct {
+	Name     string
+	Expected Kind //declared kind of the constant, KindNil if undeclared
+	Got      Kind //kind of the bound value, only meaningful for ErrorBindingKind
+	Err      error
+}
+
+func (e BindingError) Error() string {
+	if errors.Is(e.Err, ErrorBindingKind) {
+		return fmt.Sprintf("%s: expected %s, got %s", e.Name, e.Expected, e.Got)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Name, e.Err)
+}
+
+func (e BindingError) Unwrap() error { return e.Err }
+
+//LinkError aggregates every binding that could not be linked, sorted by name
+type LinkError struct {
+	Bindings []BindingError
+}
+
+func (e LinkError) Error() string {
+	messages := make([]string, len(e.Bindings))
+	for k, v := range e.Bindings {
+		messages[k] = v.Error()
+	}
+
+	return "failed to link: " + strings.Join(messages, "; ")
+}
+
+//Is reports whether any of the binding errors matches the target
+func (e LinkError) Is(target error) bool {
+	for _, v := range e.Bindings {
+		if errors.Is(v, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//DeclaredConstants returns the named constants of the program along with their declared kinds, KindNil stands for an undeclared kind
+func (b BuiltProgram) DeclaredConstants() map[string]Kind {
+	m := make(map[string]Kind)
+	for name, index := range b.reservedConstantIndices {
+		if index < uint32(len(b.constantPool)) {
+			m[name] = b.constantPool[index].Kind
+		}
+	}
+
+	return m
+}
+
+//Link binds the named constants of the program to the values in m and makes the given host functions callable.
+//The returned Program has its own copy of the constant pool, so a BuiltProgram can be linked concurrently and repeatedly.
+//Every named constant must be bound to a supported value of its declared kind, otherwise a LinkError listing every offending binding is returned.
+func (b BuiltProgram) Link(m map[string]interface{}, hosts ...HostFunction) (p Program, err error) {
+	p = Program{
+		Program:   b.program,
+		Constants: make([]Value, len(b.constantPool)),
+		Symbols:   make(map[string]uint32),
+		Hosts:     make(map[string]HostFunction),
+		SourceMap: b.sourceMap,
+	}
+
+	copy(p.Constants, b.constantPool)
+
+	for k, v := range b.symbols {
+		p.Symbols[k] = v
+	}
+
+	for _, v := range hosts {
+		p.Hosts[v.Name] = v
+	}
+
+	names := make([]string, 0, len(b.reservedConstantIndices))
+	for k := range b.reservedConstantIndices {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	linkErr := LinkError{}
+	for _, name := range names {
+		index := b.reservedConstantIndices[name]
+		if index >= uint32(len(p.Constants)) {
+			return Program{}, fmt.Errorf("%w: %s", ErrorVerifyConstant, name)
+		}
+
+		declared := p.Constants[index].Kind
+
+		raw, ok := m[name]
+		if !ok {
+			linkErr.Bindings = append(linkErr.Bindings, BindingError{Name: name, Expected: declared, Err: ErrorMissingBinding})
+			continue
+		}
+
+		v, err := ToValue(raw)
+		if err != nil {
+			linkErr.Bindings = append(linkErr.Bindings, BindingError{Name: name, Expected: declared, Err: err})
+			continue
+		}
+
+		if declared != KindNil && v.Kind != declared {
+			linkErr.Bindings = append(linkErr.Bindings, BindingError{Name: name, Expected: declared, Got: v.Kind, Err: ErrorBindingKind})
+			continue
+		}
+
+		p.Constants[index] = v
+	}
+
+	if len(linkErr.Bindings) != 0 {
+		return Program{}, linkErr
+	}
+
+	return
+}
@@ -0,0 +1,453 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrorOptimizeDynamicJump = errors.New("programs with dynamic jumps cannot be optimized")
+)
+
+//optNode is an instruction of a program that is being optimized, static jumps refer to their target node with nil being the end of the program.
+//pos is the source position that the instruction belongs to, not only the ones that start a source map entry.
+type optNode struct {
+	opcode byte
+	arg    []byte
+	target *optNode
+	pos    SourcePos
+	hasPos bool
+}
+
+func (n *optNode) size() int { return 1 + len(n.arg) }
+
+func (n *optNode) index() uint32 { return binary.LittleEndian.Uint32(n.arg) }
+
+type optimizer struct {
+	nodes     []*optNode
+	constants []Value
+	reserved  map[uint32]bool
+	symbols   map[string]*optNode
+
+	//targets holds every node that a jump or a symbol refers to, it is rebuilt before every pass
+	targets map[*optNode]bool
+}
+
+//Optimize returns an equivalent program that is smaller and faster to evaluate, the program itself is not modified.
+//Constant expressions are folded, redundant instruction pairs and unreachable code are removed and the constant pool is compacted,
+//string constants with the same value are merged. Jump targets, symbols and the source map are adjusted to the new offsets.
+//Only the behaviour of programs that pass Verify is preserved, e.g. removing DUP DROP hides a stack underflow of an unverified program.
+func (b BuiltProgram) Optimize() (BuiltProgram, error) {
+	o, err := newOptimizer(b)
+	if err != nil {
+		return b, err
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, pass := range []func() bool{o.removeUnreachable, o.foldConstants, o.peephole} {
+			o.markTargets()
+			if pass() {
+				changed = true
+			}
+		}
+	}
+
+	return o.emit(b), nil
+}
+
+func newOptimizer(b BuiltProgram) (*optimizer, error) {
+	instructions, err := decodeProgram(b.program)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &optimizer{
+		constants: append([]Value{}, b.constantPool...),
+		reserved:  make(map[uint32]bool),
+		symbols:   make(map[string]*optNode),
+	}
+
+	for _, v := range b.reservedConstantIndices {
+		o.reserved[v] = true
+	}
+
+	nodeAt := make(map[int]*optNode)
+	for pc := 0; pc < len(b.program); pc = instructions[pc].next() {
+		ins := instructions[pc]
+		if ins.opcode == OpDJMP || ins.opcode == OpDJMPT || ins.opcode == OpDJMPF {
+			return nil, VerifyError{PC: pc, Opcode: ins.opcode, Err: ErrorOptimizeDynamicJump}
+		}
+
+		node := &optNode{opcode: ins.opcode, arg: ins.arg}
+		node.pos, node.hasPos = lookupSource(b.sourceMap, pc)
+		nodeAt[pc] = node
+		o.nodes = append(o.nodes, node)
+	}
+
+	resolve := func(pc uint32) (*optNode, bool) {
+		if int(pc) == len(b.program) {
+			return nil, true
+		}
+
+		node, ok := nodeAt[int(pc)]
+		return node, ok
+	}
+
+	for _, ins := range instructions {
+		if isStaticJump(ins.opcode) {
+			var ok bool
+			if nodeAt[ins.pc].target, ok = resolve(ins.index()); !ok {
+				return nil, VerifyError{PC: ins.pc, Opcode: ins.opcode, Err: ErrorVerifyJumpTarget}
+			}
+		}
+	}
+
+	for name, pc := range b.symbols {
+		var ok bool
+		if o.symbols[name], ok = resolve(pc); !ok {
+			return nil, ErrorVerifySymbol
+		}
+	}
+
+	return o, nil
+}
+
+func (o *optimizer) markTargets() {
+	o.targets = make(map[*optNode]bool)
+
+	for _, v := range o.nodes {
+		if isStaticJump(v.opcode) && v.target != nil {
+			o.targets[v.target] = true
+		}
+	}
+	for _, v := range o.symbols {
+		if v != nil {
+			o.targets[v] = true
+		}
+	}
+}
+
+//straight reports whether control can only enter the n nodes starting at i through the first one
+func (o *optimizer) straight(i, n int) bool {
+	for j := i + 1; j < i+n; j++ {
+		if o.targets[o.nodes[j]] {
+			return false
+		}
+	}
+
+	return true
+}
+
+//replace substitutes the n nodes starting at i, references to the first node are moved to the first replacement or to the node that follows
+func (o *optimizer) replace(i, n int, replacement []*optNode) {
+	first := o.nodes[i]
+
+	var to *optNode
+	if len(replacement) != 0 {
+		to = replacement[0]
+	} else if i+n < len(o.nodes) {
+		to = o.nodes[i+n]
+	}
+
+	for _, v := range replacement {
+		v.pos, v.hasPos = first.pos, first.hasPos
+	}
+
+	for _, v := range o.nodes {
+		if isStaticJump(v.opcode) && v.target == first {
+			v.target = to
+		}
+	}
+	for k, v := range o.symbols {
+		if v == first {
+			o.symbols[k] = to
+		}
+	}
+
+	nodes := make([]*optNode, 0, len(o.nodes)-n+len(replacement))
+	nodes = append(nodes, o.nodes[:i]...)
+	nodes = append(nodes, replacement...)
+	o.nodes = append(nodes, o.nodes[i+n:]...)
+
+	o.markTargets()
+}
+
+//removeUnreachable removes the nodes that cannot be reached from the start of the program or from a symbol
+func (o *optimizer) removeUnreachable() bool {
+	indices := make(map[*optNode]int)
+	for k, v := range o.nodes {
+		indices[v] = k
+	}
+
+	reachable := make([]bool, len(o.nodes))
+	queue := make([]int, 0)
+	visit := func(n *optNode) {
+		if idx, ok := indices[n]; ok && !reachable[idx] {
+			reachable[idx] = true
+			queue = append(queue, idx)
+		}
+	}
+
+	if len(o.nodes) != 0 {
+		visit(o.nodes[0])
+	}
+	for _, v := range o.symbols {
+		visit(v)
+	}
+
+	for len(queue) > 0 {
+		idx := queue[0]
+		queue = queue[1:]
+		node := o.nodes[idx]
+
+		if isStaticJump(node.opcode) {
+			visit(node.target)
+		}
+		if node.opcode != OpJMP && node.opcode != OpHLT && node.opcode != OpRET && idx+1 < len(o.nodes) {
+			visit(o.nodes[idx+1])
+		}
+	}
+
+	nodes := make([]*optNode, 0, len(o.nodes))
+	for k, v := range o.nodes {
+		if reachable[k] {
+			nodes = append(nodes, v)
+		}
+	}
+
+	changed := len(nodes) != len(o.nodes)
+	o.nodes = nodes
+	return changed
+}
+
+func (o *optimizer) isConstant(n *optNode) bool {
+	switch n.opcode {
+	case OpNCONST, OpNCONST_0, OpNCONST_1, OpNCONST_2, OpBCONST_0, OpBCONST_1, OpNILCONST, OpICONST:
+		return true
+	case OpCLOAD:
+		return !o.reserved[n.index()]
+	}
+
+	return false
+}
+
+//isPure reports whether the instruction only depends on the values it pops
+func isPure(opcode byte) bool {
+	return opcode >= OpISNIL && opcode < OpHLT && opcode != OpCLOAD && opcode != OpSTORE && opcode != OpLOAD && opcode != OpNOW
+}
+
+//evaluate executes the nodes on an empty stack, the result is the stack afterwards
+func (o *optimizer) evaluate(nodes []*optNode) ([]Value, bool) {
+	code := bytes.Buffer{}
+	for _, v := range nodes {
+		code.WriteByte(v.opcode)
+		code.Write(v.arg)
+	}
+
+	scratch := NewVM(Program{Program: code.Bytes(), Constants: o.constants})
+	for range nodes {
+		if err := scratch.SingleStep(); err != nil {
+			return nil, false
+		}
+	}
+
+	return append([]Value{}, scratch.stack[:scratch.sp]...), true
+}
+
+//constantNodes returns the instructions that push the values, strings and lists are added to the constant pool
+func (o *optimizer) constantNodes(values []Value) []*optNode {
+	builder := ProgramBuilder{constantPool: o.constants}
+	for _, v := range values {
+		builder.EmitConst(v)
+	}
+	o.constants = builder.constantPool
+
+	code := builder.buffer.Bytes()
+	nodes := make([]*optNode, 0, len(values))
+	for pc := 0; pc < len(code); {
+		next := pc + 1 + GetOpcodeProperties(code[pc]).ArgSize
+		nodes = append(nodes, &optNode{opcode: code[pc], arg: code[pc+1 : next]})
+		pc = next
+	}
+
+	return nodes
+}
+
+//foldConstants replaces pure instructions whose operands are all constants by their result,
+//as long as that takes fewer instructions or the same amount of instructions in fewer bytes
+func (o *optimizer) foldConstants() (changed bool) {
+	for i := 0; i < len(o.nodes); i++ {
+		node := o.nodes[i]
+		if !isPure(node.opcode) {
+			continue
+		}
+
+		pops := GetOpcodeProperties(node.opcode).Pops
+		if node.opcode == OpLSTNEW {
+			pops = int(node.arg[0])
+		}
+		if pops == 0 || pops > i || !o.straight(i-pops, pops+1) {
+			continue
+		}
+
+		start := i - pops
+		window := o.nodes[start : i+1]
+
+		constant := true
+		for _, v := range window[:pops] {
+			constant = constant && o.isConstant(v)
+		}
+		if !constant {
+			continue
+		}
+
+		values, ok := o.evaluate(window)
+		if !ok {
+			continue
+		}
+
+		replacement := o.constantNodes(values)
+		if len(replacement) > len(window) || (len(replacement) == len(window) && nodesSize(replacement) > nodesSize(window)) {
+			continue
+		}
+
+		o.replace(start, len(window), replacement)
+		i = start + len(replacement) - 1
+		changed = true
+	}
+
+	return
+}
+
+func nodesSize(nodes []*optNode) (size int) {
+	for _, v := range nodes {
+		size += v.size()
+	}
+
+	return
+}
+
+//pushesBool reports whether the instruction always leaves a bool on the top of the stack
+func pushesBool(opcode byte) bool {
+	switch opcode {
+	case OpBCONST_0, OpBCONST_1, OpISNIL, OpLT, OpLE, OpEQ, OpGE, OpGT, OpNE, OpLAND, OpLOR, OpLXOR, OpLTTBLB, OpLNOT, OpLTTBLU,
+		OpITESTBIT, OpSTRPREFIX, OpSTRSUFFIX, OpSTRCONTAINS, OpSTRFOLDEQ, OpSTRGLOB, OpLSTIN:
+		return true
+	}
+
+	return false
+}
+
+//peephole removes instruction sequences that have no effect: NOP, DUP DROP, SWAP SWAP, NOT NOT on a bool and jumps to the next instruction
+func (o *optimizer) peephole() (changed bool) {
+	for i := 0; i < len(o.nodes); i++ {
+		node := o.nodes[i]
+
+		var next *optNode
+		if i+1 < len(o.nodes) {
+			next = o.nodes[i+1]
+		}
+
+		remove := 0
+		switch {
+		case node.opcode == OpNOP:
+			remove = 1
+		case isStaticJump(node.opcode) && node.opcode != OpCALL && node.target == next:
+			remove = 1
+		case next == nil || !o.straight(i, 2):
+			//pairs are only removed if the second instruction cannot be jumped to
+		case node.opcode == OpSDUP && next.opcode == OpSDROP, node.opcode == OpSSWAP && next.opcode == OpSSWAP:
+			remove = 2
+		case node.opcode == OpLNOT && next.opcode == OpLNOT && i > 0 && !o.targets[node] && pushesBool(o.nodes[i-1].opcode):
+			remove = 2
+		}
+
+		if remove != 0 {
+			o.replace(i, remove, nil)
+			i--
+			changed = true
+		}
+	}
+
+	return
+}
+
+//emit encodes the nodes, the constant pool keeps every named constant and the other constants that are still referenced
+func (o *optimizer) emit(b BuiltProgram) BuiltProgram {
+	pcs := make(map[*optNode]uint32)
+	end := uint32(0)
+	for _, v := range o.nodes {
+		pcs[v] = end
+		end += uint32(v.size())
+	}
+
+	pcOf := func(n *optNode) uint32 {
+		if n == nil {
+			return end
+		}
+		return pcs[n]
+	}
+
+	referenced := make(map[uint32]bool)
+	for _, v := range o.nodes {
+		if v.opcode == OpCLOAD || v.opcode == OpHCALL {
+			referenced[v.index()] = true
+		}
+	}
+
+	optimized := BuiltProgram{
+		constantPool:            make([]Value, 0),
+		reservedConstantIndices: make(map[string]uint32),
+		symbols:                 make(map[string]uint32),
+	}
+
+	indices := make(map[uint32]uint32)
+	merged := make(map[string]uint32)
+	for k, v := range o.constants {
+		idx := uint32(k)
+		if !o.reserved[idx] && !referenced[idx] {
+			continue
+		}
+
+		if !o.reserved[idx] && v.Kind == KindString {
+			if existing, ok := merged[v.Data.(string)]; ok {
+				indices[idx] = existing
+				continue
+			}
+			merged[v.Data.(string)] = uint32(len(optimized.constantPool))
+		}
+
+		indices[idx] = uint32(len(optimized.constantPool))
+		optimized.constantPool = append(optimized.constantPool, v)
+	}
+
+	code := bytes.Buffer{}
+	for _, v := range o.nodes {
+		code.WriteByte(v.opcode)
+
+		switch {
+		case isStaticJump(v.opcode):
+			_ = binary.Write(&code, binary.LittleEndian, pcOf(v.target))
+		case v.opcode == OpCLOAD || v.opcode == OpHCALL:
+			_ = binary.Write(&code, binary.LittleEndian, indices[v.index()])
+		default:
+			code.Write(v.arg)
+		}
+
+		if n := len(optimized.sourceMap); v.hasPos && (n == 0 || optimized.sourceMap[n-1].Pos != v.pos) {
+			optimized.sourceMap = append(optimized.sourceMap, SourceMapEntry{pcs[v], v.pos})
+		}
+	}
+	optimized.program = code.Bytes()
+
+	for k, v := range b.reservedConstantIndices {
+		optimized.reservedConstantIndices[k] = indices[v]
+	}
+	for k, v := range o.symbols {
+		optimized.symbols[k] = pcOf(v)
+	}
+
+	return optimized
+}
@@ -0,0 +1,191 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrorStepLimit   = errors.New("instruction budget exhausted")
+	ErrorMemoryLimit = errors.New("memory budget exhausted")
+)
+
+//StopReason describes why Run returned
+type StopReason uint8
+
+const (
+	StopHalted StopReason = iota
+	StopEOF
+	StopStepLimit
+	StopDeadline
+	StopCancelled
+	StopMemoryLimit
+	StopError
+	StopPaused
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopHalted:
+		return "halted"
+	case StopEOF:
+		return "end of program"
+	case StopStepLimit:
+		return "step limit"
+	case StopDeadline:
+		return "deadline"
+	case StopCancelled:
+		return "cancelled"
+	case StopMemoryLimit:
+		return "memory limit"
+	case StopError:
+		return "error"
+	case StopPaused:
+		return "paused"
+	default:
+		return "unknown"
+	}
+}
+
+//Limits bounds the execution of a program, zero values mean that the respective resource is not limited
+type Limits struct {
+	MaxSteps       int           //maximum number of instructions to execute
+	Timeout        time.Duration //wall-clock time budget, applied on top of the deadline of the context
+	MaxStackDepth  int           //maximum number of values on the stack, cannot exceed the capacity of the stack
+	MaxStringBytes int           //maximum number of string bytes held on the stack and in local variables
+}
+
+var (
+	//DefaultLimits are suitable for evaluating untrusted condition programs
+	DefaultLimits = Limits{
+		MaxSteps:       1 << 16,
+		Timeout:        time.Millisecond * 50,
+		MaxStackDepth:  stackSize,
+		MaxStringBytes: 1 << 16,
+	}
+)
+
+//RunResult is the outcome of Run, Top is ValueNil if the stack is empty
+type RunResult struct {
+	Top    Value
+	Steps  int
+	Reason StopReason
+}
+
+//contextCheckInterval is the amount of steps between checks of the context and the clock
+const contextCheckInterval = 256
+
+//Run executes the program until it halts, fails or exceeds one of the given limits.
+//A program that halts (either through HLT or by reaching its end) returns a nil error, every other stop reason is accompanied by an error.
+func (vm *VM) Run(ctx context.Context, limits Limits) (res RunResult, err error) {
+	return vm.run(ctx, limits, nil)
+}
+
+//run is Run with an optional check that is made after every instruction that does not halt, the run is paused as soon as it returns true
+func (vm *VM) run(ctx context.Context, limits Limits, shouldBreak func() bool) (res RunResult, err error) {
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+
+	defer func() { res.Top = vm.topOrNil() }()
+
+	for {
+		if res.Steps%contextCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				if err == context.DeadlineExceeded {
+					res.Reason = StopDeadline
+				} else {
+					res.Reason = StopCancelled
+				}
+				return
+			}
+		}
+
+		if limits.MaxSteps > 0 && res.Steps >= limits.MaxSteps {
+			res.Reason = StopStepLimit
+			err = ErrorStepLimit
+			return
+		}
+
+		opcode := byte(OpNOP)
+		if vm.pc >= 0 && vm.pc < len(vm.code) {
+			opcode = vm.code[vm.pc].opcode
+		}
+
+		if err = vm.SingleStep(); err == ErrorHLT {
+			res.Reason = StopHalted
+			err = nil
+			return
+		} else if err == ErrorEOF {
+			res.Reason = StopEOF
+			err = nil
+			return
+		} else if err != nil {
+			res.Reason = StopError
+			return
+		}
+		res.Steps++
+
+		if !vm.withinFootprint(limits, opcode) {
+			res.Reason = StopMemoryLimit
+			err = ErrorMemoryLimit
+			return
+		}
+
+		if shouldBreak != nil && !vm.halt && shouldBreak() {
+			res.Reason = StopPaused
+			return
+		}
+	}
+}
+
+func (vm *VM) topOrNil() Value {
+	if vm.sp == 0 {
+		return ValueNil
+	}
+
+	return vm.stack[vm.sp-1]
+}
+
+//stringBytes is the amount of string bytes held by a value, including the elements of lists
+func stringBytes(v Value) (total int) {
+	switch v.Kind {
+	case KindString:
+		return len(v.Data.(string))
+	case KindList:
+		for _, e := range v.Data.([]Value) {
+			total += stringBytes(e)
+		}
+	}
+
+	return
+}
+
+//withinFootprint checks the limits after an instruction with the given opcode has been executed.
+//Apart from HCALL and STORE, every instruction that adds string bytes leaves them on the top of the stack, so the stack and the locals are only scanned if the top holds strings.
+func (vm *VM) withinFootprint(limits Limits, opcode byte) bool {
+	if limits.MaxStackDepth > 0 && vm.sp > limits.MaxStackDepth {
+		return false
+	}
+
+	if top := vm.topOrNil(); limits.MaxStringBytes > 0 && (opcode == OpHCALL || opcode == OpSTORE || top.Kind == KindString || top.Kind == KindList) {
+		total := 0
+		for i := 0; i < vm.sp; i++ {
+			total += stringBytes(vm.stack[i])
+		}
+		for i := 0; i < vm.csp; i++ {
+			for _, v := range vm.callStack[i].vars {
+				total += stringBytes(v)
+			}
+		}
+
+		if total > limits.MaxStringBytes {
+			return false
+		}
+	}
+
+	return true
+}
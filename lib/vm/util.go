@@ -3,7 +3,7 @@ package vm
 import (
 	"bytes"
 	"encoding/binary"
-	"reflect"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -32,22 +32,64 @@ func makeIndex(index uint64) ([]byte, uint8) {
 	return buf, iType
 }
 
+//Token is a token of a source string along with its position, lines and columns start at 1 and columns count runes
+type Token struct {
+	Text   string
+	Line   int
+	Column int
+}
+
 func TokenizeString(str string) []string {
+	tokens := TokenizeStringPositions(str)
+
+	texts := make([]string, len(tokens))
+	for k, v := range tokens {
+		texts[k] = v.Text
+	}
+
+	return texts
+}
+
+//TokenizeStringPositions splits the string like TokenizeString, keeping the position at which every token starts.
+//A backslash followed by whitespace comments out the rest of the line and an opening parenthesis followed by whitespace comments out everything up to the next closing one.
+//Within tokens a backslash escapes the next rune, see DecodeEscape.
+func TokenizeStringPositions(str string) []Token {
 	const (
 		stateInit          = 0
 		stateReadingAtom   = 1
 		stateReadingString = 2
+		stateLineComment   = 3
+		stateBlockComment  = 4
 	)
 
 	state := stateInit
 	inEscape := false
 	buffer := strings.Builder{}
-	tokens := make([]string, 0)
+	tokens := make([]Token, 0)
+
+	runes := []rune(str)
+	i := 0
+	line, column := 1, 1
+	start := Token{}
 
 	pushRune := func(r rune) {
 		buffer.WriteRune(r)
 	}
 
+	//pushEscape decodes the escape sequence starting with r and skips the runes that belong to it
+	pushEscape := func(r rune) {
+		decoded, n := DecodeEscape(r, runes[i:])
+		buffer.WriteString(decoded)
+		i += n
+		column += n
+		inEscape = false
+	}
+
+	//endsWord is true if the rune that was just read is a whole word
+	endsWord := func() bool {
+		return i == len(runes) || unicode.IsSpace(runes[i])
+	}
+
 	endToken := func() {
 		state = stateInit
 
@@ -55,7 +97,8 @@ func TokenizeString(str string) []string {
 			return
 		}
 
-		tokens = append(tokens, buffer.String())
+		start.Text = buffer.String()
+		tokens = append(tokens, start)
 		buffer = strings.Builder{}
 	}
 
@@ -63,8 +106,13 @@ func TokenizeString(str string) []string {
 		stateInit: func(r rune) {
 			if unicode.IsSpace(r) {
 				return
+			} else if r == '\\' && endsWord() {
+				state = stateLineComment
+			} else if r == '(' && endsWord() {
+				state = stateBlockComment
 			} else {
 				pushRune(r)
+				start = Token{Line: line, Column: column}
 
 				if r == '"' {
 					state = stateReadingString
@@ -75,8 +123,7 @@ func TokenizeString(str string) []string {
 		},
 		stateReadingAtom: func(r rune) {
 			if inEscape {
-				pushRune(r)
-				inEscape = false
+				pushEscape(r)
 			} else {
 				if unicode.IsSpace(r) {
 					endToken()
@@ -89,8 +136,7 @@ func TokenizeString(str string) []string {
 		},
 		stateReadingString: func(r rune) {
 			if inEscape {
-				pushRune(r)
-				inEscape = false
+				pushEscape(r)
 			} else {
 				if r == '"' {
 					pushRune(r)
@@ -102,48 +148,92 @@ func TokenizeString(str string) []string {
 				}
 			}
 		},
+		stateLineComment: func(r rune) {
+			if r == '\n' {
+				state = stateInit
+			}
+		},
+		stateBlockComment: func(r rune) {
+			if r == ')' {
+				state = stateInit
+			}
+		},
 	}
 
-	for _, r := range []rune(str) {
+	for i < len(runes) {
+		r := runes[i]
+		i++
 		s[state](r)
+
+		if r == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
 	}
 	endToken()
 
 	return tokens
 }
 
-func genericPush(slicePtr interface{}, ptr *int, v interface{}) error {
-	sl := reflect.ValueOf(slicePtr)
-	slv := reflect.Indirect(sl)
-
-	if *ptr == slv.Len() {
-		return ErrorOverflow
+//DecodeEscape decodes the escape sequence made of a backslash, r and the runes following r, which are given as rest.
+//It returns the decoded text and the number of runes of rest that belong to the sequence.
+//\n, \r and \t stand for control characters and \xNN for a single byte, any other rune stands for itself.
+func DecodeEscape(r rune, rest []rune) (string, int) {
+	switch r {
+	case 'n':
+		return "\n", 0
+	case 'r':
+		return "\r", 0
+	case 't':
+		return "\t", 0
+	case 'x':
+		if len(rest) >= 2 {
+			if v, err := strconv.ParseUint(string(rest[:2]), 16, 8); err == nil {
+				return string([]byte{byte(v)}), 2
+			}
+		}
 	}
 
-	slv.Index(*ptr).Set(reflect.ValueOf(v))
-	*ptr += 1
+	return string(r), 0
+}
 
-	return nil
+//hasRadixPrefix reports whether s starts with 0x, 0o or 0b
+func hasRadixPrefix(s string) bool {
+	return len(s) > 2 && s[0] == '0' && strings.ContainsRune("xXoObB", rune(s[1]))
 }
 
-func genericTop(slice interface{}, sp int) (interface{}, error) {
-	if sp == 0 {
-		return nil, ErrorUnderflow
+//ParseNumber parses a numeric literal. Literals with a u suffix are ints, everything else is a number.
+//Besides the decimal and hexadecimal floats that strconv.ParseFloat accepts, integers may be written in hexadecimal, octal or binary
+//with a 0x, 0o or 0b prefix, an optional minus sign is allowed unless the literal is an int.
+//Prefixed numbers must not exceed 2^53, above which not every integer is a number.
+func ParseNumber(s string) (Value, bool) {
+	if strings.HasSuffix(s, "u") {
+		base, digits := 10, strings.TrimSuffix(s, "u")
+		if hasRadixPrefix(digits) {
+			base = 0
+		}
+
+		if v, err := strconv.ParseUint(digits, base, 64); err == nil {
+			return MakeInt(v), true
+		}
+		return ValueNil, false
 	}
 
-	return reflect.ValueOf(slice).Index(sp - 1), nil
-}
+	if digits := strings.TrimPrefix(s, "-"); hasRadixPrefix(digits) {
+		if v, err := strconv.ParseUint(digits, 0, 64); err == nil && v <= 1<<53 {
+			n := float64(v)
+			if digits != s {
+				n = -n
+			}
 
-func genericPop(slicePtr interface{}, ptr *int) (interface{}, error) {
-	if *ptr == 0 {
-		return nil, ErrorUnderflow
+			return MakeValue(n), true
+		}
 	}
 
-	sl := reflect.ValueOf(slicePtr)
-	slv := reflect.Indirect(sl)
-
-	*ptr -= 1
-	val := slv.Index(*ptr).Interface()
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return MakeValue(v), true
+	}
 
-	return val, nil
+	return ValueNil, false
 }
@@ -0,0 +1,364 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrorVerifyTruncated   = errors.New("instruction argument is truncated")
+	ErrorVerifyJumpTarget  = errors.New("jump target is not on an instruction boundary")
+	ErrorVerifyConstant    = errors.New("constant index is out of bounds")
+	ErrorVerifyDynamicJump = errors.New("dynamic jumps cannot be verified")
+	ErrorVerifyStackDepth  = errors.New("stack depth differs between paths")
+	ErrorVerifyReturn      = errors.New("return outside of a function")
+	ErrorVerifyRecursion   = errors.New("recursive calls cannot be verified")
+	ErrorVerifySymbol      = errors.New("symbol is not on an instruction boundary")
+	ErrorVerifyHost        = errors.New("host function is not known")
+)
+
+//VerifyError is returned by Verify, PC is the offset of the offending instruction
+type VerifyError struct {
+	PC     int
+	Opcode byte
+	Err    error
+}
+
+func (e VerifyError) Error() string {
+	return fmt.Sprintf("pc %d (%s): %s", e.PC, GetOpcodeProperties(e.Opcode).Name, e.Err)
+}
+
+func (e VerifyError) Unwrap() error { return e.Err }
+
+type decodedInstruction struct {
+	pc     int
+	opcode byte
+	props  OpcodeProperties
+	arg    []byte
+}
+
+func (i decodedInstruction) next() int { return i.pc + 1 + i.props.ArgSize }
+
+func (i decodedInstruction) index() (v uint32) {
+	_ = binary.Read(bytes.NewReader(i.arg), binary.LittleEndian, &v)
+	return
+}
+
+//decodeProgram splits the code into instructions, rejecting unknown opcodes and truncated arguments
+func decodeProgram(code []byte) (instructions map[int]decodedInstruction, err error) {
+	instructions = make(map[int]decodedInstruction)
+
+	for pc := 0; pc < len(code); {
+		ins := decodedInstruction{
+			pc:     pc,
+			opcode: code[pc],
+			props:  GetOpcodeProperties(code[pc]),
+		}
+
+		if ins.props.Bad() {
+			return nil, VerifyError{PC: pc, Opcode: ins.opcode, Err: ErrorBadOpcode}
+		}
+
+		if ins.next() > len(code) {
+			return nil, VerifyError{PC: pc, Opcode: ins.opcode, Err: ErrorVerifyTruncated}
+		}
+
+		ins.arg = code[pc+1 : ins.next()]
+		instructions[pc] = ins
+		pc = ins.next()
+	}
+
+	return
+}
+
+//functionSummary is the effect of a function on the stack relative to the depth at which it was called
+type functionSummary struct {
+	need    int  //values the caller must have on the stack
+	grow    int  //maximum amount of values above the call depth
+	delta   int  //change in depth after returning
+	calls   int  //maximum amount of frames that nested calls push on the call stack
+	returns bool //false if no RET is reachable
+}
+
+type verifier struct {
+	program      BuiltProgram
+	instructions map[int]decodedInstruction
+	hosts        map[string]HostFunction
+
+	summaries  map[int]functionSummary
+	inProgress map[int]bool
+}
+
+//Verify statically checks the program: every instruction must be known and complete, every static jump target must be on an instruction boundary,
+//every CLOAD must be within the constant pool and no path may underflow or overflow the stack or nest calls deeper than the call stack.
+//HCALL may only name one of the given host functions, whose signatures are used for the stack analysis.
+func (b BuiltProgram) Verify(hosts ...HostFunction) (err error) {
+	v := verifier{
+		program:    b,
+		hosts:      make(map[string]HostFunction),
+		summaries:  make(map[int]functionSummary),
+		inProgress: make(map[int]bool),
+	}
+
+	for _, h := range hosts {
+		v.hosts[h.Name] = h
+	}
+
+	if v.instructions, err = decodeProgram(b.program); err != nil {
+		return
+	}
+
+	for _, ins := range v.instructions {
+		if err = v.checkInstruction(ins); err != nil {
+			return
+		}
+	}
+
+	for name, pc := range b.symbols {
+		if !v.isBoundary(int(pc)) {
+			return fmt.Errorf("%w: %s", ErrorVerifySymbol, name)
+		}
+	}
+
+	if len(b.program) == 0 {
+		return nil
+	}
+
+	_, err = v.analyze(0, true)
+	return
+}
+
+func (v *verifier) isBoundary(pc int) bool {
+	if pc == len(v.program.program) {
+		return true
+	}
+
+	_, ok := v.instructions[pc]
+	return ok
+}
+
+func (v *verifier) checkInstruction(ins decodedInstruction) error {
+	switch ins.opcode {
+	case OpJMP, OpJMPT, OpJMPF, OpCALL:
+		if !v.isBoundary(int(ins.index())) {
+			return VerifyError{PC: ins.pc, Opcode: ins.opcode, Err: ErrorVerifyJumpTarget}
+		}
+	case OpCLOAD:
+		if ins.index() >= uint32(len(v.program.constantPool)) {
+			return VerifyError{PC: ins.pc, Opcode: ins.opcode, Err: ErrorVerifyConstant}
+		}
+	case OpHCALL:
+		if _, ok := v.host(ins); !ok {
+			return VerifyError{PC: ins.pc, Opcode: ins.opcode, Err: ErrorVerifyHost}
+		}
+	case OpDJMP, OpDJMPT, OpDJMPF:
+		return VerifyError{PC: ins.pc, Opcode: ins.opcode, Err: ErrorVerifyDynamicJump}
+	case OpDCALL:
+		if len(v.program.symbols) == 0 {
+			return VerifyError{PC: ins.pc, Opcode: ins.opcode, Err: ErrorVerifyDynamicJump}
+		}
+	}
+
+	return nil
+}
+
+//analyze walks every path starting at entry while tracking the stack depth relative to the entry.
+//The top level of the program is analyzed with absolute depths, in which case underflows and overflows are reported where they happen.
+func (v *verifier) analyze(entry int, topLevel bool) (summary functionSummary, err error) {
+	depths := map[int]int{entry: 0}
+	queue := []int{entry}
+
+	fail := func(ins decodedInstruction, e error) error {
+		return VerifyError{PC: ins.pc, Opcode: ins.opcode, Err: e}
+	}
+
+	flow := func(ins decodedInstruction, to, depth int) error {
+		if existing, ok := depths[to]; ok {
+			if existing != depth {
+				return fail(ins, ErrorVerifyStackDepth)
+			}
+			return nil
+		}
+
+		depths[to] = depth
+		queue = append(queue, to)
+		return nil
+	}
+
+	for len(queue) > 0 {
+		pc := queue[0]
+		queue = queue[1:]
+		depth := depths[pc]
+
+		if pc == len(v.program.program) {
+			continue
+		}
+
+		ins := v.instructions[pc]
+		need, after, grow := ins.props.Pops-depth, depth-ins.props.Pops+ins.props.Pushes, 0
+		if ins.props.Pushes > ins.props.Pops {
+			grow = after
+		}
+
+		fallsThrough := true
+
+		switch ins.opcode {
+		case OpHLT:
+			fallsThrough = false
+		case OpJMP:
+			fallsThrough = false
+			err = flow(ins, int(ins.index()), after)
+		case OpJMPT, OpJMPF:
+			err = flow(ins, int(ins.index()), after)
+		case OpRET:
+			if topLevel {
+				return summary, fail(ins, ErrorVerifyReturn)
+			}
+
+			fallsThrough = false
+			if summary.returns && summary.delta != depth {
+				return summary, fail(ins, ErrorVerifyStackDepth)
+			}
+			summary.returns = true
+			summary.delta = depth
+		case OpCALL:
+			var callee functionSummary
+			if callee, err = v.summarize(int(ins.index())); err != nil {
+				return
+			}
+
+			need, after, grow = callee.need-depth, depth+callee.delta, depth+callee.grow
+			fallsThrough = callee.returns
+			if callee.calls+1 > summary.calls {
+				summary.calls = callee.calls + 1
+			}
+		case OpLSTNEW:
+			n := int(ins.arg[0])
+			need, after, grow = n-depth, depth-n+1, 0
+			if after > depth {
+				grow = after
+			}
+		case OpHCALL:
+			host, _ := v.host(ins)
+			need, after = len(host.Args)-depth, depth-len(host.Args)+len(host.Returns)
+			if after > depth {
+				grow = after
+			}
+		case OpDCALL:
+			var callee functionSummary
+			if callee, err = v.summarizeSymbols(); err != nil {
+				return
+			}
+
+			//the name of the callee is popped before the call
+			need, after, grow = callee.need-(depth-1), depth-1+callee.delta, depth-1+callee.grow
+			if 1-depth > need {
+				need = 1 - depth
+			}
+			fallsThrough = callee.returns
+			if callee.calls+1 > summary.calls {
+				summary.calls = callee.calls + 1
+			}
+		}
+
+		if err != nil {
+			return
+		}
+
+		if need > summary.need {
+			summary.need = need
+		}
+		if grow > summary.grow {
+			summary.grow = grow
+		}
+
+		if topLevel && summary.need > 0 {
+			return summary, fail(ins, ErrorUnderflow)
+		}
+		if topLevel && summary.grow > stackSize {
+			return summary, fail(ins, ErrorOverflow)
+		}
+		//the top level holds the first frame of the call stack
+		if topLevel && summary.calls >= callStackSize {
+			return summary, fail(ins, ErrorOverflow)
+		}
+
+		if fallsThrough {
+			if err = flow(ins, ins.next(), after); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (v *verifier) host(ins decodedInstruction) (HostFunction, bool) {
+	index := ins.index()
+	if index >= uint32(len(v.program.constantPool)) || v.program.constantPool[index].Kind != KindString {
+		return HostFunction{}, false
+	}
+
+	f, ok := v.hosts[v.program.constantPool[index].Data.(string)]
+	return f, ok
+}
+
+func (v *verifier) summarize(entry int) (summary functionSummary, err error) {
+	if s, ok := v.summaries[entry]; ok {
+		return s, nil
+	}
+
+	if v.inProgress[entry] {
+		ins := v.instructions[entry]
+		return summary, VerifyError{PC: ins.pc, Opcode: ins.opcode, Err: ErrorVerifyRecursion}
+	}
+
+	v.inProgress[entry] = true
+	defer delete(v.inProgress, entry)
+
+	if summary, err = v.analyze(entry, false); err != nil {
+		return
+	}
+
+	v.summaries[entry] = summary
+	return
+}
+
+//summarizeSymbols combines the summaries of every symbol as DCALL may call any of them, all symbols that return must agree on their effect
+func (v *verifier) summarizeSymbols() (summary functionSummary, err error) {
+	names := make([]string, 0, len(v.program.symbols))
+	for k := range v.program.symbols {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var s functionSummary
+		if s, err = v.summarize(int(v.program.symbols[name])); err != nil {
+			return
+		}
+
+		if s.returns && summary.returns && s.delta != summary.delta {
+			return summary, fmt.Errorf("%w: %s", ErrorVerifyStackDepth, name)
+		}
+
+		if s.need > summary.need {
+			summary.need = s.need
+		}
+		if s.grow > summary.grow {
+			summary.grow = s.grow
+		}
+		if s.calls > summary.calls {
+			summary.calls = s.calls
+		}
+		if s.returns {
+			summary.returns = true
+			summary.delta = s.delta
+		}
+	}
+
+	return
+}
@@ -1,17 +1,24 @@
 package vm
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"example.com/itsuMain/lib/util"
 	"fmt"
 	"math"
+	"net"
+	"strings"
+	"time"
 )
 
 const (
 	stackSize     = 64
 	callStackSize = 16
+
+	//maxStringLength is the maximum length of a string produced by an instruction
+	maxStringLength = 1 << 12
+	//maxListLength is the maximum length of a list produced by an instruction
+	maxListLength = 1 << 8
 )
 
 var (
@@ -24,15 +31,75 @@ var (
 	ErrorUnsupportedConstant = errors.New("loaded constant's type is not supported")
 	ErrorType                = errors.New("type error")
 	ErrorArithmetic          = errors.New("arithmetic sign error")
+	ErrorUnknownSymbol       = errors.New("called symbol is not defined")
+	ErrorStringLength        = errors.New("string result is too long")
+	ErrorGlobPattern         = errors.New("malformed glob pattern")
+	ErrorVersion             = errors.New("malformed semantic version")
+	ErrorCIDR                = errors.New("malformed CIDR prefix")
+	ErrorListLength          = errors.New("list result is too long")
+	ErrorListIndex           = errors.New("list index is out of bounds")
 )
 
+//callFrame holds the return address and the locals of a function, the bottom frame belongs to the top level of the program.
+//vars is created by the first store so that calls to functions without locals do not allocate.
 type callFrame struct {
 	rp   int
 	vars map[uint32]Value
 }
 
+type opcodeHandler func(vm *VM, ins *instruction) error
+
+//instruction is an instruction decoded ahead of execution, err is set if no valid instruction starts at its offset
+type instruction struct {
+	handler opcodeHandler
+	opcode  byte
+	arg     uint64
+	next    int
+	err     error
+}
+
+func (ins *instruction) index() uint32   { return uint32(ins.arg) }
+func (ins *instruction) number() float64 { return math.Float64frombits(ins.arg) }
+
+//opcodeHandlers is indexed by opcode, opcodes without a handler are nil
+var opcodeHandlers [256]opcodeHandler
+
+//decodeInstructions decodes an instruction at every offset of the code since jump targets are not known ahead of time
+func decodeInstructions(code []byte) []instruction {
+	instructions := make([]instruction, len(code))
+
+	for pc := range code {
+		ins := &instructions[pc]
+		ins.opcode = code[pc]
+
+		props := GetOpcodeProperties(ins.opcode)
+		if ins.handler = opcodeHandlers[ins.opcode]; props.Bad() || ins.handler == nil {
+			ins.err = ErrorBadOpcode
+			continue
+		}
+
+		ins.next = pc + 1 + props.ArgSize
+		if ins.next > len(code) {
+			ins.err = ErrorBadEOF
+			continue
+		}
+
+		switch arg := code[pc+1 : ins.next]; props.ArgSize {
+		case 1:
+			ins.arg = uint64(arg[0])
+		case 4:
+			ins.arg = uint64(binary.LittleEndian.Uint32(arg))
+		case 8:
+			ins.arg = binary.LittleEndian.Uint64(arg)
+		}
+	}
+
+	return instructions
+}
+
 type VM struct {
 	program Program
+	code    []instruction
 	pc      int
 
 	stack [stackSize]Value
@@ -41,92 +108,188 @@ type VM struct {
 	callStack [callStackSize]callFrame
 	csp       int
 
+	hosts map[string]HostFunction
+	clock func() time.Time //read by NOW, time.Now if nil
+
 	halt bool
 }
 
 func NewVM(program Program) *VM {
 	v := &VM{
 		program: program,
+		code:    decodeInstructions(program.Program),
 		pc:      0,
-		stack:   [stackSize]Value{ValueNil},
 		sp:      0,
 	}
 
+	v.callStack[0] = callFrame{rp: -1}
+	v.csp = 1
+
 	return v
 }
 
+//SingleStep executes one instruction. ErrorHLT and ErrorEOF are returned as they are, every other error is wrapped in a RuntimeError.
 func (vm *VM) SingleStep() (err error) {
-	if vm.pc == len(vm.program.Program) {
-		return ErrorEOF
-	} else if vm.halt {
+	if vm.halt {
 		return ErrorHLT
+	} else if vm.pc == len(vm.code) {
+		return ErrorEOF
+	} else if vm.pc < 0 || vm.pc > len(vm.code) {
+		return ErrorBadEOF
 	}
 
-	var opcode byte
-	var argBytes []byte
-	if opcode, argBytes, err = vm.readInstruction(); err != nil {
-		return
+	pc, ins := vm.pc, &vm.code[vm.pc]
+	if ins.err != nil {
+		return vm.runtimeError(pc, ins.opcode, ins.err)
+	}
+
+	vm.pc = ins.next
+	if err = ins.handler(vm, ins); err != nil {
+		return vm.runtimeError(pc, ins.opcode, err)
 	}
 
-	index := uint32(0)
-	number := float64(0)
+	return nil
+}
 
-	if argSize := GetOpcodeProperties(opcode).ArgSize; argSize == 4 {
-		if err = binary.Read(bytes.NewReader(argBytes), binary.LittleEndian, &index); err != nil {
-			return
+var (
+	//smallNumbers are boxed once so that pushing them does not allocate, they cover the NCONST_n opcodes and the results of CMP and VERCMP
+	smallNumbers = [4]Value{MakeValue(0.), MakeValue(1.), MakeValue(2.), MakeValue(-1.)}
+)
+
+//compareValues implements CMP for values of the same kind, numbers and ints are compared without reflection
+func compareValues(lhs, rhs Value) Value {
+	res := 2
+
+	switch lhs.Kind {
+	case KindNumber:
+		l, r := lhs.Data.(float64), rhs.Data.(float64)
+		if l < r {
+			res = -1
+		} else if l == r {
+			res = 0
+		} else if l > r {
+			res = 1
 		}
-	} else if argSize == 8 {
-		if err = binary.Read(bytes.NewReader(argBytes), binary.LittleEndian, &number); err != nil {
-			return
+	case KindInt:
+		l, r := lhs.Data.(uint64), rhs.Data.(uint64)
+		if l < r {
+			res = -1
+		} else if l == r {
+			res = 0
+		} else {
+			res = 1
 		}
-	}
-
-	arithHelper := func(fn func(lhs, rhs float64) float64) (err error) {
-		if lhs, rhs, err := vm.Pop2Kind(KindNumber); err != nil {
-			return err
+	case KindTime:
+		l, r := lhs.Data.(time.Time), rhs.Data.(time.Time)
+		if l.Before(r) {
+			res = -1
+		} else if l.Equal(r) {
+			res = 0
+		} else {
+			res = 1
+		}
+	case KindDuration:
+		l, r := lhs.Data.(time.Duration), rhs.Data.(time.Duration)
+		if l < r {
+			res = -1
+		} else if l == r {
+			res = 0
 		} else {
-			return vm.Push(MakeValue(fn(lhs.Data.(float64), rhs.Data.(float64))))
+			res = 1
 		}
+	default:
+		res = util.Spaceship(lhs.Data, rhs.Data)
 	}
 
-	unaryArithHelper := func(fn func(v float64) float64) (err error) {
-		if v, err := vm.PopKind(KindNumber); err != nil {
-			return err
+	if res == -1 {
+		return smallNumbers[3]
+	}
+	return smallNumbers[res]
+}
+
+func arithHelper(vm *VM, fn func(lhs, rhs float64) float64) (err error) {
+	if lhs, rhs, err := vm.Pop2Kind(KindNumber); err != nil {
+		return err
+	} else {
+		return vm.Push(MakeValue(fn(lhs.Data.(float64), rhs.Data.(float64))))
+	}
+}
+
+//timeArithmetic implements NADD and NSUB for operands that are not both numbers, durations that overflow are an arithmetic error
+func timeArithmetic(opcode byte, lhs, rhs Value) (Value, error) {
+	switch {
+	case lhs.Kind == KindTime && rhs.Kind == KindDuration:
+		d := rhs.Data.(time.Duration)
+		if opcode == OpNSUB {
+			if d == math.MinInt64 {
+				return ValueNil, ErrorArithmetic
+			}
+			d = -d
+		}
+		return MakeTime(lhs.Data.(time.Time).Add(d)), nil
+	case lhs.Kind == KindDuration && rhs.Kind == KindTime && opcode == OpNADD:
+		return MakeTime(rhs.Data.(time.Time).Add(lhs.Data.(time.Duration))), nil
+	case lhs.Kind == KindTime && rhs.Kind == KindTime && opcode == OpNSUB:
+		//Sub saturates instead of overflowing
+		return MakeDuration(lhs.Data.(time.Time).Sub(rhs.Data.(time.Time))), nil
+	case lhs.Kind == KindDuration && rhs.Kind == KindDuration:
+		l, r := lhs.Data.(time.Duration), rhs.Data.(time.Duration)
+		if opcode == OpNSUB {
+			if r == math.MinInt64 {
+				return ValueNil, ErrorArithmetic
+			}
+			r = -r
+		}
+
+		if res := l + r; (r > 0 && res < l) || (r < 0 && res > l) {
+			return ValueNil, ErrorArithmetic
 		} else {
-			return vm.Push(MakeValue(fn(v.Data.(float64))))
+			return MakeDuration(res), nil
 		}
 	}
 
-	opcodeHandlers := map[uint8]func() error{
-		OpNCONST:   func() error { return vm.Push(MakeValue(number)) },
-		OpNCONST_0: func() error { return vm.Push(MakeValue(opcode - OpNCONST_0)) },
-		OpBCONST_0: func() error { return vm.Push(MakeValue(opcode == OpBCONST_1)) },
-		OpNILCONST: func() error { return vm.Push(MakeValue(nil)) },
-		OpISNIL: func() error {
+	return ValueNil, ErrorType
+}
+
+func unaryArithHelper(vm *VM, fn func(v float64) float64) (err error) {
+	if v, err := vm.PopKind(KindNumber); err != nil {
+		return err
+	} else {
+		return vm.Push(MakeValue(fn(v.Data.(float64))))
+	}
+}
+
+func init() {
+	handlers := map[uint8]opcodeHandler{
+		OpNCONST:   func(vm *VM, ins *instruction) error { return vm.Push(MakeValue(ins.number())) },
+		OpNCONST_0: func(vm *VM, ins *instruction) error { return vm.Push(smallNumbers[ins.opcode-OpNCONST_0]) },
+		OpBCONST_0: func(vm *VM, ins *instruction) error { return vm.Push(MakeValue(ins.opcode == OpBCONST_1)) },
+		OpNILCONST: func(vm *VM, ins *instruction) error { return vm.Push(MakeValue(nil)) },
+		OpISNIL: func(vm *VM, ins *instruction) error {
 			if vm.sp == 0 {
 				return ErrorUnderflow
 			}
 
 			return vm.Push(MakeValue(vm.stack[vm.sp-1].Kind == KindNil))
 		},
-		OpKIND: func() error {
+		OpKIND: func(vm *VM, ins *instruction) error {
 			if vm.sp == 0 {
 				return ErrorUnderflow
 			}
 
 			return vm.Push(MakeValue(int(vm.stack[vm.sp-1].Kind)))
 		},
-		OpCLOAD: func() error { return vm.LoadConstant(index) },
-		OpLOAD:  func() error { return vm.LoadVariable(index) },
-		OpSTORE: func() error {
+		OpCLOAD: func(vm *VM, ins *instruction) error { return vm.LoadConstant(ins.index()) },
+		OpLOAD:  func(vm *VM, ins *instruction) error { return vm.LoadVariable(ins.index()) },
+		OpSTORE: func(vm *VM, ins *instruction) error {
 			if v, err := vm.Pop(); err != nil {
 				return err
 			} else {
-				return vm.StoreVariable(index, v)
+				return vm.StoreVariable(ins.index(), v)
 			}
 		},
 
-		OpSDUP: func() error {
+		OpSDUP: func(vm *VM, ins *instruction) error {
 			if vm.sp < 1 {
 				return ErrorUnderflow
 			} else if vm.sp == stackSize {
@@ -137,7 +300,7 @@ func (vm *VM) SingleStep() (err error) {
 			vm.sp++
 			return nil
 		},
-		OpSDROP: func() error {
+		OpSDROP: func(vm *VM, ins *instruction) error {
 			if vm.sp < 1 {
 				return ErrorUnderflow
 			}
@@ -146,7 +309,7 @@ func (vm *VM) SingleStep() (err error) {
 			vm.stack[vm.sp] = ValueNil
 			return nil
 		},
-		OpSSWAP: func() error {
+		OpSSWAP: func(vm *VM, ins *instruction) error {
 			if vm.sp < 2 {
 				return ErrorUnderflow
 			}
@@ -154,7 +317,7 @@ func (vm *VM) SingleStep() (err error) {
 			vm.stack[vm.sp-1], vm.stack[vm.sp-2] = vm.stack[vm.sp-2], vm.stack[vm.sp-1]
 			return nil
 		},
-		OpSOVER: func() error {
+		OpSOVER: func(vm *VM, ins *instruction) error {
 			if vm.sp < 2 {
 				return ErrorUnderflow
 			} else if vm.sp == stackSize {
@@ -165,7 +328,7 @@ func (vm *VM) SingleStep() (err error) {
 			vm.sp++
 			return nil
 		},
-		OpSROT: func() error {
+		OpSROT: func(vm *VM, ins *instruction) error {
 			if vm.sp < 3 {
 				return ErrorUnderflow
 			}
@@ -175,7 +338,7 @@ func (vm *VM) SingleStep() (err error) {
 			return nil
 		},
 
-		OpCMP: func() error {
+		OpCMP: func(vm *VM, ins *instruction) error {
 			if vm.sp < 2 {
 				return ErrorUnderflow
 			}
@@ -189,10 +352,10 @@ func (vm *VM) SingleStep() (err error) {
 				return ErrorType
 			}
 
-			vm.stack[vm.sp-1] = MakeValue(util.Spaceship(vLhs.Data, vRhs.Data))
+			vm.stack[vm.sp-1] = compareValues(vLhs, vRhs)
 			return nil
 		},
-		OpLT: func() error {
+		OpLT: func(vm *VM, ins *instruction) error {
 			if vm.sp < 1 {
 				return ErrorUnderflow
 			}
@@ -204,7 +367,7 @@ func (vm *VM) SingleStep() (err error) {
 				return ErrorType
 			}
 
-			cType := opcode - OpLT
+			cType := ins.opcode - OpLT
 			bRes = util.MatCond(cType == comparisonTypeLt, sRes < 0) &&
 				util.MatCond(cType == comparisonTypeLE, sRes <= 0) &&
 				util.MatCond(cType == comparisonTypeEq, sRes == 0) &&
@@ -215,16 +378,16 @@ func (vm *VM) SingleStep() (err error) {
 			vm.stack[vm.sp-1] = MakeValue(bRes)
 			return nil
 		},
-		OpLTTBLB: func() error {
+		OpLTTBLB: func(vm *VM, ins *instruction) error {
 			if vm.sp < 2 {
 				return ErrorUnderflow
 			}
 
 			tTable := uint8(0)
-			if opcode == OpLTTBLB {
-				tTable = argBytes[0]
+			if ins.opcode == OpLTTBLB {
+				tTable = byte(ins.arg)
 			} else {
-				switch opcode {
+				switch ins.opcode {
 				case OpLAND:
 					tTable = uint8(util.RelAnd)
 					break
@@ -243,11 +406,11 @@ func (vm *VM) SingleStep() (err error) {
 				return vm.Push(MakeValue(util.TTableEval(lhs.Data.(bool), rhs.Data.(bool), util.Relation(tTable))))
 			}
 		},
-		OpLTTBLU: func() error {
+		OpLTTBLU: func(vm *VM, ins *instruction) error {
 			tTable := uint8(0)
-			if opcode == OpLTTBLU {
-				tTable = argBytes[0]
-			} else if opcode == OpLNOT {
+			if ins.opcode == OpLTTBLU {
+				tTable = byte(ins.arg)
+			} else if ins.opcode == OpLNOT {
 				tTable = uint8(util.RelNotP)
 			}
 
@@ -258,14 +421,39 @@ func (vm *VM) SingleStep() (err error) {
 			}
 		},
 
-		OpNADD:  func() error { return arithHelper(func(lhs, rhs float64) float64 { return lhs + rhs }) },
-		OpNSUB:  func() error { return arithHelper(func(lhs, rhs float64) float64 { return lhs - rhs }) },
-		OpNMUL:  func() error { return arithHelper(func(lhs, rhs float64) float64 { return lhs * rhs }) },
-		OpNDIV:  func() error { return arithHelper(func(lhs, rhs float64) float64 { return lhs / rhs }) },
-		OpNFMOD: func() error { return arithHelper(func(lhs, rhs float64) float64 { return math.Mod(lhs, rhs) }) },
-		OpNPOW:  func() error { return arithHelper(func(lhs, rhs float64) float64 { return math.Pow(lhs, rhs) }) },
-		OpNSHL: func() error {
-			if lhs, rhs, err := vm.Pop2(); err != nil {
+		OpNADD: func(vm *VM, ins *instruction) error {
+			lhs, rhs, err := vm.Pop2()
+			if err != nil {
+				return err
+			}
+
+			if lhs.Kind == KindNumber && rhs.Kind == KindNumber {
+				if ins.opcode == OpNADD {
+					return vm.Push(MakeValue(lhs.Data.(float64) + rhs.Data.(float64)))
+				}
+				return vm.Push(MakeValue(lhs.Data.(float64) - rhs.Data.(float64)))
+			}
+
+			if v, err := timeArithmetic(ins.opcode, lhs, rhs); err != nil {
+				return err
+			} else {
+				return vm.Push(v)
+			}
+		},
+		OpNMUL: func(vm *VM, ins *instruction) error {
+			return arithHelper(vm, func(lhs, rhs float64) float64 { return lhs * rhs })
+		},
+		OpNDIV: func(vm *VM, ins *instruction) error {
+			return arithHelper(vm, func(lhs, rhs float64) float64 { return lhs / rhs })
+		},
+		OpNFMOD: func(vm *VM, ins *instruction) error {
+			return arithHelper(vm, func(lhs, rhs float64) float64 { return math.Mod(lhs, rhs) })
+		},
+		OpNPOW: func(vm *VM, ins *instruction) error {
+			return arithHelper(vm, func(lhs, rhs float64) float64 { return math.Pow(lhs, rhs) })
+		},
+		OpNSHL: func(vm *VM, ins *instruction) error {
+			if lhs, rhs, err := vm.Pop2Kind(KindNumber); err != nil {
 				return err
 			} else {
 				lhsV, rhsV := lhs.Data.(float64), rhs.Data.(float64)
@@ -277,53 +465,352 @@ func (vm *VM) SingleStep() (err error) {
 
 				newVal := int64(0)
 
-				if opcode == OpNSHL {
+				if ins.opcode == OpNSHL {
 					newVal = int64(lhsV) << shiftBy
 				} else {
 					newVal = int64(lhsV) >> shiftBy
 				}
 
-				return vm.Push(MakeValue(newVal))
+				return vm.Push(MakeValue(float64(newVal)))
+			}
+		},
+		OpNSQRT: func(vm *VM, ins *instruction) error {
+			return unaryArithHelper(vm, func(v float64) float64 { return math.Sqrt(v) })
+		},
+		OpNTRUNC: func(vm *VM, ins *instruction) error {
+			return unaryArithHelper(vm, func(v float64) float64 { return math.Trunc(v) })
+		},
+		OpNFLOOR: func(vm *VM, ins *instruction) error {
+			return unaryArithHelper(vm, func(v float64) float64 { return math.Floor(v) })
+		},
+		OpNCEIL: func(vm *VM, ins *instruction) error {
+			return unaryArithHelper(vm, func(v float64) float64 { return math.Ceil(v) })
+		},
+
+		OpICONST: func(vm *VM, ins *instruction) error { return vm.Push(MakeInt(ins.arg)) },
+		OpIAND: func(vm *VM, ins *instruction) error {
+			if lhs, rhs, err := vm.Pop2Kind(KindInt); err != nil {
+				return err
+			} else {
+				l, r := lhs.Data.(uint64), rhs.Data.(uint64)
+				switch ins.opcode {
+				case OpIAND:
+					return vm.Push(MakeInt(l & r))
+				case OpIOR:
+					return vm.Push(MakeInt(l | r))
+				default:
+					return vm.Push(MakeInt(l ^ r))
+				}
+			}
+		},
+		OpINOT: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindInt); err != nil {
+				return err
+			} else {
+				return vm.Push(MakeInt(^v.Data.(uint64)))
+			}
+		},
+		OpISHL: func(vm *VM, ins *instruction) error {
+			if lhs, rhs, err := vm.Pop2(); err != nil {
+				return err
+			} else if lhs.Kind != KindInt {
+				return ErrorType
+			} else if n, err := bitIndex(rhs); err != nil {
+				return err
+			} else {
+				v := lhs.Data.(uint64)
+				switch ins.opcode {
+				case OpISHL:
+					return vm.Push(MakeInt(v << n))
+				case OpISHR:
+					return vm.Push(MakeInt(v >> n))
+				default:
+					return vm.Push(MakeValue((v>>n)&1 == 1))
+				}
+			}
+		},
+		OpITON: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindInt); err != nil {
+				return err
+			} else {
+				return vm.Push(MakeValue(float64(v.Data.(uint64))))
+			}
+		},
+		OpNTOI: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindNumber); err != nil {
+				return err
+			} else if n := v.Data.(float64); n < 0 || math.IsNaN(n) || n >= 1<<64 {
+				return ErrorArithmetic
+			} else {
+				return vm.Push(MakeInt(uint64(n)))
+			}
+		},
+
+		OpSTRLEN: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindString); err != nil {
+				return err
+			} else {
+				return vm.Push(MakeValue(len(v.Data.(string))))
+			}
+		},
+		OpSTRCAT: func(vm *VM, ins *instruction) error {
+			if lhs, rhs, err := vm.Pop2Kind(KindString); err != nil {
+				return err
+			} else {
+				return vm.pushString(lhs.Data.(string) + rhs.Data.(string))
+			}
+		},
+		OpSTRSUB: func(vm *VM, ins *instruction) error {
+			start, n, err := vm.Pop2Kind(KindNumber)
+			if err != nil {
+				return err
+			}
+
+			v, err := vm.PopKind(KindString)
+			if err != nil {
+				return err
+			}
+
+			s := v.Data.(string)
+			from, count := start.Data.(float64), n.Data.(float64)
+			if from < 0 || count < 0 || math.IsNaN(from) || math.IsNaN(count) {
+				return ErrorArithmetic
+			}
+
+			lo := len(s)
+			if from < float64(lo) {
+				lo = int(from)
+			}
+			hi := len(s)
+			if count < float64(hi-lo) {
+				hi = lo + int(count)
+			}
+
+			return vm.Push(MakeValue(s[lo:hi]))
+		},
+		OpSTRPREFIX: func(vm *VM, ins *instruction) error {
+			lhs, rhs, err := vm.Pop2Kind(KindString)
+			if err != nil {
+				return err
+			}
+
+			l, r := lhs.Data.(string), rhs.Data.(string)
+			res := false
+
+			switch ins.opcode {
+			case OpSTRPREFIX:
+				res = strings.HasPrefix(l, r)
+			case OpSTRSUFFIX:
+				res = strings.HasSuffix(l, r)
+			case OpSTRCONTAINS:
+				res = strings.Contains(l, r)
+			case OpSTRFOLDEQ:
+				res = strings.EqualFold(l, r)
+			case OpSTRGLOB:
+				if res, err = matchGlob(r, l); err != nil {
+					return err
+				}
+			}
+
+			return vm.Push(MakeValue(res))
+		},
+		OpSTRLOWER: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindString); err != nil {
+				return err
+			} else if ins.opcode == OpSTRLOWER {
+				return vm.pushString(strings.ToLower(v.Data.(string)))
+			} else {
+				return vm.pushString(strings.ToUpper(v.Data.(string)))
+			}
+		},
+		OpVERCMP: func(vm *VM, ins *instruction) error {
+			if lhs, rhs, err := vm.Pop2Kind(KindString); err != nil {
+				return err
+			} else if res, err := util.CompareVersions(lhs.Data.(string), rhs.Data.(string)); err != nil {
+				return ErrorVersion
+			} else if res == -1 {
+				return vm.Push(smallNumbers[3])
+			} else {
+				return vm.Push(smallNumbers[res])
+			}
+		},
+		OpINCIDR: func(vm *VM, ins *instruction) error {
+			addr, prefixes, err := vm.Pop2()
+			if err != nil {
+				return err
+			} else if addr.Kind != KindString {
+				return ErrorType
+			}
+
+			list := []Value{prefixes}
+			if prefixes.Kind == KindList {
+				list = prefixes.Data.([]Value)
+			}
+
+			//every prefix is checked, so that a malformed one fails for every address. Strings that are not addresses are in no network.
+			ip, res := parseAddress(addr.Data.(string)), false
+			for _, v := range list {
+				if v.Kind != KindString {
+					return ErrorType
+				}
+
+				if _, network, err := net.ParseCIDR(v.Data.(string)); err != nil {
+					return ErrorCIDR
+				} else if ip != nil && network.Contains(ip) {
+					res = true
+				}
+			}
+
+			return vm.Push(MakeValue(res))
+		},
+
+		OpLSTNEW: func(vm *VM, ins *instruction) error {
+			n := int(byte(ins.arg))
+			if vm.sp < n {
+				return ErrorUnderflow
+			}
+
+			list := make([]Value, n)
+			copy(list, vm.stack[vm.sp-n:vm.sp])
+			for i := 0; i < n; i++ {
+				vm.sp--
+				vm.stack[vm.sp] = ValueNil
+			}
+
+			return vm.pushList(list)
+		},
+		OpLSTLEN: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindList); err != nil {
+				return err
+			} else {
+				return vm.Push(MakeValue(len(v.Data.([]Value))))
+			}
+		},
+		OpLSTGET: func(vm *VM, ins *instruction) error {
+			if l, n, err := vm.Pop2Kinds(KindList, KindNumber); err != nil {
+				return err
+			} else if list, idx := l.Data.([]Value), n.Data.(float64); idx < 0 || idx >= float64(len(list)) || math.IsNaN(idx) {
+				return ErrorListIndex
+			} else {
+				return vm.Push(list[int(idx)])
+			}
+		},
+		OpLSTIN: func(vm *VM, ins *instruction) error {
+			v, l, err := vm.Pop2()
+			if err != nil {
+				return err
+			} else if l.Kind != KindList {
+				return ErrorType
+			}
+
+			for _, e := range l.Data.([]Value) {
+				if e.Equal(v) {
+					return vm.Push(MakeValue(true))
+				}
+			}
+
+			return vm.Push(MakeValue(false))
+		},
+		OpLSTAPPEND: func(vm *VM, ins *instruction) error {
+			l, v, err := vm.Pop2()
+			if err != nil {
+				return err
+			} else if l.Kind != KindList {
+				return ErrorType
 			}
+
+			//the list may be shared with constants or other stack slots
+			old := l.Data.([]Value)
+			list := make([]Value, len(old), len(old)+1)
+			copy(list, old)
+
+			return vm.pushList(append(list, v))
 		},
-		OpNSQRT:  func() error { return unaryArithHelper(func(v float64) float64 { return math.Sqrt(v) }) },
-		OpNTRUNC: func() error { return unaryArithHelper(func(v float64) float64 { return math.Trunc(v) }) },
-		OpNFLOOR: func() error { return unaryArithHelper(func(v float64) float64 { return math.Floor(v) }) },
-		OpNCEIL:  func() error { return unaryArithHelper(func(v float64) float64 { return math.Ceil(v) }) },
 
-		OpHLT: func() error {
+		OpNOW: func(vm *VM, ins *instruction) error { return vm.Push(MakeTime(vm.now())) },
+		OpTTON: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindTime); err != nil {
+				return err
+			} else {
+				t := v.Data.(time.Time)
+				return vm.Push(MakeValue(float64(t.Unix()) + float64(t.Nanosecond())/1e9))
+			}
+		},
+		OpNTOT: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindNumber); err != nil {
+				return err
+			} else if n := v.Data.(float64); math.IsNaN(n) || math.Abs(n) >= 1<<53 {
+				return ErrorArithmetic
+			} else {
+				sec := math.Floor(n)
+				return vm.Push(MakeTime(time.Unix(int64(sec), int64((n-sec)*1e9))))
+			}
+		},
+		OpDTON: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindDuration); err != nil {
+				return err
+			} else {
+				return vm.Push(MakeValue(v.Data.(time.Duration).Seconds()))
+			}
+		},
+		OpNTOD: func(vm *VM, ins *instruction) error {
+			if v, err := vm.PopKind(KindNumber); err != nil {
+				return err
+			} else if ns := v.Data.(float64) * 1e9; math.IsNaN(ns) || ns >= 1<<63 || ns < -(1<<63) {
+				return ErrorArithmetic
+			} else {
+				return vm.Push(MakeDuration(time.Duration(ns)))
+			}
+		},
+
+		OpHLT: func(vm *VM, ins *instruction) error {
 			vm.halt = true
 			return nil
 		},
-		OpJMP: func() error { return vm.JumpGeneric(index, opcode-OpJMP) },
-		OpDJMP: func() error {
+		OpNOP: func(vm *VM, ins *instruction) error { return nil },
+		OpJMP: func(vm *VM, ins *instruction) error { return vm.JumpGeneric(ins.index(), ins.opcode-OpJMP) },
+		OpDJMP: func(vm *VM, ins *instruction) error {
 			if idxVal, err := vm.PopKind(KindNumber); err != nil {
 				return err
 			} else {
-				return vm.JumpGeneric(uint32(idxVal.Data.(float64)), opcode-OpJMP)
+				return vm.JumpGeneric(uint32(idxVal.Data.(float64)), ins.opcode-OpDJMP)
 			}
 		},
-		OpDCALL: func() error {
+		OpDCALL: func(vm *VM, ins *instruction) error {
 			if target, err := vm.Pop(); err != nil {
 				return err
-			} else {
-				if target.Kind == KindNumber {
-					return vm.JumpGeneric(uint32(target.Data.(float64)), opcode-OpJMP)
-				} else if target.Kind == KindString {
-
+			} else if target.Kind == KindNumber {
+				//the verifier only follows symbols, so numeric targets elsewhere are rejected
+				if pc := uint32(target.Data.(float64)); float64(pc) != target.Data.(float64) || !vm.isSymbol(pc) {
+					return ErrorUnknownSymbol
 				} else {
-					return ErrorType
+					return vm.Call(pc)
 				}
+			} else if target.Kind == KindString {
+				if pc, ok := vm.program.Symbols[target.Data.(string)]; !ok {
+					return ErrorUnknownSymbol
+				} else {
+					return vm.Call(pc)
+				}
+			} else {
+				return ErrorType
 			}
-			return nil
 		},
-		OpRET: func() error { return vm.Return() },
+		OpRET: func(vm *VM, ins *instruction) error { return vm.Return() },
+		OpHCALL: func(vm *VM, ins *instruction) error {
+			if ins.index() >= uint32(len(vm.program.Constants)) || vm.program.Constants[ins.index()].Kind != KindString {
+				return ErrorUnknownHost
+			}
+
+			return vm.CallHost(vm.program.Constants[ins.index()].Data.(string))
+		},
 	}
 
-	opcodeHandlerAliases := map[uint8]uint8{
+	aliases := map[uint8]uint8{
 		OpNCONST_1: OpNCONST_0,
 		OpNCONST_2: OpNCONST_0,
 		OpBCONST_1: OpBCONST_0,
+		OpNSUB:     OpNADD,
 		OpNSHR:     OpNSHL,
 		OpJMPT:     OpJMP,
 		OpJMPF:     OpJMP,
@@ -339,54 +826,54 @@ func (vm *VM) SingleStep() (err error) {
 		OpLOR:      OpLTTBLB,
 		OpLXOR:     OpLTTBLB,
 		OpLNOT:     OpLTTBLU,
+		OpIOR:      OpIAND,
+		OpIXOR:     OpIAND,
+		OpISHR:     OpISHL,
+		OpITESTBIT: OpISHL,
+
+		OpSTRSUFFIX:   OpSTRPREFIX,
+		OpSTRCONTAINS: OpSTRPREFIX,
+		OpSTRFOLDEQ:   OpSTRPREFIX,
+		OpSTRGLOB:     OpSTRPREFIX,
+		OpSTRUPPER:    OpSTRLOWER,
 	}
 
-	queryOpcode := opcode
-	if alias, aliasOk := opcodeHandlerAliases[opcode]; aliasOk {
-		queryOpcode = alias
+	for opcode, handler := range handlers {
+		opcodeHandlers[opcode] = handler
 	}
-	if handler, handlerOk := opcodeHandlers[queryOpcode]; handlerOk {
-		return handler()
+	for opcode, alias := range aliases {
+		opcodeHandlers[opcode] = handlers[alias]
 	}
-	return ErrorBadOpcode
 }
 
 func (vm *VM) DumpNow() {
 	fmt.Println("---------------")
 	fmt.Printf("Halted, PC, SP: %t, %d, %d\n", vm.halt, vm.pc, vm.sp)
 	fmt.Print("Stack         : [")
-	for i := 0; i < stackSize && vm.stack[i] != ValueNil; i++ {
+	for i := 0; i < vm.sp; i++ {
 		fmt.Print(vm.stack[i], " ")
 	}
 	fmt.Print("]\n")
 
-	if vm.pc == len(vm.program.Program) {
+	if vm.pc == len(vm.code) {
 		fmt.Println("vm.pc == len(vm.program)")
 		return
-	}
-
-	var err error
-
-	var opcode byte
-	if opcode, err = vm.readByte(); err != nil {
-		fmt.Println("Error while reading opcode:", err)
+	} else if vm.pc < 0 || vm.pc > len(vm.code) {
+		fmt.Println("vm.pc is out of bounds")
 		return
 	}
 
-	fmt.Printf("Opcode        : %d (%s)\n", opcode, GetOpcodeProperties(opcode).Name)
-
-	argSize := GetOpcodeProperties(opcode).ArgSize
-	argBytes := make([]byte, argSize)
+	ins := vm.code[vm.pc]
+	fmt.Printf("Opcode        : %d (%s)\n", ins.opcode, GetOpcodeProperties(ins.opcode).Name)
 
-	vm.pc++
-	if err = vm.readBytes(argBytes, argSize); err != nil {
-		fmt.Println("Error while reading argument bytes:", err)
-		vm.pc--
+	if ins.err != nil {
+		fmt.Println("Error while decoding the instruction:", ins.err)
 		return
 	}
-	vm.pc--
 
-	if argSize != 0 {
-		fmt.Println("Argument bytes:", argBytes)
+	if argSize := GetOpcodeProperties(ins.opcode).ArgSize; argSize != 0 {
+		argBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(argBytes, ins.arg)
+		fmt.Println("Argument bytes:", argBytes[:argSize])
 	}
 }
@@ -3,11 +3,15 @@ package vm
 import (
 	"bufio"
 	"bytes"
-	"example.com/itsuMain/lib/vm/itsu_forth"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMakeIndex(t *testing.T) {
@@ -23,23 +27,19 @@ func TestMakeIndex(t *testing.T) {
 	}
 }
 
-func runVM(vm *VM) {
-	for {
-		vm.DumpNow()
-		if err := vm.SingleStep(); err != nil {
-			log.Println(err)
-			break
-		}
-	}
-}
-
 func TestTokenizeString(t *testing.T) {
 	strs := []string{
 		"test 123 \"asdasdsad asdasd\" asd\"asd asd",
+		"1 \\ comment \"a\nb ( c ) (d ( e\n f ) g\\ h\\",
+		`"a\"b\n\t\x41\x4" c\ d\q`,
+		"( unterminated \n comment",
 	}
 
 	tokens := [][]string{
 		{"test", "123", "\"asdasdsad asdasd\"", "asd\"asd", "asd"},
+		{"1", "b", "(d", "g h"},
+		{"\"a\"b\n\tAx4\"", "c dq"},
+		{},
 	}
 
 	for k, v := range strs {
@@ -57,43 +57,55 @@ func TestTokenizeString(t *testing.T) {
 	}
 }
 
-func getDefaultProgram() (b BuiltProgram, err error) {
-	builder := NewProgramBuilder()
-
-	if err = itsu_forth.CompileFORTH(builder, `
-CNAMED_const0 1 CMP >=
-CNAMED_const0 3 CMP <=
-AND
-"asdasdasd" CNAMED_const1 CMP ==
-OR
-HLT
-`); err != nil {
-		return
+func TestTokenizeStringPositions(t *testing.T) {
+	expected := []Token{
+		{"a", 1, 1},
+		{"\"b c\"", 1, 3},
+		{"dé", 2, 2},
+		{"f", 2, 5},
 	}
 
-	b = builder.Build()
-	return
-}
+	if tokens := TokenizeStringPositions("a \"b c\"\n\tdé f"); !reflect.DeepEqual(tokens, expected) {
+		t.Error("unexpected positions: ", tokens)
+	}
 
-func TestCompile(t *testing.T) {
-	var err error
-	var built BuiltProgram
+	expected = []Token{
+		{"\"\n\"", 1, 5},
+		{"x", 3, 3},
+	}
 
-	if built, err = getDefaultProgram(); err != nil {
-		t.Error(err)
-		return
+	if tokens := TokenizeStringPositions("( ) \"\\n\" \\ a\n( b\n) x"); !reflect.DeepEqual(tokens, expected) {
+		t.Error("unexpected positions: ", tokens)
 	}
+}
 
-	if linked, err := built.Link(map[string]interface{}{
-		"const0": 1.5,
-		"const1": "asdasd asd",
-	}); err != nil {
-		t.Error(err)
-		return
-	} else {
-		vm := NewVM(linked)
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		s  string
+		v  Value
+		ok bool
+	}{
+		{"1.5", MakeValue(1.5), true},
+		{"-2e3", MakeValue(-2e3), true},
+		{"0x1F", MakeValue(31), true},
+		{"-0b101", MakeValue(-5), true},
+		{"0o17", MakeValue(15), true},
+		{"0x1p4", MakeValue(16), true},
+		{"010", MakeValue(10), true},
+		{"010u", MakeInt(10), true},
+		{"0xFFFFFFFFFFFFFFFFu", MakeInt(0xFFFFFFFFFFFFFFFF), true},
+		{"0b_1000_0000u", MakeInt(128), true},
+		{"0x20000000000001", ValueNil, false},
+		{"-1u", ValueNil, false},
+		{"0x", ValueNil, false},
+		{"0b12", ValueNil, false},
+		{"abc", ValueNil, false},
+	}
 
-		runVM(vm)
+	for k, v := range tests {
+		if n, ok := ParseNumber(v.s); ok != v.ok || n != v.v {
+			t.Error("test ", k, " failed: ", n, ok)
+		}
 	}
 }
 
@@ -109,6 +121,43 @@ var valueDeserializationPairs = []valueSerializationPair{
 	{MakeValue(1), []byte{1, 0, 0, 0, 0, 0, 0, 0, 240, 63}},
 	{MakeValue("AAAAAAAA"), []byte{3, 0, 8, 0, 0, 0, 'A', 'A', 'A', 'A', 'A', 'A', 'A', 'A'}},
 	{MakeValue(nil), []byte{0, 0}},
+	{MakeInt(0x8000000000000001), []byte{4, 0, 1, 0, 0, 0, 0, 0, 0, 0x80}},
+	{MakeValue([]string{"A", "BC"}), []byte{5, 0, 2, 0, 0, 0, 3, 0, 1, 0, 0, 0, 'A', 3, 0, 2, 0, 0, 0, 'B', 'C'}},
+	{MakeList(), []byte{5, 0, 0, 0, 0, 0}},
+	{MakeTime(time.Unix(1, 5)), []byte{6, 0, 1, 0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0}},
+	{MakeDuration(-time.Nanosecond), []byte{7, 0, 255, 255, 255, 255, 255, 255, 255, 255}},
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		expected   bool
+		err        error
+	}{
+		{"build-*", "build-42", true, nil},
+		{"build-?", "build-42", false, nil},
+		{"*", "", true, nil},
+		{"*/*", "CORP/alice", true, nil},
+		{"*.example.com", "a.b/c.example.com", true, nil},
+		{"a*b*c", "aXbYbZc", true, nil},
+		{"a*b*c", "aXbYbZ", false, nil},
+		{"??", "äö", true, nil},
+		{"[a-c]x[^0-9]", "bxy", true, nil},
+		{"[a-c]x[^0-9]", "bx1", false, nil},
+		{`CORP\\*`, `CORP\alice`, true, nil},
+		{`\*`, "*", true, nil},
+		{`\*`, "a", false, nil},
+		{"[a-", "itsu", false, ErrorGlobPattern},
+		{"[]", "itsu", false, ErrorGlobPattern},
+		{"[z-a]", "itsu", false, ErrorGlobPattern},
+		{"x\\", "itsu", false, ErrorGlobPattern},
+	}
+
+	for k, v := range tests {
+		if res, err := matchGlob(v.pattern, v.s); res != v.expected || err != v.err {
+			t.Error("test ", k, " failed: ", res, ", ", err)
+		}
+	}
 }
 
 func TestValue_Serialize(t *testing.T) {
@@ -132,29 +181,1096 @@ func TestDeserializeValue(t *testing.T) {
 			t.Error(fmt.Sprint("test ", k, " failed: ", dv))
 		}
 	}
+
+	//the string claims 4 GiB, the list is nested deeper than maxValueDepth, the kind is unknown
+	nested := bytes.Repeat([]byte{byte(KindList), 0, 1, 0, 0, 0}, maxValueDepth+1)
+	badValues := []struct {
+		b   []byte
+		err error
+	}{
+		{[]byte{byte(KindString), 0, 0xFF, 0xFF, 0xFF, 0xFF, 'a'}, io.ErrUnexpectedEOF},
+		{[]byte{byte(KindList), 0, 0xFF, 0xFF, 0xFF, 0xFF}, io.EOF},
+		{nested, ErrorValueDepth},
+		{[]byte{0xFF, 0xFF}, ErrorValueKind},
+	}
+
+	for k, v := range badValues {
+		if _, err := DeserializeValue(bufio.NewReader(bytes.NewReader(v.b))); !errors.Is(err, v.err) {
+			t.Error("bad value ", k, " failed: ", err)
+		}
+	}
+}
+
+func TestVM_Run(t *testing.T) {
+	type runTest struct {
+		build  func(b *ProgramBuilder)
+		limits Limits
+		reason StopReason
+		err    error
+		top    Value
+	}
+
+	tests := []runTest{
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpNCONST_2)
+			b.EmitByte(OpNADD)
+			b.EmitByte(OpHLT)
+		}, DefaultLimits, StopHalted, nil, MakeValue(3)},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpBCONST_1)
+		}, DefaultLimits, StopEOF, nil, MakeValue(true)},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpJMP)
+			b.emitGeneric(uint32(0))
+		}, Limits{MaxSteps: 1000}, StopStepLimit, ErrorStepLimit, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("0123456789"))
+			b.EmitByte(OpSDUP)
+			b.EmitByte(OpJMP)
+			b.emitGeneric(uint32(5))
+		}, Limits{MaxStringBytes: 50}, StopMemoryLimit, ErrorMemoryLimit, MakeValue("0123456789")},
+		{func(b *ProgramBuilder) {
+			//the strings are moved to locals, the stack never holds more than one of them
+			b.EmitByte(OpCALL)
+			b.emitGeneric(uint32(5))
+			for i := uint32(0); i < 6; i++ {
+				b.EmitConst(MakeValue("0123456789"))
+				b.EmitByte(OpSTORE)
+				b.emitGeneric(i)
+			}
+		}, Limits{MaxStringBytes: 50}, StopMemoryLimit, ErrorMemoryLimit, MakeValue("0123456789")},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpBCONST_1)
+			b.EmitByte(OpNADD)
+		}, DefaultLimits, StopError, ErrorType, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(5))
+			b.EmitConst(MakeValue(3))
+			b.EmitByte(OpNSUB)
+		}, DefaultLimits, StopEOF, nil, MakeValue(2)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(true))
+			b.EmitByte(OpLNOT)
+		}, DefaultLimits, StopEOF, nil, MakeValue(false)},
+		{func(b *ProgramBuilder) {
+			//features & mask == mask, with a mask that is not representable as a float64
+			b.EmitConst(MakeInt(0xFFFFFFFFFFFFFFFF))
+			b.EmitConst(MakeInt(0x8000000000000001))
+			b.EmitByte(OpIAND)
+			b.EmitConst(MakeInt(0x8000000000000001))
+			b.EmitByte(OpCMP)
+			b.EmitByte(OpEQ)
+		}, DefaultLimits, StopEOF, nil, MakeValue(true)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeInt(0x8000000000000000))
+			b.EmitConst(MakeValue(63))
+			b.EmitByte(OpITESTBIT)
+		}, DefaultLimits, StopEOF, nil, MakeValue(true)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeInt(1))
+			b.EmitConst(MakeInt(4))
+			b.EmitByte(OpISHL)
+			b.EmitByte(OpINOT)
+			b.EmitConst(MakeInt(0xF0))
+			b.EmitByte(OpIXOR)
+			b.EmitByte(OpITON)
+		}, DefaultLimits, StopEOF, nil, MakeValue(float64(^uint64(0x10) ^ 0xF0))},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(-1))
+			b.EmitByte(OpNTOI)
+		}, DefaultLimits, StopError, ErrorArithmetic, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeInt(1))
+			b.EmitConst(MakeValue(1))
+			b.EmitByte(OpIOR)
+		}, DefaultLimits, StopError, ErrorType, ValueNil},
+		{func(b *ProgramBuilder) {
+			//doubles the string until it exceeds maxStringLength
+			b.EmitConst(MakeValue("ab"))
+			b.EmitByte(OpSDUP)
+			b.EmitByte(OpSTRCAT)
+			b.EmitByte(OpJMP)
+			b.emitGeneric(uint32(5))
+		}, Limits{}, StopError, ErrorStringLength, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("itsu"))
+			b.EmitConst(MakeValue(2))
+			b.EmitConst(MakeValue(100))
+			b.EmitByte(OpSTRSUB)
+		}, DefaultLimits, StopEOF, nil, MakeValue("su")},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("itsu"))
+			b.EmitConst(MakeValue("[a-"))
+			b.EmitByte(OpSTRGLOB)
+		}, DefaultLimits, StopError, ErrorGlobPattern, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("1.10.0"))
+			b.EmitConst(MakeValue("v1.9.3-rc.1"))
+			b.EmitByte(OpVERCMP)
+		}, DefaultLimits, StopEOF, nil, MakeValue(1)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("1.10.0"))
+			b.EmitConst(MakeValue("latest"))
+			b.EmitByte(OpVERCMP)
+		}, DefaultLimits, StopError, ErrorVersion, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("[2001:db8::1%eth0]:443"))
+			b.EmitConst(MakeValue([]string{"10.0.0.0/8", "2001:db8::/32"}))
+			b.EmitByte(OpINCIDR)
+		}, DefaultLimits, StopEOF, nil, MakeValue(true)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(""))
+			b.EmitConst(MakeValue("10.0.0.0/33"))
+			b.EmitByte(OpINCIDR)
+		}, DefaultLimits, StopError, ErrorCIDR, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("arm64"))
+			b.EmitConst(MakeValue("amd64"))
+			b.EmitConst(MakeValue("arm64"))
+			b.EmitByte(OpLSTNEW)
+			b.EmitByte(2)
+			b.EmitByte(OpLSTIN)
+		}, DefaultLimits, StopEOF, nil, MakeValue(true)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeInt(1))
+			b.EmitConst(MakeValue([]interface{}{1, "a"}))
+			b.EmitByte(OpLSTIN)
+		}, DefaultLimits, StopEOF, nil, MakeValue(false)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue([]int{4, 5}))
+			b.EmitConst(MakeValue(6))
+			b.EmitByte(OpLSTAPPEND)
+			b.EmitByte(OpSDUP)
+			b.EmitByte(OpLSTLEN)
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpNSUB)
+			b.EmitByte(OpLSTGET)
+		}, DefaultLimits, StopEOF, nil, MakeValue(6)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue([]int{4, 5}))
+			b.EmitConst(MakeValue(2))
+			b.EmitByte(OpLSTGET)
+		}, DefaultLimits, StopError, ErrorListIndex, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpLSTNEW)
+			b.EmitByte(0)
+			b.EmitByte(OpLSTNEW)
+			b.EmitByte(1)
+		}, DefaultLimits, StopError, ErrorType, ValueNil},
+		{func(b *ProgramBuilder) {
+			//appends to a list until it exceeds maxListLength
+			b.EmitByte(OpLSTNEW)
+			b.EmitByte(0)
+			b.EmitByte(OpBCONST_1)
+			b.EmitByte(OpLSTAPPEND)
+			b.EmitByte(OpJMP)
+			b.emitGeneric(uint32(2))
+		}, Limits{}, StopError, ErrorListLength, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeDuration(time.Minute))
+			b.EmitConst(MakeTime(time.Unix(100, 0)))
+			b.EmitByte(OpNADD)
+			b.EmitConst(MakeTime(time.Unix(100, 0)))
+			b.EmitByte(OpNSUB)
+		}, DefaultLimits, StopEOF, nil, MakeDuration(time.Minute)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeDuration(math.MaxInt64))
+			b.EmitConst(MakeDuration(time.Nanosecond))
+			b.EmitByte(OpNADD)
+		}, DefaultLimits, StopError, ErrorArithmetic, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeDuration(time.Minute))
+			b.EmitConst(MakeTime(time.Unix(100, 0)))
+			b.EmitByte(OpNSUB)
+		}, DefaultLimits, StopError, ErrorType, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(1.5))
+			b.EmitByte(OpNTOT)
+			b.EmitConst(MakeTime(time.Unix(1, 0)))
+			b.EmitByte(OpCMP)
+		}, DefaultLimits, StopEOF, nil, MakeValue(1)},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(math.Inf(1)))
+			b.EmitByte(OpNTOD)
+		}, DefaultLimits, StopError, ErrorArithmetic, ValueNil},
+	}
+
+	for k, v := range tests {
+		builder := NewProgramBuilder()
+		v.build(builder)
+		linked, _ := mustBuild(builder).Link(nil)
+
+		res, err := NewVM(linked).Run(context.Background(), v.limits)
+		if !errors.Is(err, v.err) || res.Reason != v.reason || !reflect.DeepEqual(res.Top, v.top) {
+			t.Error("test ", k, " failed: ", res, ", ", err)
+		}
+	}
+}
+
+func TestVM_SetClock(t *testing.T) {
+	builder := NewProgramBuilder()
+	builder.EmitByte(OpNOW)
+	builder.EmitByte(OpTTON)
+	builder.EmitByte(OpNOW)
+	builder.EmitConst(MakeValue(90))
+	builder.EmitByte(OpNTOD)
+	builder.EmitByte(OpNSUB)
+	builder.EmitByte(OpTTON)
+	builder.EmitByte(OpNSUB)
+	linked, _ := mustBuild(builder).Link(nil)
+
+	machine := NewVM(linked)
+	machine.SetClock(func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("", 7200)) })
+
+	if res, err := machine.Run(context.Background(), DefaultLimits); err != nil || !reflect.DeepEqual(res.Top, MakeValue(90)) {
+		t.Error(res, err)
+	}
+}
+
+func TestVM_RunDeadline(t *testing.T) {
+	builder := NewProgramBuilder()
+	builder.EmitByte(OpJMP)
+	builder.emitGeneric(uint32(0))
+	linked, _ := mustBuild(builder).Link(nil)
+
+	res, err := NewVM(linked).Run(context.Background(), Limits{Timeout: time.Millisecond * 10})
+	if err != context.DeadlineExceeded || res.Reason != StopDeadline || res.Steps == 0 {
+		t.Error("deadline was not enforced: ", res, ", ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if res, err = NewVM(linked).Run(ctx, Limits{}); err != context.Canceled || res.Reason != StopCancelled {
+		t.Error("cancellation was not enforced: ", res, ", ", err)
+	}
+}
+
+func TestBuiltProgram_Verify(t *testing.T) {
+	type verifyTest struct {
+		build func(b *ProgramBuilder)
+		err   error
+	}
+
+	tests := []verifyTest{
+		{func(b *ProgramBuilder) {
+			b.EmitCLoad(b.ReserveConstant("const0"))
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpCMP)
+			b.EmitByte(OpGE)
+			b.EmitByte(OpHLT)
+		}, nil},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(0xFF)
+		}, ErrorBadOpcode},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpJMP)
+			b.EmitByte(0)
+		}, ErrorVerifyTruncated},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(3.5))
+			b.EmitByte(OpJMP)
+			b.emitGeneric(uint32(1))
+		}, ErrorVerifyJumpTarget},
+		{func(b *ProgramBuilder) {
+			b.EmitCLoad(2)
+		}, ErrorVerifyConstant},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpNADD)
+		}, ErrorUnderflow},
+		{func(b *ProgramBuilder) {
+			for i := 0; i <= stackSize; i++ {
+				b.EmitByte(OpNCONST_1)
+			}
+		}, ErrorOverflow},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpJMP)
+			b.emitGeneric(uint32(0))
+		}, ErrorVerifyStackDepth},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpDJMP)
+		}, ErrorVerifyDynamicJump},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpRET)
+		}, ErrorVerifyReturn},
+		{func(b *ProgramBuilder) {
+			//0: CALL 6, 5: HLT, 6: NCONST_1, 7: RET
+			b.EmitByte(OpCALL)
+			b.emitGeneric(uint32(6))
+			b.EmitByte(OpHLT)
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpRET)
+		}, nil},
+		{func(b *ProgramBuilder) {
+			//0: NCONST_1, 1: CALL 7, 6: HLT, 7: NADD, 8: RET
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpCALL)
+			b.emitGeneric(uint32(7))
+			b.EmitByte(OpHLT)
+			b.EmitByte(OpNADD)
+			b.EmitByte(OpRET)
+		}, ErrorUnderflow},
+		{func(b *ProgramBuilder) {
+			//0: CALL 5, 5: CALL 5
+			b.EmitByte(OpCALL)
+			b.emitGeneric(uint32(5))
+			b.EmitByte(OpCALL)
+			b.emitGeneric(uint32(5))
+		}, ErrorVerifyRecursion},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpNCONST_2)
+			b.EmitByte(OpLSTNEW)
+			b.EmitByte(2)
+			b.EmitByte(OpLSTLEN)
+		}, nil},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpLSTNEW)
+			b.EmitByte(2)
+		}, ErrorUnderflow},
+	}
+
+	//0: CALL 6, 5: HLT, then n functions of which each but the last calls the next, the top level holds one frame of the call stack
+	callChain := func(n int) func(b *ProgramBuilder) {
+		return func(b *ProgramBuilder) {
+			b.EmitByte(OpCALL)
+			b.emitGeneric(uint32(6))
+			b.EmitByte(OpHLT)
+			for i := 0; i < n-1; i++ {
+				b.EmitByte(OpCALL)
+				b.emitGeneric(uint32(6 + 6*(i+1)))
+				b.EmitByte(OpRET)
+			}
+			b.EmitByte(OpRET)
+		}
+	}
+	tests = append(tests, verifyTest{callChain(callStackSize - 1), nil}, verifyTest{callChain(callStackSize), ErrorOverflow})
+
+	for k, v := range tests {
+		builder := NewProgramBuilder()
+		v.build(builder)
+
+		if err := mustBuild(builder).Verify(); !errors.Is(err, v.err) {
+			t.Error("test ", k, " failed: ", err)
+		}
+	}
+}
+
+func TestBuiltProgram_Link(t *testing.T) {
+	builder := NewProgramBuilder()
+	builder.EmitCLoad(builder.ReserveConstant("any"))
+	if idx, err := builder.ReserveTypedConstant("count", KindNumber); err != nil {
+		t.Fatal(err)
+	} else {
+		builder.EmitCLoad(idx)
+	}
+	if _, err := builder.ReserveTypedConstant("count", KindString); !errors.Is(err, ErrorConstantKind) {
+		t.Error("conflicting declaration was accepted: ", err)
+	}
+	if idx, err := builder.ReserveTypedConstant("any", KindString); err != nil || idx != 0 {
+		t.Error("declaration of an undeclared constant failed: ", err)
+	}
+	builder.EmitCLoad(builder.ReserveConstant("other"))
+	built := mustBuild(builder)
+
+	first, err := built.Link(map[string]interface{}{"any": "a", "count": 1, "other": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := built.Link(map[string]interface{}{"any": "b", "count": 2, "other": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(first.Constants, []Value{MakeValue("a"), MakeValue(1), ValueNil}) ||
+		!reflect.DeepEqual(second.Constants, []Value{MakeValue("b"), MakeValue(2), MakeValue(true)}) ||
+		!reflect.DeepEqual(built.constantPool, []Value{ValueZeroString, ValueZeroNumber, ValueNil}) {
+		t.Error("linking is not independent: ", first.Constants, second.Constants, built.constantPool)
+	}
+
+	_, err = built.Link(map[string]interface{}{"any": 1, "other": struct{}{}})
+
+	var linkErr LinkError
+	if !errors.As(err, &linkErr) || len(linkErr.Bindings) != 3 {
+		t.Fatal("expected an aggregated error: ", err)
+	}
+
+	expected := []error{ErrorBindingKind, ErrorMissingBinding, ErrorUnsupportedType}
+	for k, v := range linkErr.Bindings {
+		if !errors.Is(v, expected[k]) {
+			t.Error("binding ", k, " failed: ", v)
+		}
+	}
+
+	if !errors.Is(err, ErrorMissingBinding) || errors.Is(err, ErrorUnderflow) {
+		t.Error("LinkError.Is failed")
+	}
 }
 
 func TestBuiltProgram_Serialize(t *testing.T) {
-	var err error
-	var built BuiltProgram
+	build := func(names []string) BuiltProgram {
+		builder := NewProgramBuilder()
+		for k, v := range names {
+			builder.MarkSource(SourcePos{1, k + 1, v})
+			builder.EmitCLoad(builder.ReserveConstant(v))
+			builder.EmitByte(OpSDROP)
+		}
+		builder.AddConstant(MakeValue([]string{"a", "b"}))
+		_ = builder.DefineSymbol("fn")
+		builder.EmitByte(OpRET)
+		_ = builder.DefineSymbol("alt")
+		return mustBuild(builder)
+	}
+
+	built := build([]string{"a", "b", "c", "d", "e", "f"})
+
+	first, err := built.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8; i++ {
+		if again, _ := built.Serialize(); !bytes.Equal(first, again) {
+			t.Fatal("serialization is not deterministic")
+		}
+	}
+
+	//the indices of the names differ, so the digests must too
+	d0, _ := built.Digest()
+	d1, _ := build([]string{"f", "e", "d", "c", "b", "a"}).Digest()
+	if d0 == d1 {
+		t.Error("different programs have the same digest")
+	}
+
+	if deserialized, err := DeserializeBuiltProgram(bufio.NewReader(bytes.NewReader(first))); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(built, deserialized) {
+		t.Error("round trip failed: ", deserialized)
+	}
+
+	corrupt := func(offset int, b byte) []byte {
+		c := append([]byte{}, first...)
+		c[offset] = b
+		return c
+	}
+
+	//header writes the start of a container whose section table has the lengths, without any section bodies
+	header := func(lengths ...uint32) []byte {
+		buffer := bytes.Buffer{}
+		buffer.Write(containerMagic[:])
+		_ = binary.Write(&buffer, binary.LittleEndian, uint16(containerVersion))
+		_ = binary.Write(&buffer, binary.LittleEndian, uint16(len(lengths)))
+		for k, v := range lengths {
+			_ = binary.Write(&buffer, binary.LittleEndian, uint16(k+1))
+			_ = binary.Write(&buffer, binary.LittleEndian, v)
+		}
+		return buffer.Bytes()
+	}
+
+	badContainers := []struct {
+		data []byte
+		err  error
+	}{
+		{corrupt(0, 'X'), ErrorContainerMagic},
+		{corrupt(4, 2), ErrorContainerVersion},
+		{corrupt(len(first)-8, first[len(first)-8]^1), ErrorContainerChecksum},
+		{corrupt(len(first)-1, first[len(first)-1]^1), ErrorContainerChecksum},
+		{first[:len(first)-2], io.ErrUnexpectedEOF},
+		{header(maxSectionLength), io.ErrUnexpectedEOF},
+		{header(maxSectionLength + 1), ErrorContainerSection},
+		{header(maxSectionLength, maxSectionLength), ErrorContainerLength},
+		{header(0xFFFF, 0xFFFF, 0xFFFF), io.ErrUnexpectedEOF},
+	}
+
+	for k, v := range badContainers {
+		if _, err := DeserializeBuiltProgram(bufio.NewReader(bytes.NewReader(v.data))); !errors.Is(err, v.err) {
+			t.Error("bad container ", k, " failed: ", err)
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	builder := NewProgramBuilder()
+	builder.MarkSource(SourcePos{1, 1, "CNAMED_const0"})
+	builder.EmitCLoad(builder.ReserveConstant("const0"))
+	builder.MarkSource(SourcePos{2, 4, "\"semi;colon\" x"})
+	builder.EmitConst(MakeValue(1.25))
+	builder.EmitByte(OpCMP)
+	builder.EmitByte(OpGE)
+	builder.EmitByte(OpJMPF)
+	builder.emitGeneric(uint32(29))
+	builder.EmitConst(MakeValue("semi;colon \"quoted\""))
+	builder.EmitConst(MakeValue(math.Float64frombits(0x7FF8000000000001)))
+	builder.EmitByte(OpLTTBLB)
+	builder.EmitByte(byte(0b1110))
+	builder.EmitConst(MakeInt(0xDEADBEEF))
+	builder.AddConstant(MakeInt(1 << 63))
+	builder.AddConstant(MakeList(MakeValue("a, b]"), MakeList(MakeInt(1), ValueNil), MakeList()))
+	builder.AddConstant(MakeList(MakeTime(time.Unix(1, 5)), MakeDuration(-90*time.Minute)))
+	builder.EmitByte(OpHLT)
+	_ = builder.DefineSymbol("fn")
+	builder.EmitByte(OpCALL)
+	builder.emitGeneric(uint32(40))
+	builder.EmitByte(OpLSTNEW)
+	builder.EmitByte(2)
+	builder.AddConstant(MakeValue(false))
+	builder.EmitByte(0xFF)
+	builder.EmitByte(OpJMP)
+	built := mustBuild(builder)
+
+	listing := built.Disassemble()
+	if reassembled, err := Assemble(listing); err != nil {
+		t.Error(err, "\n", listing)
+	} else if !reflect.DeepEqual(built, reassembled) {
+		t.Error("round trip failed:\n", listing, "\n", reassembled.Disassemble())
+	}
+
+	handWritten := `
+.const 0 nil
+.name x 0
+start:
+	CLOAD 0 ; x
+	ISNIL
+	JMPT end
+	SDROP
+	SDROP
+	JMP start
+end:
+	HLT
+`
+	if b, err := Assemble(handWritten); err != nil {
+		t.Error(err)
+	} else if err = b.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	badListings := []string{
+		"FOO",
+		"JMP nowhere",
+		"0001: HLT",
+		".const 1 num 1",
+		"NCONST",
+		"x:\nx:",
+		".const 0 list [num 1",
+		".const 0 list [num 1 num 2]",
+		".source 1 1 1 \"a\"\n.source 1 1 2 \"b\"",
+		".source 0 1 1 b",
+	}
 
-	if built, err = getDefaultProgram(); err != nil {
+	for k, v := range badListings {
+		if _, err := Assemble(v); err == nil {
+			t.Error("bad listing ", k, " was assembled")
+		}
+	}
+}
+
+func TestVM_Call(t *testing.T) {
+	builder := NewProgramBuilder()
+	builder.EmitConst(MakeValue(3))
+	builder.EmitConst(MakeValue(2))
+	builder.EmitStore(0)
+	builder.EmitConst(MakeValue("square"))
+	builder.EmitByte(OpDCALL)
+	builder.EmitLoad(0)
+	builder.EmitByte(OpNADD)
+	builder.EmitByte(OpHLT)
+	if err := builder.DefineSymbol("square"); err != nil {
+		t.Fatal(err)
+	}
+	builder.EmitStore(0)
+	builder.EmitLoad(0)
+	builder.EmitLoad(0)
+	builder.EmitByte(OpNMUL)
+	builder.EmitByte(OpRET)
+	if err := builder.DefineSymbol("square"); err != ErrorDuplicateSymbol {
+		t.Error("duplicate symbol was defined: ", err)
+	}
+
+	built := mustBuild(builder)
+	if err := built.Verify(); err != nil {
 		t.Error(err)
-		return
 	}
 
-	var built2 BuiltProgram
-	var serialized []byte
+	linked, _ := built.Link(nil)
+	if res, err := NewVM(linked).Run(context.Background(), DefaultLimits); err != nil || !reflect.DeepEqual(res.Top, MakeValue(11)) {
+		t.Error("call failed: ", res, ", ", err)
+	}
+
+	failing := []struct {
+		build func(b *ProgramBuilder)
+		err   error
+	}{
+		{func(b *ProgramBuilder) { b.EmitByte(OpRET) }, ErrorUnderflow},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("missing"))
+			b.EmitByte(OpDCALL)
+		}, ErrorUnknownSymbol},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(3))
+			b.EmitByte(OpDCALL)
+			b.EmitByte(OpHLT)
+			_ = b.DefineSymbol("fn")
+			b.EmitByte(OpRET)
+		}, ErrorUnknownSymbol},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpCALL)
+			b.emitGeneric(uint32(0))
+		}, ErrorOverflow},
+	}
+
+	for k, v := range failing {
+		builder := NewProgramBuilder()
+		v.build(builder)
+		linked, _ := mustBuild(builder).Link(nil)
+
+		if _, err := NewVM(linked).Run(context.Background(), DefaultLimits); !errors.Is(err, v.err) {
+			t.Error("test ", k, " failed: ", err)
+		}
+	}
+
+	//numeric targets are accepted at symbols
+	builder = NewProgramBuilder()
+	builder.EmitConst(MakeValue(11))
+	builder.EmitByte(OpDCALL)
+	builder.EmitByte(OpHLT)
+	_ = builder.DefineSymbol("fn")
+	builder.EmitByte(OpNCONST_2)
+	builder.EmitByte(OpRET)
+	linked, _ = mustBuild(builder).Link(nil)
+	if res, err := NewVM(linked).Run(context.Background(), DefaultLimits); err != nil || !reflect.DeepEqual(res.Top, MakeValue(2)) {
+		t.Error("call by pc failed: ", res, ", ", err)
+	}
+}
+
+func TestVM_CallHost(t *testing.T) {
+	concat := HostFunction{
+		Name:    "concat",
+		Args:    []Kind{KindString, KindAny},
+		Returns: []Kind{KindString},
+		Fn: func(args []Value) ([]Value, error) {
+			return []Value{MakeValue(args[0].Data.(string) + fmt.Sprint(args[1].Data))}, nil
+		},
+	}
+	broken := HostFunction{
+		Name:    "broken",
+		Returns: []Kind{KindBool},
+		Fn:      func(args []Value) ([]Value, error) { return []Value{MakeValue(1)}, nil },
+	}
+	panicking := HostFunction{
+		Name: "panicking",
+		Fn:   func(args []Value) ([]Value, error) { panic("oh no") },
+	}
+
+	tests := []struct {
+		build func(b *ProgramBuilder)
+		err   error
+		top   Value
+	}{
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("a"))
+			b.EmitConst(MakeValue(true))
+			b.EmitHostCall("concat")
+		}, nil, MakeValue("atrue")},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue("a"))
+			b.EmitHostCall("concat")
+		}, ErrorHostArity, ValueNil},
+		{func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(1))
+			b.EmitConst(MakeValue(1))
+			b.EmitHostCall("concat")
+		}, ErrorType, ValueNil},
+		{func(b *ProgramBuilder) { b.EmitHostCall("broken") }, ErrorHostReturn, ValueNil},
+		{func(b *ProgramBuilder) { b.EmitHostCall("panicking") }, ErrorHostPanic, ValueNil},
+		{func(b *ProgramBuilder) { b.EmitHostCall("missing") }, ErrorUnknownHost, ValueNil},
+	}
+
+	for k, v := range tests {
+		builder := NewProgramBuilder()
+		v.build(builder)
+		built := mustBuild(builder)
+
+		linked, _ := built.Link(nil, concat, broken)
+		machine := NewVM(linked)
+		machine.RegisterHostFunction(panicking)
+
+		if res, err := machine.Run(context.Background(), DefaultLimits); !errors.Is(err, v.err) || (err == nil && !reflect.DeepEqual(res.Top, v.top)) {
+			t.Error("test ", k, " failed: ", res, ", ", err)
+		}
+	}
+
+	builder := NewProgramBuilder()
+	builder.EmitConst(MakeValue("a"))
+	builder.EmitHostCall("concat")
+	if err := mustBuild(builder).Verify(concat); !errors.Is(err, ErrorUnderflow) {
+		t.Error("verifier accepted a call with too few arguments: ", err)
+	}
+	builder.EmitHostCall("missing")
+	if err := mustBuild(builder).Verify(concat); !errors.Is(err, ErrorVerifyHost) {
+		t.Error("verifier accepted an unknown host function: ", err)
+	}
+}
+
+func TestOpcodeHandlers(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		if props := GetOpcodeProperties(byte(i)); !props.Bad() && opcodeHandlers[i] == nil {
+			t.Error("opcode ", props.Name, " has no handler")
+		}
+	}
+}
+
+//countdownProgram decrements a local from n to zero
+func countdownProgram(n float64) BuiltProgram {
+	builder := NewProgramBuilder()
+	builder.EmitConst(MakeValue(n))
+	builder.EmitStore(0)
+	builder.EmitByte(OpBCONST_1)
+	loop := builder.NewLabel()
+	_ = builder.MarkLabel(loop)
+	builder.EmitByte(OpSDROP)
+	builder.EmitLoad(0)
+	builder.EmitByte(OpNCONST_1)
+	builder.EmitByte(OpNSUB)
+	builder.EmitByte(OpSDUP)
+	builder.EmitStore(0)
+	builder.EmitByte(OpNCONST_0)
+	builder.EmitByte(OpCMP)
+	builder.EmitByte(OpGT)
+	builder.EmitJump(OpJMPT, loop)
+	builder.EmitByte(OpSDROP)
+	builder.EmitByte(OpHLT)
+
+	return mustBuild(builder)
+}
+
+//mustBuild builds programs that do not use labels or mark all of them
+func mustBuild(builder *ProgramBuilder) BuiltProgram {
+	built, err := builder.Build()
+	if err != nil {
+		panic(err)
+	}
+
+	return built
+}
+
+func TestProgramBuilder_Labels(t *testing.T) {
+	builder := NewProgramBuilder()
+	skip, back, done, unused := builder.NewLabel(), builder.NewLabel(), builder.NewLabel(), builder.NewLabel()
+	_ = unused
+
+	//a forward jump over a HLT, then a loop that counts to 2 and leaves through another forward jump
+	builder.EmitByte(OpNCONST_0)
+	builder.EmitStore(0)
+	builder.EmitJump(OpJMP, skip)
+	builder.EmitByte(OpHLT)
+	_ = builder.MarkLabel(skip)
+	_ = builder.MarkLabel(back)
+	builder.EmitLoad(0)
+	builder.EmitByte(OpNCONST_1)
+	builder.EmitByte(OpNADD)
+	builder.EmitByte(OpSDUP)
+	builder.EmitStore(0)
+	builder.EmitByte(OpNCONST_2)
+	builder.EmitByte(OpCMP)
+	builder.EmitByte(OpLT)
+	builder.EmitJump(OpJMPF, done)
+	builder.EmitByte(OpSDROP)
+	builder.EmitJump(OpJMP, back)
+	_ = builder.MarkLabel(done)
+	builder.EmitByte(OpSDROP)
+	builder.EmitLoad(0)
+	builder.EmitByte(OpHLT)
+
+	if err := builder.MarkLabel(back); !errors.Is(err, ErrorLabelMarked) {
+		t.Error("label was marked twice: ", err)
+	}
+	if err := builder.MarkLabel(Label(100)); !errors.Is(err, ErrorLabelUnmarked) {
+		t.Error("foreign label was marked: ", err)
+	}
+
+	built := mustBuild(builder)
+	if err := built.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	linked, _ := built.Link(nil)
+	if res, err := NewVM(linked).Run(context.Background(), DefaultLimits); err != nil || res.Reason != StopHalted || res.Top != MakeValue(2) {
+		t.Error("unexpected result: ", res, err)
+	}
 
-	if serialized, err = built.Serialize(); err != nil {
-		return
+	builder.EmitJump(OpJMP, builder.NewLabel())
+	if _, err := builder.Build(); !errors.Is(err, ErrorLabelUnmarked) {
+		t.Error("unmarked label was built: ", err)
 	}
+}
 
-	if built2, err = DeserializeBuiltProgram(bufio.NewReader(bytes.NewReader(serialized))); err != nil {
-		return
+func BenchmarkVM_Run(b *testing.B) {
+	linked, err := countdownProgram(1000).Link(nil)
+	if err != nil {
+		b.Fatal(err)
 	}
 
-	if !reflect.DeepEqual(built, built2) {
-		t.Error("")
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := NewVM(linked).Run(context.Background(), Limits{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//BenchmarkVM_Condition links and runs a small condition program the way the server does for every agent
+func BenchmarkVM_Condition(b *testing.B) {
+	builder := NewProgramBuilder()
+	builder.EmitCLoad(builder.ReserveConstant("RTCPU"))
+	builder.EmitByte(OpNCONST_1)
+	builder.EmitByte(OpCMP)
+	builder.EmitByte(OpGE)
+	builder.EmitCLoad(builder.ReserveConstant("RTCPU"))
+	builder.EmitConst(MakeValue(3))
+	builder.EmitByte(OpCMP)
+	builder.EmitByte(OpLE)
+	builder.EmitByte(OpLAND)
+	builder.EmitCLoad(builder.ReserveConstant("Hostname"))
+	builder.EmitConst(MakeValue("build-*"))
+	builder.EmitByte(OpSTRGLOB)
+	builder.EmitByte(OpLOR)
+	builder.EmitByte(OpHLT)
+	built := mustBuild(builder)
+
+	bindings := map[string]interface{}{"RTCPU": 4, "Hostname": "build-42"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		linked, err := built.Link(bindings)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if res, err := NewVM(linked).Run(context.Background(), DefaultLimits); err != nil || res.Top != MakeValue(true) {
+			b.Fatal(res, err)
+		}
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	builder := NewProgramBuilder()
+	builder.MarkSource(SourcePos{1, 1, "1"})
+	builder.EmitByte(OpNCONST_1)
+	builder.MarkSource(SourcePos{2, 1, "fn"})
+	builder.EmitByte(OpCALL)
+	builder.emitGeneric(uint32(7))
+	builder.MarkSource(SourcePos{3, 1, "HLT"})
+	builder.EmitByte(OpHLT)
+	builder.MarkSource(SourcePos{4, 1, "DUP"})
+	builder.EmitByte(OpSDUP)
+	builder.EmitStore(0)
+	builder.MarkSource(SourcePos{5, 1, "+"})
+	builder.EmitLoad(0)
+	builder.EmitByte(OpNADD)
+	builder.EmitByte(OpRET)
+	linked, _ := mustBuild(builder).Link(nil)
+
+	d := NewDebugger(NewVM(linked), DefaultLimits)
+	if pc, err := d.SetLineBreakpoint(4); err != nil || pc != 7 {
+		t.Fatal("line breakpoint was not resolved: ", pc, err)
+	}
+	if _, err := d.SetLineBreakpoint(9); err != ErrorNoCodeAtLine {
+		t.Error("breakpoint was set on an empty line: ", err)
+	}
+
+	if res, err := d.Continue(context.Background()); err != nil || res.Reason != StopPaused {
+		t.Fatal("breakpoint was not reached: ", res, err)
+	}
+	breakpoint := d.Snapshot()
+	if s := breakpoint; s.PC != 7 || s.Opcode != OpSDUP || s.Pos.Line != 4 || len(s.Frames) != 2 || s.Frames[1].ReturnPC != 6 {
+		t.Error("unexpected snapshot at the breakpoint: ", s)
+	}
+
+	d.Step(context.Background())
+	d.Step(context.Background())
+	if s := d.Snapshot(); s.PC != 13 || !reflect.DeepEqual(s.Stack, []Value{MakeValue(1)}) || !reflect.DeepEqual(s.Frames[1].Locals, map[uint32]Value{0: MakeValue(1)}) {
+		t.Error("unexpected snapshot after stepping: ", s)
+	}
+
+	if res, err := d.Continue(context.Background()); err != nil || res.Reason != StopHalted || res.Top != MakeValue(2) {
+		t.Error("program did not run to the end: ", res, err)
+	}
+
+	d.vm.Restore(breakpoint)
+	if s := d.Snapshot(); !reflect.DeepEqual(s, breakpoint) {
+		t.Error("snapshot was not restored: ", s)
+	}
+
+	d = NewDebugger(NewVM(linked), DefaultLimits)
+	d.Step(context.Background())
+	if res, err := d.StepOver(context.Background()); err != nil || res.Reason != StopPaused || res.Steps != 6 {
+		t.Error("call was not stepped over: ", res, err)
+	}
+	if s := d.Snapshot(); s.PC != 6 || len(s.Frames) != 1 || !reflect.DeepEqual(s.Stack, []Value{MakeValue(2)}) {
+		t.Error("unexpected snapshot after stepping over: ", s)
+	}
+
+	d = NewDebugger(NewVM(linked), DefaultLimits)
+	d.SetBreakpoint(13)
+	d.Step(context.Background())
+	if _, err := d.StepOver(context.Background()); err != nil || d.Snapshot().PC != 13 {
+		t.Error("breakpoint within the callee was not reached: ", d.Snapshot().PC, err)
+	}
+}
+
+func TestBuiltProgram_Optimize(t *testing.T) {
+	tests := []struct {
+		build    func(b *ProgramBuilder)
+		expected func(b *ProgramBuilder)
+	}{
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpNCONST_2)
+			b.EmitByte(OpNADD)
+			b.EmitByte(OpHLT)
+		}, func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(3))
+			b.EmitByte(OpHLT)
+		}},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_0)
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpNSUB)
+			b.EmitByte(OpNCONST_0)
+			b.EmitByte(OpNMUL)
+		}, func(b *ProgramBuilder) {
+			b.EmitConst(MakeValue(math.Copysign(0, -1)))
+		}},
+		{func(b *ProgramBuilder) {
+			b.EmitCLoad(b.ReserveConstant("x"))
+			b.EmitConst(MakeValue("ab"))
+			b.EmitByte(OpCMP)
+			b.EmitByte(OpEQ)
+			b.EmitCLoad(b.ReserveConstant("x"))
+			b.EmitConst(MakeValue("a"))
+			b.EmitConst(MakeValue("b"))
+			b.EmitByte(OpSTRCAT)
+			b.EmitByte(OpCMP)
+			b.EmitByte(OpEQ)
+			b.EmitByte(OpLNOT)
+			b.EmitByte(OpLNOT)
+			b.EmitByte(OpLAND)
+		}, func(b *ProgramBuilder) {
+			b.EmitCLoad(b.ReserveConstant("x"))
+			b.EmitConst(MakeValue("ab"))
+			b.EmitByte(OpCMP)
+			b.EmitByte(OpEQ)
+			b.EmitCLoad(b.ReserveConstant("x"))
+			b.EmitCLoad(1)
+			b.EmitByte(OpCMP)
+			b.EmitByte(OpEQ)
+			b.EmitByte(OpLAND)
+		}},
+		{func(b *ProgramBuilder) {
+			b.MarkSource(SourcePos{1, 1, "T"})
+			b.EmitByte(OpBCONST_1)
+			b.MarkSource(SourcePos{1, 3, "NOT"})
+			b.EmitByte(OpLNOT)
+			b.EmitByte(OpLNOT)
+			b.EmitByte(OpJMPT)
+			b.emitGeneric(uint32(18))
+			b.EmitByte(OpNOP)
+			b.MarkSource(SourcePos{2, 1, "2"})
+			b.EmitByte(OpNCONST_2)
+			b.EmitByte(OpSDUP)
+			b.EmitByte(OpSDROP)
+			b.EmitByte(OpHLT)
+			b.EmitCLoad(b.ReserveConstant("y"))
+			b.MarkSource(SourcePos{3, 1, "1"})
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpSSWAP)
+			b.EmitByte(OpSSWAP)
+			b.EmitByte(OpHLT)
+			_ = b.DefineSymbol("fn")
+			b.EmitByte(OpRET)
+		}, func(b *ProgramBuilder) {
+			b.ReserveConstant("y")
+			b.MarkSource(SourcePos{1, 1, "T"})
+			b.EmitByte(OpBCONST_1)
+			b.MarkSource(SourcePos{1, 3, "NOT"})
+			b.EmitByte(OpJMPT)
+			b.emitGeneric(uint32(8))
+			b.MarkSource(SourcePos{2, 1, "2"})
+			b.EmitByte(OpNCONST_2)
+			b.EmitByte(OpHLT)
+			b.MarkSource(SourcePos{3, 1, "1"})
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpHLT)
+			_ = b.DefineSymbol("fn")
+			b.EmitByte(OpRET)
+		}},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNILCONST)
+			b.EmitByte(OpSDUP)
+		}, func(b *ProgramBuilder) {
+			b.EmitByte(OpNILCONST)
+			b.EmitByte(OpNILCONST)
+		}},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNILCONST)
+			b.EmitByte(OpISNIL)
+		}, func(b *ProgramBuilder) {
+			b.EmitByte(OpNILCONST)
+			b.EmitByte(OpBCONST_1)
+		}},
+		{func(b *ProgramBuilder) {
+			b.EmitByte(OpNCONST_1)
+			b.EmitByte(OpNILCONST)
+			b.EmitByte(OpSSWAP)
+			b.EmitByte(OpSDROP)
+			b.EmitByte(OpISNIL)
+		}, func(b *ProgramBuilder) {
+			b.EmitByte(OpNILCONST)
+			b.EmitByte(OpBCONST_1)
+		}},
+	}
+
+	for k, v := range tests {
+		builder, expectedBuilder := NewProgramBuilder(), NewProgramBuilder()
+		v.build(builder)
+		v.expected(expectedBuilder)
+		built, expected := mustBuild(builder), mustBuild(expectedBuilder)
+
+		optimized, err := built.Optimize()
+		if err != nil {
+			t.Error("test ", k, " failed: ", err)
+			continue
+		}
+
+		if !reflect.DeepEqual(optimized, expected) {
+			t.Error("test ", k, " failed:\n", optimized.Disassemble(), "\n", expected.Disassemble())
+		}
+
+		run := func(program BuiltProgram) Value {
+			linked, _ := program.Link(map[string]interface{}{"x": "ab", "y": 0})
+			res, _ := NewVM(linked).Run(context.Background(), DefaultLimits)
+			return res.Top
+		}
+
+		if before, after := run(built), run(optimized); !reflect.DeepEqual(before, after) {
+			t.Error("test ", k, " changed the result: ", before, " != ", after)
+		}
+	}
+
+	builder := NewProgramBuilder()
+	builder.EmitByte(OpNCONST_0)
+	builder.EmitByte(OpDJMP)
+	if _, err := mustBuild(builder).Optimize(); !errors.Is(err, ErrorOptimizeDynamicJump) {
+		t.Error("dynamic jump was optimized: ", err)
 	}
 }
@@ -1,63 +1,64 @@
 package vm
 
-func (vm *VM) readByte() (byte, error) {
-	if vm.pc == len(vm.program.Program) {
-		return 0, ErrorBadEOF
+import (
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+func (vm *VM) Push(a Value) error {
+	if vm.sp == stackSize {
+		return ErrorOverflow
 	}
 
-	b := vm.program.Program[vm.pc]
-	return b, nil
+	vm.stack[vm.sp] = a
+	vm.sp++
+	return nil
 }
 
-func (vm *VM) readBytes(buf []byte, n int) error {
-	if vm.pc+n > len(vm.program.Program) {
-		return ErrorBadEOF
-	}
-
-	for i := 0; i < n; i++ {
-		buf[i] = vm.program.Program[vm.pc+i]
+//pushString pushes a string produced by an instruction, failing if it is longer than maxStringLength
+func (vm *VM) pushString(s string) error {
+	if len(s) > maxStringLength {
+		return ErrorStringLength
 	}
 
-	return nil
+	return vm.Push(MakeValue(s))
 }
 
-func (vm *VM) readInstruction() (opcode byte, argBytes []byte, err error) {
-	if opcode, err = vm.readByte(); err != nil {
-		return
+//pushList pushes a list produced by an instruction, failing if it is longer than maxListLength.
+//Lists produced by instructions may not contain other lists so that their size stays bounded.
+func (vm *VM) pushList(list []Value) error {
+	if len(list) > maxListLength {
+		return ErrorListLength
 	}
 
-	props := GetOpcodeProperties(opcode)
-	if props.Bad() {
-		err = ErrorBadOpcode
-		return
-	}
-	vm.pc += 1
-
-	argBytes = make([]byte, props.ArgSize)
-	if err = vm.readBytes(argBytes, props.ArgSize); err != nil {
-		return
+	for _, v := range list {
+		if v.Kind == KindList {
+			return ErrorType
+		}
 	}
-	vm.pc += props.ArgSize
 
-	return
+	return vm.Push(Value{Data: list, Kind: KindList})
 }
 
-func (vm *VM) Push(a Value) error { return genericPush(&vm.stack, &vm.sp, a) }
-
 func (vm *VM) Top() (Value, error) {
-	if v, err := genericTop(vm.stack, vm.sp); err != nil {
+	if vm.sp == 0 {
 		return ValueNil, ErrorUnderflow
-	} else {
-		return v.(Value), nil
 	}
+
+	return vm.stack[vm.sp-1], nil
 }
 
 func (vm *VM) Pop() (Value, error) {
-	if v, err := genericPop(&vm.stack, &vm.sp); err != nil {
+	if vm.sp == 0 {
 		return ValueNil, ErrorUnderflow
-	} else {
-		return v.(Value), nil
 	}
+
+	vm.sp--
+	v := vm.stack[vm.sp]
+	vm.stack[vm.sp] = ValueNil
+	return v, nil
 }
 
 func (vm *VM) PopKind(kind Kind) (v Value, err error) {
@@ -70,11 +71,11 @@ func (vm *VM) PopKind(kind Kind) (v Value, err error) {
 
 //Pop2 returns the second and the first element on the stack in order
 func (vm *VM) Pop2() (lhs, rhs Value, err error) {
-	if lhs, err = vm.Pop(); err != nil {
+	if rhs, err = vm.Pop(); err != nil {
 		return
 	}
 
-	if rhs, err = vm.Pop(); err != nil {
+	if lhs, err = vm.Pop(); err != nil {
 		return
 	}
 
@@ -99,26 +100,65 @@ func (vm *VM) Goto(index uint32) {
 	vm.pc = int(index)
 }
 
+//Resume replaces the program of the VM and continues at pc, so that a VM that ran the beginning of a program can run code that was appended to it.
+//The stack and the locals of the top level are kept, the call stack is unwound and a halted VM is no longer halted.
+func (vm *VM) Resume(program Program, pc int) {
+	vm.program = program
+	vm.code = decodeInstructions(program.Program)
+
+	for vm.csp > 1 {
+		vm.csp--
+		vm.callStack[vm.csp] = callFrame{}
+	}
+
+	vm.pc = pc
+	vm.halt = false
+}
+
+//SetClock sets the function that NOW reads the time from, nil restores time.Now
+func (vm *VM) SetClock(clock func() time.Time) { vm.clock = clock }
+
+func (vm *VM) now() time.Time {
+	if vm.clock != nil {
+		return vm.clock()
+	}
+
+	return time.Now()
+}
+
+//isSymbol reports whether pc is the start of a symbol, the only numeric targets that DCALL accepts
+func (vm *VM) isSymbol(pc uint32) bool {
+	for _, v := range vm.program.Symbols {
+		if v == pc {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (vm *VM) Call(pc uint32) error {
-	if err := genericPush(&vm.callStack, &vm.csp, callFrame{
-		rp:   vm.pc,
-		vars: make(map[uint32]Value),
-	}); err != nil {
-		return err
+	if vm.csp == callStackSize {
+		return ErrorOverflow
 	}
 
+	vm.callStack[vm.csp] = callFrame{rp: vm.pc}
+	vm.csp++
+
 	vm.pc = int(pc)
 	return nil
 }
 
+//Return resumes the caller of the current function, returning from the top level is an underflow
 func (vm *VM) Return() error {
-	if cfEFace, err := genericPop(&vm.callStack, &vm.csp); err != nil {
-		return err
-	} else {
-		cf := cfEFace.(callFrame)
-		vm.sp = cf.rp
-		return nil
+	if vm.csp <= 1 {
+		return ErrorUnderflow
 	}
+
+	vm.csp--
+	vm.pc = vm.callStack[vm.csp].rp
+	vm.callStack[vm.csp] = callFrame{}
+	return nil
 }
 
 func (vm *VM) StoreVariable(idx uint32, val Value) error {
@@ -126,12 +166,17 @@ func (vm *VM) StoreVariable(idx uint32, val Value) error {
 		return ErrorUnderflow
 	}
 
-	vm.callStack[vm.csp-1].vars[idx] = val
+	cf := &vm.callStack[vm.csp-1]
+	if cf.vars == nil {
+		cf.vars = make(map[uint32]Value)
+	}
+
+	cf.vars[idx] = val
 	return nil
 }
 
 func (vm *VM) LoadVariable(idx uint32) error {
-	if vm.csp >= callStackSize {
+	if vm.csp < 1 {
 		return ErrorUnderflow
 	}
 
@@ -143,10 +188,6 @@ func (vm *VM) LoadVariable(idx uint32) error {
 }
 
 func (vm *VM) LoadConstant(idx uint32) error {
-	if vm.csp >= stackSize {
-		return ErrorUnderflow
-	}
-
 	if idx >= uint32(len(vm.program.Constants)) {
 		return vm.Push(ValueNil)
 	} else {
@@ -187,3 +228,156 @@ func (vm *VM) JumpGeneric(to uint32, typ uint8) (err error) {
 
 	return
 }
+
+//parseAddress parses an IP address that may carry a port or a zone, the result is nil if s is not an address
+func parseAddress(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+
+	if idx := strings.Index(s, "%"); idx != -1 {
+		s = s[:idx]
+	}
+
+	return net.ParseIP(s)
+}
+
+//bitIndex converts a shift amount or a bit index to an unsigned integer, both numbers and ints are accepted
+func bitIndex(v Value) (uint64, error) {
+	switch v.Kind {
+	case KindInt:
+		return v.Data.(uint64), nil
+	case KindNumber:
+		if n := v.Data.(float64); n < 0 || math.IsNaN(n) {
+			return 0, ErrorArithmetic
+		} else {
+			return uint64(n), nil
+		}
+	default:
+		return 0, ErrorType
+	}
+}
+
+//globAtom is one element of a glob pattern, a literal rune unless star, any or class is set
+type globAtom struct {
+	star, any, class bool
+	negated          bool
+	ranges           [][2]rune
+	literal          rune
+}
+
+func (a globAtom) matches(c rune) bool {
+	switch {
+	case a.any:
+		return true
+	case a.class:
+		for _, r := range a.ranges {
+			if r[0] <= c && c <= r[1] {
+				return !a.negated
+			}
+		}
+		return a.negated
+	default:
+		return a.literal == c
+	}
+}
+
+//classRune reads the rune of a character class at i, which may be escaped, and returns the index after it
+func classRune(p []rune, i int) (rune, int, error) {
+	if i < len(p) && p[i] == '\\' {
+		i++
+	}
+	if i >= len(p) || p[i] == ']' {
+		return 0, i, ErrorGlobPattern
+	}
+
+	return p[i], i + 1, nil
+}
+
+//parseGlob splits a glob pattern into atoms: "*" matches any string, separators included, "?" any rune, "[...]" a class of runes that is negated by a leading "^" and "\" escapes the next rune
+func parseGlob(pattern string) ([]globAtom, error) {
+	p := []rune(pattern)
+	atoms := make([]globAtom, 0, len(p))
+
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '*':
+			atoms = append(atoms, globAtom{star: true})
+		case '?':
+			atoms = append(atoms, globAtom{any: true})
+		case '\\':
+			if i++; i == len(p) {
+				return nil, ErrorGlobPattern
+			}
+			atoms = append(atoms, globAtom{literal: p[i]})
+		case '[':
+			a := globAtom{class: true}
+			if i++; i < len(p) && p[i] == '^' {
+				a.negated = true
+				i++
+			}
+
+			for i < len(p) && p[i] != ']' {
+				lo, next, err := classRune(p, i)
+				if err != nil {
+					return nil, err
+				}
+
+				hi := lo
+				if next < len(p) && p[next] == '-' {
+					if hi, next, err = classRune(p, next+1); err != nil {
+						return nil, err
+					} else if hi < lo {
+						return nil, ErrorGlobPattern
+					}
+				}
+
+				a.ranges = append(a.ranges, [2]rune{lo, hi})
+				i = next
+			}
+
+			if i == len(p) || len(a.ranges) == 0 {
+				return nil, ErrorGlobPattern
+			}
+			atoms = append(atoms, a)
+		default:
+			atoms = append(atoms, globAtom{literal: p[i]})
+		}
+	}
+
+	return atoms, nil
+}
+
+//matchGlob reports whether the whole of s matches the pattern, see parseGlob for its syntax.
+//Unlike path.Match, "*" also matches "/" as the matched strings are names rather than paths.
+func matchGlob(pattern, s string) (bool, error) {
+	atoms, err := parseGlob(pattern)
+	if err != nil {
+		return false, err
+	}
+
+	str := []rune(s)
+	//star is the atom after the last star, from is the rune at which the atoms after it are tried next
+	star, from := -1, 0
+	a, i := 0, 0
+	for i < len(str) {
+		if a < len(atoms) && atoms[a].star {
+			star, from = a+1, i
+			a++
+		} else if a < len(atoms) && atoms[a].matches(str[i]) {
+			a++
+			i++
+		} else if star == -1 {
+			return false, nil
+		} else {
+			from++
+			a, i = star, from
+		}
+	}
+
+	for a < len(atoms) && atoms[a].star {
+		a++
+	}
+
+	return a == len(atoms), nil
+}
